@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Alias is a name resolving to one or more indexes. Requests for an alias
+// resolving to one index are served by that index, so clients can address
+// the alias while the index behind it is replaced. Searches for an alias
+// resolving to several indexes run across all of them.
+type Alias struct {
+	Name    string   `json:"name"`
+	Indexes []string `json:"indexes"`
+}
+
+// aliasesFile is the file in the root of the collections holding the
+// aliases.
+const aliasesFile = "aliases.json"
+
+var errIndexAliased = errors.New("index has an alias")
+
+var errAliasNotFound = func(name string) error { return fmt.Errorf("alias '%s' %w", name, errNotFound) }
+
+func (c *collections) aliasesPath() string {
+	return filepath.Join(c.root, aliasesFile)
+}
+
+// PutAlias points the alias to the indexes, creating the alias if needed.
+// The switch is atomic: requests resolve the alias either to its old
+// indexes or to the new ones. It fails with errIndexExists if there is an
+// index with the name of the alias.
+func (c *collections) PutAlias(name string, indexes []string) error {
+	if !indexName.MatchString(name) {
+		return fmt.Errorf("invalid alias name '%s'", name)
+	}
+	if len(indexes) == 0 {
+		return fmt.Errorf("alias requires an index")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.indexes[name]; ok {
+		return errIndexExists
+	}
+	seen := make(map[string]bool, len(indexes))
+	for _, index := range indexes {
+		if _, ok := c.indexes[index]; !ok {
+			return errIndexNotFound(index)
+		}
+		if seen[index] {
+			return fmt.Errorf("index '%s' listed twice", index)
+		}
+		seen[index] = true
+	}
+
+	aliases := c.copyAliases()
+	aliases[name] = append([]string(nil), indexes...)
+	return c.writeAliases(aliases)
+}
+
+// DeleteAlias removes the alias. The indexes it resolved to are kept.
+func (c *collections) DeleteAlias(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.aliases[name]; !ok {
+		return errAliasNotFound(name)
+	}
+	aliases := c.copyAliases()
+	delete(aliases, name)
+	return c.writeAliases(aliases)
+}
+
+// Aliases returns the aliases, sorted by name.
+func (c *collections) Aliases() []Alias {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make([]Alias, 0, len(c.aliases))
+	for name, indexes := range c.aliases {
+		out = append(out, Alias{Name: name, Indexes: indexes})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// resolve returns the indexes the names resolve to, in order and without
+// duplicates. A name is either the name of an index or an alias.
+func (c *collections) resolve(names []string) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var out []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for _, name := range names {
+		if indexes, ok := c.aliases[name]; ok {
+			for _, index := range indexes {
+				add(index)
+			}
+			continue
+		}
+		if _, ok := c.indexes[name]; !ok {
+			return nil, errIndexNotFound(name)
+		}
+		add(name)
+	}
+	return out, nil
+}
+
+// aliasOf returns the name of an alias resolving to the index, or an empty
+// string if there is none. The caller must hold mu.
+func (c *collections) aliasOf(index string) string {
+	for name, indexes := range c.aliases {
+		for _, i := range indexes {
+			if i == index {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// copyAliases returns a copy of the aliases to change. The caller must hold
+// mu.
+func (c *collections) copyAliases() map[string][]string {
+	out := make(map[string][]string, len(c.aliases)+1)
+	for name, indexes := range c.aliases {
+		out[name] = indexes
+	}
+	return out
+}
+
+// writeAliases persists the aliases and makes them the current ones. The
+// caller must hold mu.
+func (c *collections) writeAliases(aliases map[string][]string) error {
+	data, err := json.Marshal(aliases)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := writeFileAtomic(c.aliasesPath(), data); err != nil {
+		return fmt.Errorf("write aliases: %w", err)
+	}
+	c.aliases = aliases
+	return nil
+}
+
+// handleAliases lists the aliases.
+func (c *collections) handleAliases(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResp, err := json.Marshal(c.Aliases())
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
+
+// handleAlias serves /aliases/{name}. PUT points the alias to the indexes
+// listed in the body, like {"indexes": ["wiki_v2"]}, GET returns the alias
+// and DELETE removes it.
+func (c *collections) handleAlias(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/aliases/")
+
+	switch req.Method {
+	case "PUT":
+		var alias Alias
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err != nil {
+			log.Printf("read body: %v", err)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &alias); err != nil {
+			log.Printf("unmarshal: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = c.PutAlias(name, alias.Indexes)
+		if errors.Is(err, errIndexExists) {
+			log.Printf("put alias: %v", err)
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("put alias: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		c.mu.RLock()
+		indexes, ok := c.aliases[name]
+		c.mu.RUnlock()
+		if !ok {
+			log.Printf("alias %s not found", name)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		jsonResp, err := json.Marshal(Alias{Name: name, Indexes: indexes})
+		if err != nil {
+			log.Printf("marshal: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonResp)
+	case "DELETE":
+		if err := c.DeleteAlias(name); err != nil {
+			log.Printf("delete alias: %v", err)
+			http.Error(w, "", errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// analyzer turns the text of documents and queries into terms. Documents
+// are split into tokens with the token patterns of the analyzer, and stop
+// words are left out of both documents and queries.
+type analyzer struct {
+	name      string
+	patterns  []string
+	stopWords map[string]bool
+}
+
+// englishStopWords are common English words carrying little meaning.
+var englishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if",
+	"in", "into", "is", "it", "no", "not", "of", "on", "or", "such", "that",
+	"the", "their", "then", "there", "these", "they", "this", "to", "was",
+	"will", "with",
+}
+
+// analyzers are the analyzers an index can be created with, by name. The
+// standard analyzer is the default: it finds tokens like e-mail addresses,
+// URLs and numbers. The english analyzer also leaves out English stop
+// words, and the whitespace analyzer only splits text on whitespace.
+var analyzers = map[string]*analyzer{
+	"standard": {
+		name:     "standard",
+		patterns: patterns,
+	},
+	"english": {
+		name:      "english",
+		patterns:  patterns,
+		stopWords: stringSet(englishStopWords),
+	},
+	"whitespace": {
+		name:     "whitespace",
+		patterns: []string{`\S+`},
+	},
+}
+
+const defaultAnalyzer = "standard"
+
+func stringSet(values []string) map[string]bool {
+	out := make(map[string]bool, len(values))
+	for _, v := range values {
+		out[v] = true
+	}
+	return out
+}
+
+// lookupAnalyzer returns the analyzer with the given name, or the default
+// analyzer if the name is empty.
+func lookupAnalyzer(name string) (*analyzer, error) {
+	if name == "" {
+		name = defaultAnalyzer
+	}
+	a, ok := analyzers[name]
+	if !ok {
+		names := make([]string, 0, len(analyzers))
+		for n := range analyzers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown analyzer '%s', must be one of %s", name, strings.Join(names, ", "))
+	}
+	return a, nil
+}
+
+// analyze tokenizes the document from the reader.
+func (a *analyzer) analyze(r io.Reader) (analyzedDoc, error) {
+	doc := analyzedDoc{
+		terms: make(map[string]*analyzedTerm),
+	}
+
+	tokenizer := newTokenizer(r, a.patterns)
+	for tokenizer.HasMoreTokens() {
+		t, err := tokenizer.NextToken()
+		if err != nil {
+			return analyzedDoc{}, fmt.Errorf("next token: %w", err)
+		}
+		if t == "" {
+			break
+		}
+		if a.stopWords[t] {
+			continue
+		}
+
+		at, ok := doc.terms[t]
+		if !ok {
+			at = &analyzedTerm{}
+			doc.terms[t] = at
+		}
+		at.positions = append(at.positions, doc.length)
+		at.offsets = append(at.offsets, tokenizer.Offset())
+		doc.length++
+	}
+	return doc, nil
+}
+
+// filter returns the query terms without the stop words.
+func (a *analyzer) filter(terms []QueryTerm) []QueryTerm {
+	if len(a.stopWords) == 0 {
+		return terms
+	}
+	out := make([]QueryTerm, 0, len(terms))
+	for _, t := range terms {
+		if !a.stopWords[t.Token] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzers(t *testing.T) {
+	text := "The cat is on the mat, see http://example.com"
+
+	english, err := lookupAnalyzer("english")
+	require.Nil(t, err)
+	doc, err := english.analyze(strings.NewReader(text))
+	require.Nil(t, err)
+	require.Equal(t, 4, doc.length)
+	require.Contains(t, doc.terms, "cat")
+	require.NotContains(t, doc.terms, "the")
+	require.Equal(t, []int{1}, doc.terms["mat"].positions)
+	require.Equal(t, []int{strings.Index(text, "mat")}, doc.terms["mat"].offsets)
+
+	whitespace, err := lookupAnalyzer("whitespace")
+	require.Nil(t, err)
+	doc, err = whitespace.analyze(strings.NewReader(text))
+	require.Nil(t, err)
+	require.Contains(t, doc.terms, "mat,")
+
+	standard, err := lookupAnalyzer("")
+	require.Nil(t, err)
+	require.Equal(t, "standard", standard.name)
+	require.Equal(t, []QueryTerm{{Token: "the"}}, standard.filter([]QueryTerm{{Token: "the"}}))
+	require.Equal(t, []QueryTerm{{Token: "cat"}}, english.filter([]QueryTerm{{Token: "the"}, {Token: "cat"}}))
+
+	_, err = lookupAnalyzer("klingon")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Batch is a list of changes applied to the index at once, see
+// Index.Prepare. Documents are tokenized as they're added to the batch, so
+// the index is only locked while the changes are applied.
+//
+// Documents are analyzed with the standard analyzer, unless the batch is
+// created with newBatch.
+type Batch struct {
+	ops      []batchOp
+	analyzer *analyzer
+}
+
+// newBatch returns a batch analyzing documents with the analyzer.
+func newBatch(a *analyzer) *Batch {
+	return &Batch{
+		analyzer: a,
+	}
+}
+
+type batchOpKind int
+
+const (
+	opIndex batchOpKind = iota
+	opUpdate
+	opDelete
+)
+
+type batchOp struct {
+	kind       batchOpKind
+	externalID string
+	doc        analyzedDoc
+	fields     Fields
+
+	// id is the ID to index the document as, if fixedID is set.
+	id      int
+	fixedID bool
+}
+
+// Index adds a document to the batch. If its fields hold an external ID
+// already in use, the document replaces the existing one.
+func (b *Batch) Index(r io.Reader, fields Fields) error {
+	return b.add(opIndex, r, fields)
+}
+
+// Update adds a document replacing the one with the same external ID to the
+// batch. The change fails if there is no such document.
+func (b *Batch) Update(r io.Reader, fields Fields) error {
+	if fields.first(externalIDField) == "" {
+		return fmt.Errorf("update requires an external ID")
+	}
+	return b.add(opUpdate, r, fields)
+}
+
+// IndexAs adds a document to the batch like Index, but with the given ID
+// instead of the next free one. The change fails if the ID is lower than the
+// next free one. It's used to restore documents with their original IDs.
+func (b *Batch) IndexAs(id int, r io.Reader, fields Fields) error {
+	if err := b.add(opIndex, r, fields); err != nil {
+		return err
+	}
+	b.ops[len(b.ops)-1].id = id
+	b.ops[len(b.ops)-1].fixedID = true
+	return nil
+}
+
+func (b *Batch) add(kind batchOpKind, r io.Reader, fields Fields) error {
+	a := b.analyzer
+	if a == nil {
+		a = analyzers[defaultAnalyzer]
+	}
+	text := newExtractor(fields.first(contentTypeField), r)
+	doc, err := a.analyze(text)
+	if err != nil {
+		return fmt.Errorf("analyze: %w", err)
+	}
+	fields = withExtracted(fields, text.Fields())
+	b.ops = append(b.ops, batchOp{
+		kind:       kind,
+		externalID: fields.first(externalIDField),
+		doc:        doc,
+		fields:     fields,
+	})
+	return nil
+}
+
+// Delete adds the deletion of the document with the given external ID to the
+// batch.
+func (b *Batch) Delete(externalID string) {
+	b.ops = append(b.ops, batchOp{
+		kind:       opDelete,
+		externalID: externalID,
+	})
+}
+
+// Len returns the number of changes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// BatchResult is the outcome of one change in a batch.
+type BatchResult struct {
+	// ID is the ID of the indexed document, or of the deleted one for
+	// deletions.
+	ID int
+
+	// Removed holds the IDs of the documents removed from the index by
+	// the change, either deleted or replaced.
+	Removed []int
+
+	Err error
+}
+
+var errExternalIDNotInIndex = func(externalID string) error {
+	return fmt.Errorf("document '%s' %w in index", externalID, errNotFound)
+}
+
+var errIDInUse = func(id int) error { return fmt.Errorf("document ID %d already assigned", id) }
+
+var errTxnConflict = errors.New("index changed since the transaction was prepared")
+
+// Txn holds the changes of a batch, prepared for committing to the index.
+// IDs are assigned and external IDs resolved when a transaction is
+// prepared, so the IDs are known before anything is changed.
+type Txn struct {
+	ops     []batchOp
+	results []BatchResult
+
+	// first is the ID of the first document added by the transaction,
+	// next the ID of the first document after it. external holds the
+	// external IDs changed by the transaction, -1 for removed ones.
+	first    int
+	next     int
+	external map[string]int
+}
+
+// Prepare prepares the changes in the batch for committing, without changing
+// the index. It returns the result each change will have once committed, in
+// the order of the changes. A failing change doesn't stop the following
+// ones, and is left out of the transaction.
+//
+// Preparing and committing transactions must be serialized by the caller.
+func (idx *index) Prepare(b *Batch) (*Txn, []BatchResult) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return prepare(b, idx.nextID, idx.external)
+}
+
+// prepare prepares the changes in the batch against the next free ID and
+// the external IDs of an index, see Prepare. The caller must keep both
+// from changing.
+func prepare(b *Batch, nextID int, external map[string]int) (*Txn, []BatchResult) {
+	txn := &Txn{
+		results:  make([]BatchResult, len(b.ops)),
+		first:    nextID,
+		next:     nextID,
+		external: make(map[string]int),
+	}
+
+	lookup := func(externalID string) (int, bool) {
+		if id, ok := txn.external[externalID]; ok {
+			return id, id != -1
+		}
+		id, ok := external[externalID]
+		return id, ok
+	}
+
+	for i, op := range b.ops {
+		var old int
+		var exists bool
+		if op.externalID != "" {
+			old, exists = lookup(op.externalID)
+		}
+
+		if op.kind != opIndex && !exists {
+			txn.results[i] = BatchResult{Err: errExternalIDNotInIndex(op.externalID)}
+			continue
+		}
+		if op.fixedID {
+			if op.id < txn.next {
+				txn.results[i] = BatchResult{Err: errIDInUse(op.id)}
+				continue
+			}
+			txn.next = op.id
+		}
+
+		var res BatchResult
+		if op.kind == opDelete {
+			txn.external[op.externalID] = -1
+			res = BatchResult{ID: old, Removed: []int{old}}
+		} else {
+			res = BatchResult{ID: txn.next}
+			txn.next++
+			if op.externalID != "" {
+				txn.external[op.externalID] = res.ID
+			}
+			if exists {
+				res.Removed = []int{old}
+			}
+		}
+		txn.ops = append(txn.ops, op)
+		txn.results[i] = res
+	}
+
+	out := make([]BatchResult, len(txn.results))
+	copy(out, txn.results)
+	return txn, out
+}
+
+// Commit commits the transaction. The IDs it assigned are taken and its
+// documents can be looked up by external ID at once, but searches only see
+// the changes after the next refresh.
+//
+// It fails with errTxnConflict if documents were added since the
+// transaction was prepared.
+func (idx *index) Commit(txn *Txn) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := txn.take(&idx.nextID, idx.external); err != nil {
+		return err
+	}
+	idx.pending = append(idx.pending, txn)
+	return nil
+}
+
+// take takes the IDs assigned by the transaction from the next free ID of
+// an index, and applies its changes to the external IDs of the index. It
+// fails with errTxnConflict if the next free ID changed since the
+// transaction was prepared.
+func (txn *Txn) take(nextID *int, external map[string]int) error {
+	if *nextID != txn.first {
+		return errTxnConflict
+	}
+	*nextID = txn.next
+
+	for externalID, id := range txn.external {
+		if id == -1 {
+			delete(external, externalID)
+			continue
+		}
+		external[externalID] = id
+	}
+	return nil
+}
+
+// checkRemovals returns an error if the transaction removes a document
+// that isn't in the index after the transactions before it. exists holds
+// the documents those transactions added, true, and removed, false, and
+// inIndex tells whether any other document is in the index. If the check
+// passes, exists is updated with the changes of the transaction.
+func (txn *Txn) checkRemovals(exists map[int]bool, inIndex func(id int) bool) error {
+	changes := make(map[int]bool)
+	has := func(id int) bool {
+		if ok, found := changes[id]; found {
+			return ok
+		}
+		if ok, found := exists[id]; found {
+			return ok
+		}
+		return inIndex(id)
+	}
+
+	i := 0
+	for _, res := range txn.results {
+		if res.Err != nil {
+			continue
+		}
+		op := txn.ops[i]
+		i++
+
+		if op.kind != opDelete {
+			changes[res.ID] = true
+		}
+		for _, id := range res.Removed {
+			if !has(id) {
+				return errDocNotInIndex(id)
+			}
+			changes[id] = false
+		}
+	}
+
+	for id, ok := range changes {
+		exists[id] = ok
+	}
+	return nil
+}
+
+// Refresh makes the changes of all committed transactions visible to
+// searches. The index is locked once and its version changes once, so
+// searches either see all of the changes or none of them. It reports
+// whether there were any changes.
+//
+// Transactions removing documents that aren't in the index are checked for
+// before anything is changed. They are dropped and reported, and the
+// changes of the others are made.
+func (idx *index) Refresh() (bool, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if len(idx.pending) == 0 {
+		return false, nil
+	}
+
+	txns, err := checkPending(idx.pending, func(id int) bool {
+		_, ok := idx.vectors[id]
+		return ok
+	})
+	for _, txn := range txns {
+		i := 0
+		for _, res := range txn.results {
+			if res.Err != nil {
+				continue
+			}
+			op := txn.ops[i]
+			i++
+
+			if op.kind != opDelete {
+				idx.addAs(res.ID, op.doc)
+				idx.values.set(res.ID, op.fields)
+			}
+			for _, id := range res.Removed {
+				if err := idx.remove(id); err != nil {
+					return false, fmt.Errorf("remove: %w", err)
+				}
+			}
+		}
+	}
+	idx.pending = nil
+	idx.version++
+	return true, err
+}
+
+// checkPending checks the removals of the pending transactions against the
+// documents in an index, see Txn.checkRemovals, and returns the
+// transactions that pass. The error reports those that don't.
+func checkPending(pending []*Txn, inIndex func(id int) bool) ([]*Txn, error) {
+	var txns []*Txn
+	var errs []string
+	exists := make(map[int]bool)
+	for _, txn := range pending {
+		if err := txn.checkRemovals(exists, inIndex); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		txns = append(txns, txn)
+	}
+	if len(errs) > 0 {
+		return txns, fmt.Errorf("dropped %d transactions: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return txns, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxn(t *testing.T) {
+	idx := NewIndex()
+
+	var b Batch
+	require.Nil(t, b.Index(strings.NewReader("hello world"), Fields{externalIDField: {"a"}}))
+	require.Nil(t, b.Index(strings.NewReader("hello again"), Fields{externalIDField: {"b"}}))
+	require.Nil(t, b.Index(strings.NewReader("goodbye world"), Fields{externalIDField: {"a"}}))
+	require.Nil(t, b.Update(strings.NewReader("hello"), Fields{externalIDField: {"c"}}))
+	b.Delete("b")
+	b.Delete("b")
+	require.Equal(t, 6, b.Len())
+
+	txn, res := idx.Prepare(&b)
+	require.Equal(t, []BatchResult{
+		{ID: 0},
+		{ID: 1},
+		{ID: 2, Removed: []int{0}},
+		{Err: errExternalIDNotInIndex("c")},
+		{ID: 1, Removed: []int{1}},
+		{Err: errExternalIDNotInIndex("b")},
+	}, res)
+
+	// Nothing changes until the transaction is committed and refreshed.
+	_, ok := idx.Lookup("a")
+	require.False(t, ok)
+
+	version := idx.Version()
+	require.Nil(t, idx.Commit(txn))
+	id, ok := idx.Lookup("a")
+	require.True(t, ok)
+	require.Equal(t, 2, id)
+	require.Equal(t, version, idx.Version())
+	require.Equal(t, 0, idx.DocCount())
+
+	refreshed, err := idx.Refresh()
+	require.Nil(t, err)
+	require.True(t, refreshed)
+	require.Equal(t, version+1, idx.Version())
+	require.Equal(t, []int{2}, idx.DocIDs())
+	require.Equal(t, "a", idx.Fields(2).first(externalIDField))
+
+	_, err = idx.Postings("hello")
+	require.Equal(t, errTokenNotInIndex("hello"), err)
+
+	refreshed, err = idx.Refresh()
+	require.Nil(t, err)
+	require.False(t, refreshed)
+
+	require.NotNil(t, b.Update(strings.NewReader("hello"), Fields{}))
+}
+
+func TestTxnConflict(t *testing.T) {
+	idx := NewIndex()
+
+	var b Batch
+	require.Nil(t, b.Index(strings.NewReader("hello"), Fields{}))
+	txn, _ := idx.Prepare(&b)
+
+	_, err := idx.IndexDocument(strings.NewReader("world"))
+	require.Nil(t, err)
+	require.Equal(t, errTxnConflict, idx.Commit(txn))
+}
+
+func TestRefreshDropsFailingTxn(t *testing.T) {
+	idx := NewIndex()
+	commit := func(source, externalID string) {
+		t.Helper()
+		var b Batch
+		require.Nil(t, b.Index(strings.NewReader(source), Fields{externalIDField: {externalID}}))
+		txn, _ := idx.Prepare(&b)
+		require.Nil(t, idx.Commit(txn))
+	}
+
+	commit("hello", "a")
+	_, err := idx.Refresh()
+	require.Nil(t, err)
+
+	// The replaced document is gone by the time the transaction replacing
+	// it is refreshed.
+	commit("hello again", "a")
+	require.Nil(t, idx.Delete(0))
+	commit("world", "b")
+
+	refreshed, err := idx.Refresh()
+	require.NotNil(t, err)
+	require.True(t, refreshed)
+	require.Equal(t, []int{2}, idx.DocIDs())
+	_, err = idx.Postings("again")
+	require.NotNil(t, err)
+
+	refreshed, err = idx.Refresh()
+	require.Nil(t, err)
+	require.False(t, refreshed)
+	require.Equal(t, []int{2}, idx.DocIDs())
+}
+
+// failingStore fails to store the document with the given ID.
+type failingStore struct {
+	Store
+	id int
+}
+
+func (s failingStore) PutFromStream(r io.Reader, id int) error {
+	if id == s.id {
+		return errors.New("disk full")
+	}
+	return s.Store.PutFromStream(r, id)
+}
+
+func TestCommitRollback(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(filepath.Join(dir, "wal"), syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	s.store = failingStore{Store: s.store, id: 1}
+
+	ops := []walOp{
+		{Action: actionIndex, Fields: Fields{}, Source: []byte("hello")},
+		{Action: actionIndex, Fields: Fields{}, Source: []byte("world")},
+	}
+	var b Batch
+	for _, op := range ops {
+		require.Nil(t, op.addTo(&b))
+	}
+
+	_, err = s.commit(&b, ops, true)
+	require.NotNil(t, err)
+
+	// Neither document is indexed, stored or logged.
+	require.Equal(t, 0, s.idx.DocCount())
+	_, err = s.store.Get(0)
+	require.True(t, errors.Is(err, errNotFound))
+	require.Empty(t, replayAll(t, w))
+}
+
+// TestBulkSourceBase64 indexes a source that isn't valid UTF-8 through the
+// bulk endpoint.
+func TestBulkSourceBase64(t *testing.T) {
+	idx := NewIndex()
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+	h := NewService(idx, NewQuerier(idx), store, Config{}).(*service).Handler()
+
+	source := []byte("caf\xe9 au lait")
+	line, err := json.Marshal(BulkAction{Action: actionIndex, ID: "latin1", SourceBase64: source})
+	require.Nil(t, err)
+	code, _ := do(t, h, "POST", "/bulk?refresh=true", string(line))
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, h, "GET", "/doc/0", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, string(source), body)
+
+	code, body = do(t, h, "POST", "/bulk", `{"action": "index", "source": "a", "source_base64": "Yg=="}`)
+	require.Equal(t, http.StatusOK, code)
+	var res BulkResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.True(t, res.Errors)
+	require.Equal(t, http.StatusBadRequest, res.Items[0].Status)
+}
+
+// TestRefreshRemovesReplaced replaces a document and checks that its old
+// version is kept in the store until the refresh that hides it.
+func TestRefreshRemovesReplaced(t *testing.T) {
+	idx := NewIndex()
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+	s := NewService(idx, NewQuerier(idx), store, Config{RefreshInterval: time.Hour}).(*service)
+	h := s.Handler()
+
+	code, _ := do(t, h, "POST", "/doc?id=a&refresh=true", "old version")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(t, h, "POST", "/doc?id=a", "new version")
+	require.Equal(t, http.StatusOK, code)
+
+	var res GetResponseBody
+	code, body := do(t, h, "GET", "/search/union?query=version", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, 1, res.Hits)
+	require.Equal(t, "old version", res.Documents[0].Source)
+
+	code, _ = do(t, h, "POST", "/refresh", "")
+	require.Equal(t, http.StatusOK, code)
+	code, body = do(t, h, "GET", "/search/union?query=version", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, 1, res.Hits)
+	require.Equal(t, "new version", res.Documents[0].Source)
+	_, err = store.Get(0)
+	require.True(t, errors.Is(err, errNotFound))
+}
+
+// conflictingIndex fails to commit transactions.
+type conflictingIndex struct {
+	Index
+}
+
+func (conflictingIndex) Commit(txn *Txn) error {
+	return errTxnConflict
+}
+
+func TestCommitConflictRollback(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(filepath.Join(dir, "wal"), syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	require.Nil(t, s.recover())
+	s.idx = conflictingIndex{Index: s.idx}
+
+	ops := []walOp{{Action: actionIndex, Fields: Fields{}, Source: []byte("hello")}}
+	var b Batch
+	require.Nil(t, ops[0].addTo(&b))
+
+	_, err = s.commit(&b, ops, true)
+	require.True(t, errors.Is(err, errTxnConflict))
+
+	// The record is truncated and the source removed again.
+	require.Equal(t, 0, w.Len())
+	require.Empty(t, replayAll(t, w))
+	_, err = s.store.Get(0)
+	require.True(t, errors.Is(err, errNotFound))
+}
+
+// TestBulkLimits sends a bulk request with a line too long for the largest
+// document, and an empty one.
+func TestBulkLimits(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(filepath.Join(dir, "wal"), syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	require.Nil(t, s.recover())
+	s.maxDocSize = 5
+	h := s.Handler()
+
+	long := `{"action": "index", "source": "` + strings.Repeat("a", int(bulkLineLimit(s.maxDocSize))) + `"}`
+	code, body := do(t, h, "POST", "/bulk", long+"\n"+`{"action": "index", "source": "short"}`)
+	require.Equal(t, http.StatusOK, code)
+	var res BulkResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Len(t, res.Items, 2)
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.Items[0].Status)
+	require.Equal(t, http.StatusCreated, res.Items[1].Status)
+	require.Equal(t, 1, w.Len())
+
+	// Nothing is committed without actions.
+	code, body = do(t, h, "POST", "/bulk", "\n")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Empty(t, res.Items)
+	require.Equal(t, 1, w.Len())
+}
@@ -0,0 +1,57 @@
+package main
+
+import "math/bits"
+
+// bitset is a set of document IDs.
+type bitset []uint64
+
+// newBitset returns a bitset holding the document IDs of the postings list.
+func newBitset(postings []Posting) bitset {
+	var b bitset
+	for _, p := range postings {
+		b = b.set(p.DocID)
+	}
+	return b
+}
+
+// set adds the ID to the set, growing it if needed.
+func (b bitset) set(id int) bitset {
+	i := id / 64
+	for len(b) <= i {
+		b = append(b, 0)
+	}
+	b[i] |= 1 << uint(id%64)
+	return b
+}
+
+// has reports whether the ID is in the set.
+func (b bitset) has(id int) bool {
+	i := id / 64
+	if i >= len(b) {
+		return false
+	}
+	return b[i]&(1<<uint(id%64)) != 0
+}
+
+// len returns the number of IDs in the set.
+func (b bitset) len() int {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// postings returns the IDs of the set as a postings list without
+// frequencies, in ascending order.
+func (b bitset) postings() []Posting {
+	out := make([]Posting, 0, b.len())
+	for i, w := range b {
+		for w != 0 {
+			j := bits.TrailingZeros64(w)
+			out = append(out, Posting{DocID: i*64 + j})
+			w &= w - 1
+		}
+	}
+	return out
+}
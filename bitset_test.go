@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitset(t *testing.T) {
+	postings := []Posting{{DocID: 0}, {DocID: 63}, {DocID: 64}, {DocID: 200}}
+	b := newBitset(postings)
+
+	require.Equal(t, 4, b.len())
+	require.True(t, b.has(64))
+	require.False(t, b.has(1))
+	require.False(t, b.has(1000))
+	require.Equal(t, postings, b.postings())
+
+	require.Equal(t, []Posting{}, bitset(nil).postings())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats holds the counters of a cache.
+type CacheStats struct {
+	Hits      int `json:"hits"`
+	Misses    int `json:"misses"`
+	Evictions int `json:"evictions"`
+	Entries   int `json:"entries"`
+	Capacity  int `json:"capacity"`
+}
+
+// lruCache is a least recently used cache of versioned values. A value is
+// only returned for the version of the index it was computed from, so writes
+// to the index invalidate all values computed before them.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	key     string
+	version uint64
+	value   interface{}
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the value cached for the key if it was computed from the
+// given version. Stale values are dropped.
+func (c *lruCache) Get(key string, version uint64) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if e.version != version {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	c.stats.Hits++
+	return e.value, true
+}
+
+// Put caches the value computed from the given version, evicting the least
+// recently used value if the cache is full.
+func (c *lruCache) Put(key string, version uint64, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capacity <= 0 {
+		return
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key: key, version: version, value: value}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	for c.order.Len() >= c.capacity {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, version: version, value: value})
+}
+
+// Stats returns the counters of the cache.
+func (c *lruCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
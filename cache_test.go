@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+
+	_, ok := c.Get("a", 0)
+	require.False(t, ok)
+
+	c.Put("a", 0, 1)
+	c.Put("b", 0, 2)
+
+	v, ok := c.Get("a", 0)
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	// b is the least recently used entry and gets evicted.
+	c.Put("c", 0, 3)
+	_, ok = c.Get("b", 0)
+	require.False(t, ok)
+
+	// Values from older versions of the index are stale.
+	_, ok = c.Get("a", 1)
+	require.False(t, ok)
+	_, ok = c.Get("a", 0)
+	require.False(t, ok)
+
+	require.Equal(t, CacheStats{
+		Hits:      1,
+		Misses:    4,
+		Evictions: 1,
+		Entries:   1,
+		Capacity:  2,
+	}, c.Stats())
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coordinator serves one logical index from several data nodes, each a
+// service of its own. Documents are routed to a node by a hash of their
+// external ID, and searches are sent to all nodes and their hits merged.
+// Since routing depends on the position of a node, the nodes must always
+// be listed in the same order.
+//
+// A node that is down or failing doesn't fail searches: the hits of the
+// other nodes are returned, with the failed nodes reported in the response.
+// Documents routed to a failing node are rejected with 503 Service
+// Unavailable.
+type coordinator struct {
+	addr       string
+	nodes      []string
+	client     *http.Client
+	timeout    time.Duration
+	maxDocSize int64
+}
+
+// newCoordinator returns a coordinator for the nodes, given by their base
+// URLs. Searches and refreshes fail on a node after the timeout. Documents
+// are forwarded without one, since uploading a large document may take
+// longer, and the node may commit it after the coordinator gave up on it.
+// maxDocSize bounds the actions of bulk requests, see bulkLineLimit.
+func newCoordinator(addr string, nodes []string, timeout time.Duration, maxDocSize int64) *coordinator {
+	return &coordinator{
+		addr:       addr,
+		nodes:      nodes,
+		client:     &http.Client{},
+		timeout:    timeout,
+		maxDocSize: maxDocSize,
+	}
+}
+
+func (c *coordinator) Start() error {
+	return http.ListenAndServe(c.addr, c.Handler())
+}
+
+// Handler returns the HTTP handler serving the endpoints of the
+// coordinator.
+func (c *coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search/intersection", func(w http.ResponseWriter, req *http.Request) {
+		c.handleSearch(w, req, "intersection")
+	})
+	mux.HandleFunc("/search/phrase", func(w http.ResponseWriter, req *http.Request) {
+		c.handleSearch(w, req, "phrase")
+	})
+	mux.HandleFunc("/search/union", func(w http.ResponseWriter, req *http.Request) {
+		c.handleSearch(w, req, "union")
+	})
+	mux.HandleFunc("/doc", c.handleDoc)
+	mux.HandleFunc("/bulk", c.handleBulk)
+	mux.HandleFunc("/refresh", c.handleRefresh)
+	return mux
+}
+
+// nodeOf returns the number of the node holding the document with the given
+// external ID.
+func (c *coordinator) nodeOf(externalID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(externalID))
+	return int(h.Sum32() % uint32(len(c.nodes)))
+}
+
+// newExternalID returns a random external ID for a document posted without
+// one, so it can be routed to a node.
+func newExternalID() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NodesStatus reports the nodes a request was sent to. If any of them
+// failed, the response only holds the results of the others.
+type NodesStatus struct {
+	Total      int           `json:"total"`
+	Successful int           `json:"successful"`
+	Failed     int           `json:"failed"`
+	Failures   []NodeFailure `json:"failures,omitempty"`
+}
+
+// NodeFailure is a node that failed a request.
+type NodeFailure struct {
+	Node  string `json:"node"`
+	Error string `json:"error"`
+}
+
+// ClusterSearchResponse is a page of hits merged from all nodes.
+type ClusterSearchResponse struct {
+	GetResponseBody
+	Nodes NodesStatus `json:"nodes"`
+}
+
+// nodeResponse is the response of a node, or the error if it failed.
+type nodeResponse struct {
+	status int
+	body   []byte
+	err    error
+}
+
+// send sends a request to the node and reads the response. The node failed
+// if it couldn't be reached or responded with a server error.
+func (c *coordinator) send(ctx context.Context, method, target, contentType string, body io.Reader, contentLength int64) nodeResponse {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nodeResponse{err: fmt.Errorf("new request: %w", err)}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if contentLength > 0 {
+		req.ContentLength = contentLength
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nodeResponse{err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nodeResponse{err: fmt.Errorf("read response: %w", err)}
+	}
+	if resp.StatusCode >= 500 {
+		return nodeResponse{status: resp.StatusCode, body: data, err: fmt.Errorf("node responded %s", resp.Status)}
+	}
+	return nodeResponse{status: resp.StatusCode, body: data}
+}
+
+// broadcast sends a request without a body to every node in parallel, and
+// returns their responses in the order of the nodes. Nodes that don't
+// respond within the timeout fail.
+func (c *coordinator) broadcast(ctx context.Context, method, pathAndQuery string) ([]nodeResponse, NodesStatus) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	responses := make([]nodeResponse, len(c.nodes))
+	var wg sync.WaitGroup
+	for i, node := range c.nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			responses[i] = c.send(ctx, method, node+pathAndQuery, "", nil, 0)
+		}(i, node)
+	}
+	wg.Wait()
+	return responses, c.status(responses)
+}
+
+// status summarizes the responses of the nodes.
+func (c *coordinator) status(responses []nodeResponse) NodesStatus {
+	status := NodesStatus{
+		Total: len(responses),
+	}
+	for i, r := range responses {
+		if r.err != nil {
+			log.Printf("node %s: %v", c.nodes[i], r.err)
+			status.Failed++
+			status.Failures = append(status.Failures, NodeFailure{
+				Node:  c.nodes[i],
+				Error: r.err.Error(),
+			})
+			continue
+		}
+		status.Successful++
+	}
+	return status
+}
+
+// handleSearch runs a query of the given type on all nodes and returns one
+// page of the merged hits, see service.handleSearch. Hits are merged by
+// score, with the scores of each node ranked by the statistics of that
+// node. Sorting by fields and cursors aren't supported.
+//
+// If some nodes fail, the page holds the hits of the others. If all of
+// them fail, the search fails with 503 Service Unavailable.
+func (c *coordinator) handleSearch(w http.ResponseWriter, req *http.Request, typ string) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+	if len(q.Get("query")) == 0 {
+		log.Printf("no query provided")
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseSearchParams(req)
+	if err != nil {
+		log.Printf("search params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Get("sort") != "" || params.after != nil {
+		log.Printf("sort or cursor in cluster")
+		http.Error(w, "sort and after aren't supported by the coordinator", http.StatusBadRequest)
+		return
+	}
+
+	// Every node returns its hits up to the end of the page, so the page
+	// can be cut from the merged hits.
+	q.Set("from", "0")
+	q.Set("size", strconv.Itoa(params.from+params.size))
+	responses, status := c.broadcast(req.Context(), "GET", "/search/"+typ+"?"+q.Encode())
+
+	var pages []GetResponseBody
+	for i, r := range responses {
+		if r.err != nil {
+			continue
+		}
+		if r.status != http.StatusOK {
+			// The query itself is invalid, so it fails on every node.
+			log.Printf("node %s: status %d", c.nodes[i], r.status)
+			http.Error(w, strings.TrimSpace(string(r.body)), r.status)
+			return
+		}
+
+		var page GetResponseBody
+		if err := json.Unmarshal(r.body, &page); err != nil {
+			log.Printf("unmarshal response of %s: %v", c.nodes[i], err)
+			http.Error(w, "", http.StatusBadGateway)
+			return
+		}
+		for j := range page.Documents {
+			page.Documents[j].Node = c.nodes[i]
+		}
+		pages = append(pages, page)
+	}
+	if status.Successful == 0 {
+		log.Printf("search: all nodes failed")
+		http.Error(w, "", http.StatusServiceUnavailable)
+		return
+	}
+
+	jsonResp, err := json.Marshal(ClusterSearchResponse{
+		GetResponseBody: mergePages(pages, params.from, params.size),
+		Nodes:           status,
+	})
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
+
+// handleDoc forwards a posted document to the node it's routed to, see
+// service.handleDoc. Documents posted without an external ID are given a
+// random one. Asynchronous indexing isn't supported, since jobs are local
+// to the nodes.
+func (c *coordinator) handleDoc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+	if q.Get("async") != "" {
+		log.Printf("async in cluster")
+		http.Error(w, "async isn't supported by the coordinator", http.StatusBadRequest)
+		return
+	}
+	if q.Get("id") == "" {
+		id, err := newExternalID()
+		if err != nil {
+			log.Printf("new external id: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		q.Set("id", id)
+	}
+
+	node := c.nodes[c.nodeOf(q.Get("id"))]
+	r := c.send(req.Context(), "POST", node+"/doc?"+q.Encode(), req.Header.Get("Content-Type"), req.Body, req.ContentLength)
+	if r.err != nil {
+		log.Printf("node %s: %v", node, r.err)
+		http.Error(w, "", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body)
+}
+
+// handleBulk splits the actions of a bulk request by the nodes they're
+// routed to, see service.handleBulk, and streams them to the nodes in
+// parallel as they're read. Index actions without an ID are given a random
+// one. The actions of a failing node fail with 503 Service Unavailable.
+func (c *coordinator) handleBulk(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := url.Values{}
+	if v := req.URL.Query().Get("refresh"); v != "" {
+		query.Set("refresh", v)
+	}
+
+	var resp BulkResponseBody
+	// items holds the positions in the response of the actions sent to
+	// each node.
+	items := make([][]int, len(c.nodes))
+	streams := make([]*bulkStream, len(c.nodes))
+	stream := func(n int) *bulkStream {
+		if streams[n] == nil {
+			streams[n] = c.streamBulk(req.Context(), c.nodes[n]+"/bulk?"+query.Encode())
+		}
+		return streams[n]
+	}
+	// finish ends the requests to the nodes, failing them with err if
+	// it's not nil, and waits for their responses.
+	finish := func(err error) {
+		for _, st := range streams {
+			if st != nil {
+				st.w.CloseWithError(err)
+			}
+		}
+		for _, st := range streams {
+			if st != nil {
+				<-st.done
+			}
+		}
+	}
+
+	fail := func(item BulkItem, status int, err error) {
+		item.Status = status
+		item.Error = err.Error()
+		resp.Items = append(resp.Items, item)
+		resp.Errors = true
+	}
+
+	r := bufio.NewReader(req.Body)
+	for {
+		line, tooLong, err := readBulkLine(r, bulkLineLimit(c.maxDocSize))
+		if err != nil && err != io.EOF {
+			log.Printf("read: %v", err)
+			finish(err)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		if tooLong {
+			fail(BulkItem{}, http.StatusRequestEntityTooLarge, errDocTooLarge)
+		} else if len(bytes.TrimSpace(line)) != 0 {
+			var action BulkAction
+			if err := json.Unmarshal(line, &action); err != nil {
+				fail(BulkItem{}, http.StatusBadRequest, fmt.Errorf("invalid action: %w", err))
+			} else {
+				if action.ID == "" && action.Action == actionIndex {
+					if action.ID, err = newExternalID(); err != nil {
+						log.Printf("new external id: %v", err)
+						finish(err)
+						http.Error(w, "", http.StatusInternalServerError)
+						return
+					}
+				}
+				data, err := json.Marshal(action)
+				if err != nil {
+					log.Printf("marshal: %v", err)
+					finish(err)
+					http.Error(w, "", http.StatusInternalServerError)
+					return
+				}
+
+				// A node that fails to take the action fails its
+				// response, which is checked below.
+				n := c.nodeOf(action.ID)
+				stream(n).w.Write(append(data, '\n'))
+				items[n] = append(items[n], len(resp.Items))
+				resp.Items = append(resp.Items, BulkItem{
+					Action:     action.Action,
+					ExternalID: action.ID,
+					Node:       c.nodes[n],
+				})
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	finish(nil)
+
+	responses := make([]nodeResponse, len(c.nodes))
+	for i, st := range streams {
+		if st != nil {
+			responses[i] = st.resp
+		}
+	}
+
+	for i, r := range responses {
+		if len(items[i]) == 0 {
+			continue
+		}
+
+		var nodeResp BulkResponseBody
+		err := r.err
+		if err == nil && r.status != http.StatusOK {
+			err = fmt.Errorf("node responded %d", r.status)
+		}
+		if err == nil {
+			if err = json.Unmarshal(r.body, &nodeResp); err == nil && len(nodeResp.Items) != len(items[i]) {
+				err = fmt.Errorf("node returned %d items for %d actions", len(nodeResp.Items), len(items[i]))
+			}
+		}
+		if err != nil {
+			log.Printf("node %s: %v", c.nodes[i], err)
+			for _, pos := range items[i] {
+				item := &resp.Items[pos]
+				item.Status = http.StatusServiceUnavailable
+				item.Error = err.Error()
+			}
+			resp.Errors = true
+			continue
+		}
+
+		for j, pos := range items[i] {
+			item := nodeResp.Items[j]
+			item.Node = c.nodes[i]
+			resp.Items[pos] = item
+		}
+		if nodeResp.Errors {
+			resp.Errors = true
+		}
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
+
+// bulkStream is a bulk request to a node, with the actions written to w as
+// they're read. done is closed once the node has responded with resp.
+type bulkStream struct {
+	w    *io.PipeWriter
+	done chan struct{}
+	resp nodeResponse
+}
+
+var errNodeResponded = errors.New("node responded")
+
+// streamBulk starts a bulk request to the target.
+func (c *coordinator) streamBulk(ctx context.Context, target string) *bulkStream {
+	pr, pw := io.Pipe()
+	st := &bulkStream{
+		w:    pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(st.done)
+		st.resp = c.send(ctx, "POST", target, "application/x-ndjson", pr, 0)
+		// A node may respond before it has read all actions.
+		pr.CloseWithError(errNodeResponded)
+	}()
+	return st
+}
+
+// handleRefresh refreshes all nodes, and responds with the status of the
+// nodes. It fails with 503 Service Unavailable if all nodes failed.
+func (c *coordinator) handleRefresh(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, status := c.broadcast(req.Context(), "POST", "/refresh")
+
+	jsonResp, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if status.Successful == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonResp)
+}
+
+// runCoordinator runs the coordinator of a cluster of data nodes until it
+// fails.
+func runCoordinator(args []string) error {
+	flags := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+	addr := flags.String("addr", ":5000", "address to listen on")
+	nodes := flags.String("nodes", "", "comma-separated base URLs of the data nodes, like http://localhost:5001, always in the same order")
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of searches and refreshes on the nodes, documents are forwarded without one")
+	maxDocSize := flags.Int64("max-doc-size", 1<<30, "largest document accepted in bulk requests in bytes, 0 for no limit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *nodes == "" {
+		return fmt.Errorf("-nodes is required")
+	}
+
+	var urls []string
+	for _, node := range strings.Split(*nodes, ",") {
+		urls = append(urls, strings.TrimSuffix(strings.TrimSpace(node), "/"))
+	}
+	return newCoordinator(*addr, urls, *timeout, *maxDocSize).Start()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startNode starts a data node on a port of its own.
+func startNode(t *testing.T) *httptest.Server {
+	t.Helper()
+	idx := NewIndex()
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+	s := NewService(idx, NewQuerier(idx), store, Config{}).(*service)
+	node := httptest.NewServer(s.Handler())
+	t.Cleanup(node.Close)
+	return node
+}
+
+// send sends a request to the server and returns the status and body of
+// the response.
+func send(t *testing.T, method, target, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, strings.NewReader(body))
+	require.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	return resp.StatusCode, string(data)
+}
+
+// TestCluster runs a coordinator with three data nodes, each listening on
+// a port of its own, and takes one of them down.
+func TestCluster(t *testing.T) {
+	nodes := []*httptest.Server{startNode(t), startNode(t), startNode(t)}
+	urls := make([]string, len(nodes))
+	for i, n := range nodes {
+		urls[i] = n.URL
+	}
+	coord := newCoordinator("", urls, time.Second, 0)
+	c := httptest.NewServer(coord.Handler())
+	defer c.Close()
+
+	search := func(query string) (int, ClusterSearchResponse) {
+		t.Helper()
+		var res ClusterSearchResponse
+		code, body := send(t, "GET", c.URL+"/search/union?"+query, "")
+		if code == http.StatusOK {
+			require.Nil(t, json.Unmarshal([]byte(body), &res))
+		}
+		return code, res
+	}
+
+	// Index documents one by one and in bulk.
+	for i := 0; i < 10; i++ {
+		code, _ := send(t, "POST", fmt.Sprintf("%s/doc?id=doc%d", c.URL, i), fmt.Sprintf("common document %d", i))
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, body := send(t, "POST", c.URL+"/doc", "common unnamed")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `"external_id"`)
+
+	var bulk []string
+	for i := 10; i < 20; i++ {
+		bulk = append(bulk, fmt.Sprintf(`{"action": "index", "id": "doc%d", "source": "common rare%d"}`, i, i))
+	}
+	bulk = append(bulk, `{"action": "delete", "id": "doc0"}`, `not json`)
+	code, body = send(t, "POST", c.URL+"/bulk?refresh=true", strings.Join(bulk, "\n"))
+	require.Equal(t, http.StatusOK, code)
+	var bulkResp BulkResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &bulkResp))
+	require.True(t, bulkResp.Errors)
+	require.Len(t, bulkResp.Items, 12)
+	require.Equal(t, http.StatusCreated, bulkResp.Items[0].Status)
+	require.Equal(t, "doc10", bulkResp.Items[0].ExternalID)
+	require.Equal(t, "deleted", bulkResp.Items[10].Result)
+	require.Equal(t, http.StatusBadRequest, bulkResp.Items[11].Status)
+
+	// Lines too long for the largest document fail without being routed.
+	coord.maxDocSize = 5
+	long := fmt.Sprintf(`{"action": "index", "id": "long", "source": "%s"}`, strings.Repeat("a", int(bulkLineLimit(5))))
+	code, body = send(t, "POST", c.URL+"/bulk", long+"\n"+`{"action": "index", "id": "doc1", "source": "common document 1"}`)
+	coord.maxDocSize = 0
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &bulkResp))
+	require.Len(t, bulkResp.Items, 2)
+	require.Equal(t, http.StatusRequestEntityTooLarge, bulkResp.Items[0].Status)
+	require.Equal(t, "updated", bulkResp.Items[1].Result)
+
+	code, body = send(t, "POST", c.URL+"/refresh", "")
+	require.Equal(t, http.StatusOK, code, body)
+
+	// Documents are spread over the nodes and searched on all of them.
+	code, res := search("query=common&size=5")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 20, res.Hits)
+	require.Len(t, res.Documents, 5)
+	require.Equal(t, NodesStatus{Total: 3, Successful: 3}, res.Nodes)
+	perNode := make(map[string]int)
+	for from := 0; from < 20; from += 5 {
+		_, res := search(fmt.Sprintf("query=common&from=%d&size=5", from))
+		for _, d := range res.Documents {
+			perNode[d.Node]++
+		}
+	}
+	require.Len(t, perNode, 3)
+
+	code, res = search("query=rare15+document")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 10, res.Hits)
+	require.Equal(t, "doc15", res.Documents[0].ExternalID)
+
+	// Terms missing on some nodes don't fail them.
+	code, body = send(t, "GET", c.URL+"/search/intersection?query=common+rare15", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `"successful":3`)
+
+	code, _ = search("query=common&sort=_id")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = search("query=common&size=-1")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// With a node down, searches return the hits of the others.
+	down := nodes[1]
+	down.Close()
+	code, res = search("query=common&size=20")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 2, res.Nodes.Successful)
+	require.Equal(t, 1, res.Nodes.Failed)
+	require.Equal(t, down.URL, res.Nodes.Failures[0].Node)
+	require.Less(t, res.Hits, 20)
+	require.Len(t, res.Documents, res.Hits)
+	for _, d := range res.Documents {
+		require.NotEqual(t, down.URL, d.Node)
+	}
+
+	// Documents routed to the node that is down fail, the others don't.
+	bulk = nil
+	for i := 20; i < 30; i++ {
+		bulk = append(bulk, fmt.Sprintf(`{"action": "index", "id": "doc%d", "source": "late"}`, i))
+	}
+	code, body = send(t, "POST", c.URL+"/bulk", strings.Join(bulk, "\n"))
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &bulkResp))
+	var unavailable int
+	for _, item := range bulkResp.Items {
+		if item.Node == down.URL {
+			require.Equal(t, http.StatusServiceUnavailable, item.Status)
+			unavailable++
+			continue
+		}
+		require.Equal(t, http.StatusCreated, item.Status)
+	}
+	require.NotZero(t, unavailable)
+
+	for i := 20; i < 30; i++ {
+		id := fmt.Sprintf("doc%d", i)
+		if urls[coord.nodeOf(id)] == down.URL {
+			code, _ := send(t, "POST", c.URL+"/doc?id="+id, "late")
+			require.Equal(t, http.StatusServiceUnavailable, code)
+			break
+		}
+	}
+
+	// With all nodes down, searches fail.
+	nodes[0].Close()
+	nodes[2].Close()
+	code, _ = search("query=common")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = send(t, "POST", c.URL+"/refresh", "")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+// TestClusterTimeout checks that only searches and refreshes time out, not
+// forwarded documents.
+func TestClusterTimeout(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	defer node.Close()
+	c := httptest.NewServer(newCoordinator("", []string{node.URL}, 10*time.Millisecond, 0).Handler())
+	defer c.Close()
+
+	code, _ := send(t, "POST", c.URL+"/doc?id=a", "slow")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = send(t, "POST", c.URL+"/bulk", `{"action": "index", "id": "b", "source": "slow"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = send(t, "GET", c.URL+"/search/union?query=slow", "")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	code, _ = send(t, "POST", c.URL+"/refresh", "")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collections are named indexes served by one service, each with its own
+// schema, analyzer, write-ahead log, store and snapshots in a directory of
+// its own under root.
+//
+// aliases maps alias names to the names of the indexes they resolve to, see
+// PutAlias. Indexes and aliases share one namespace.
+type collections struct {
+	mu      sync.RWMutex
+	root    string
+	cfg     collectionsConfig
+	indexes map[string]*collection
+	aliases map[string][]string
+}
+
+// collectionsConfig holds the settings shared by all named indexes, see
+// Config.
+type collectionsConfig struct {
+	policy          syncPolicy
+	syncInterval    time.Duration
+	refreshInterval time.Duration
+	compactInterval time.Duration
+	maxDocSize      int64
+	dedup           bool
+}
+
+type collection struct {
+	info    IndexInfo
+	svc     *service
+	handler http.Handler
+}
+
+// IndexConfig holds the settings of a named index. Analyzer is the name of
+// the analyzer of the index and Store the type of its store, files or
+// packed. Both default to the defaults of the service. Shards is the number
+// of shards the index is split into, see NewShardedIndex, and is fixed when
+// the index is created.
+type IndexConfig struct {
+	Analyzer string  `json:"analyzer,omitempty"`
+	Schema   *Schema `json:"schema,omitempty"`
+	Store    string  `json:"store,omitempty"`
+	Shards   int     `json:"shards,omitempty"`
+}
+
+// IndexInfo describes a named index.
+type IndexInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	IndexConfig
+	Docs int `json:"docs"`
+}
+
+// indexInfoFile is the file in the directory of a named index holding its
+// info.
+const indexInfoFile = "index.json"
+
+var indexName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+var errIndexExists = errors.New("index already exists")
+
+var errIndexNotFound = func(name string) error { return fmt.Errorf("index '%s' %w", name, errNotFound) }
+
+// openCollections opens the named indexes in the directory, creating it if
+// needed.
+func openCollections(root string, cfg collectionsConfig) (*collections, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	c := &collections{
+		root:    root,
+		cfg:     cfg,
+		indexes: make(map[string]*collection),
+		aliases: make(map[string][]string),
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, e.Name(), indexInfoFile))
+		if errors.Is(err, os.ErrNotExist) {
+			// Created but never finished, see Create.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read info of %s: %w", e.Name(), err)
+		}
+		var info IndexInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("unmarshal info of %s: %w", e.Name(), err)
+		}
+		col, err := c.open(info)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", info.Name, err)
+		}
+		c.indexes[info.Name] = col
+	}
+
+	data, err := os.ReadFile(c.aliasesPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read aliases: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &c.aliases); err != nil {
+			return nil, fmt.Errorf("unmarshal aliases: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// validate returns an error if the name or the settings of an index are
+// invalid.
+func (cfg IndexConfig) validate(name string) error {
+	if !indexName.MatchString(name) {
+		return fmt.Errorf("invalid index name '%s'", name)
+	}
+	if _, err := lookupAnalyzer(cfg.Analyzer); err != nil {
+		return err
+	}
+	if cfg.Schema != nil {
+		if err := cfg.Schema.validate(); err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+	}
+	switch cfg.Store {
+	case "", storeFiles, storePacked:
+	default:
+		return fmt.Errorf("unknown store '%s'", cfg.Store)
+	}
+	if cfg.Shards == 0 {
+		// The default, a single shard.
+		return nil
+	}
+	return validateShards(cfg.Shards)
+}
+
+// Create creates and opens a named index. It fails with errIndexExists if
+// there already is an index with the name.
+func (c *collections) Create(name string, cfg IndexConfig) (IndexInfo, error) {
+	if err := cfg.validate(name); err != nil {
+		return IndexInfo{}, err
+	}
+	if cfg.Analyzer == "" {
+		cfg.Analyzer = defaultAnalyzer
+	}
+	if cfg.Store == "" {
+		cfg.Store = storeFiles
+	}
+	if cfg.Shards == 0 {
+		cfg.Shards = 1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.indexes[name]; ok {
+		return IndexInfo{}, errIndexExists
+	}
+	if _, ok := c.aliases[name]; ok {
+		return IndexInfo{}, errIndexExists
+	}
+
+	info := IndexInfo{
+		Name:        name,
+		Created:     time.Now().UTC(),
+		IndexConfig: cfg,
+	}
+	dir := filepath.Join(c.root, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return IndexInfo{}, fmt.Errorf("remove unfinished: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return IndexInfo{}, fmt.Errorf("mkdir: %w", err)
+	}
+	col, err := c.open(info)
+	if err != nil {
+		os.RemoveAll(dir)
+		return IndexInfo{}, err
+	}
+
+	// The index exists once its info is written.
+	data, err := json.Marshal(info)
+	if err != nil {
+		col.svc.close()
+		os.RemoveAll(dir)
+		return IndexInfo{}, fmt.Errorf("marshal: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, indexInfoFile), data); err != nil {
+		col.svc.close()
+		os.RemoveAll(dir)
+		return IndexInfo{}, fmt.Errorf("write info: %w", err)
+	}
+	c.indexes[name] = col
+	return info, nil
+}
+
+// open opens the write-ahead log, the store and the snapshots of the index
+// and starts a service for it.
+func (c *collections) open(info IndexInfo) (*collection, error) {
+	a, err := lookupAnalyzer(info.Analyzer)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(c.root, info.Name)
+	wal, err := openWAL(filepath.Join(dir, "wal"), c.cfg.policy, c.cfg.syncInterval)
+	if err != nil {
+		return nil, fmt.Errorf("open wal: %w", err)
+	}
+	store, err := openStore(info.Store, filepath.Join(dir, "store"), c.cfg.dedup)
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("open store: %w", err)
+	}
+	snapshots, err := newSnapshotRepo(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("open snapshot repository: %w", err)
+	}
+
+	idx := NewIndex()
+	if info.Shards > 1 {
+		idx = NewShardedIndex(info.Shards)
+	}
+	svc := NewService(idx, NewQuerier(idx), store, Config{
+		WAL:             wal,
+		CompactInterval: c.cfg.compactInterval,
+		RefreshInterval: c.cfg.refreshInterval,
+		Snapshots:       snapshots,
+		MaxDocSize:      c.cfg.maxDocSize,
+		Analyzer:        a,
+		Schema:          info.Schema,
+	}).(*service)
+	if err := svc.open(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	return &collection{
+		info:    info,
+		svc:     svc,
+		handler: svc.Handler(),
+	}, nil
+}
+
+// Drop closes the named index and removes it with all of its documents.
+// It fails with errIndexAliased while an alias resolves to the index.
+func (c *collections) Drop(name string) error {
+	c.mu.Lock()
+	col, ok := c.indexes[name]
+	if !ok {
+		c.mu.Unlock()
+		return errIndexNotFound(name)
+	}
+	if alias := c.aliasOf(name); alias != "" {
+		c.mu.Unlock()
+		return fmt.Errorf("%w: '%s' resolves to '%s'", errIndexAliased, alias, name)
+	}
+	delete(c.indexes, name)
+	c.mu.Unlock()
+
+	if err := col.svc.close(); err != nil {
+		log.Printf("close index %s: %v", name, err)
+	}
+	if err := os.RemoveAll(filepath.Join(c.root, name)); err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+	return nil
+}
+
+// Get returns the named index.
+func (c *collections) Get(name string) (*collection, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	col, ok := c.indexes[name]
+	return col, ok
+}
+
+// List returns the named indexes, sorted by name.
+func (c *collections) List() []IndexInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make([]IndexInfo, 0, len(c.indexes))
+	for _, col := range c.indexes {
+		out = append(out, col.Info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Close closes all named indexes.
+func (c *collections) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for name, col := range c.indexes {
+		if err := col.svc.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("close %s: %w", name, err)
+		}
+	}
+	c.indexes = make(map[string]*collection)
+	return firstErr
+}
+
+// Info returns the info of the index with its current document count.
+func (col *collection) Info() IndexInfo {
+	info := col.info
+	info.Docs = col.svc.idx.DocCount()
+	return info
+}
+
+// handleIndexes lists the named indexes.
+func (c *collections) handleIndexes(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResp, err := json.Marshal(c.List())
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
+
+// handleIndex serves /indexes/{name}. PUT creates the index with the
+// IndexConfig in the body, if any, GET returns its info and DELETE drops it.
+// Requests for /indexes/{name}/{path} are served by the index as requests
+// for /{path}. The name can be an alias resolving to the index.
+//
+// Searches can run across indexes by listing their names separated by
+// commas, like /indexes/a,b/search/union, or through an alias resolving to
+// several indexes. Hits are merged by score, with the scores of each index
+// ranked by the statistics of that index.
+func (c *collections) handleIndex(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/indexes/")
+	var rest string
+	if i := strings.Index(name, "/"); i != -1 {
+		name, rest = name[:i], name[i+1:]
+	}
+
+	if rest != "" {
+		names, err := c.resolve(strings.Split(name, ","))
+		if err != nil {
+			log.Printf("resolve: %v", err)
+			http.Error(w, "", errorStatus(err))
+			return
+		}
+		if len(names) > 1 {
+			if !strings.HasPrefix(rest, "search/") {
+				log.Printf("%s resolves to several indexes", name)
+				http.Error(w, "only searches can run across indexes", http.StatusBadRequest)
+				return
+			}
+			c.handleSearch(w, req, names, strings.TrimPrefix(rest, "search/"))
+			return
+		}
+
+		col, ok := c.Get(names[0])
+		if !ok {
+			log.Printf("index %s not found", names[0])
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		r := req.Clone(req.Context())
+		r.URL.Path = "/" + rest
+		r.URL.RawPath = ""
+		col.handler.ServeHTTP(w, r)
+		return
+	}
+
+	switch req.Method {
+	case "PUT":
+		c.handleCreate(w, req, name)
+	case "GET":
+		col, ok := c.Get(name)
+		if !ok {
+			log.Printf("index %s not found", name)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		jsonResp, err := json.Marshal(col.Info())
+		if err != nil {
+			log.Printf("marshal: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Write(jsonResp)
+	case "DELETE":
+		err := c.Drop(name)
+		if errors.Is(err, errIndexAliased) {
+			log.Printf("drop: %v", err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("drop: %v", err)
+			http.Error(w, "", errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *collections) handleCreate(w http.ResponseWriter, req *http.Request, name string) {
+	var cfg IndexConfig
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		log.Printf("read body: %v", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) != 0 {
+		if err := json.Unmarshal(body, &cfg); err != nil {
+			log.Printf("unmarshal: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := cfg.validate(name); err != nil {
+		log.Printf("index config: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := c.Create(name, cfg)
+	if errors.Is(err, errIndexExists) {
+		log.Printf("create: %v", err)
+		http.Error(w, "", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("create: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResp)
+}
+
+// handleSearch runs a query of the given type in each of the named indexes
+// and returns one page of the merged hits. Sorting by fields and cursors
+// aren't supported across indexes.
+func (c *collections) handleSearch(w http.ResponseWriter, req *http.Request, names []string, typ string) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := queryTypes(nil)[typ]; !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	query := req.URL.Query().Get("query")
+	if len(query) == 0 {
+		log.Printf("no query provided")
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseSearchParams(req)
+	if err != nil {
+		log.Printf("search params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.URL.Query().Get("sort") != "" || params.after != nil {
+		log.Printf("sort or cursor across indexes")
+		http.Error(w, "sort and after aren't supported across indexes", http.StatusBadRequest)
+		return
+	}
+
+	// Every index returns its hits up to the end of the page, so the page
+	// can be cut from the merged hits.
+	from, size := params.from, params.size
+	params.size += params.from
+	params.from = 0
+
+	pages := make([]GetResponseBody, 0, len(names))
+	for _, name := range names {
+		col, ok := c.Get(name)
+		if !ok {
+			log.Printf("index %s not found", name)
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		terms, err := col.svc.parseQuery(typ, query)
+		if err != nil {
+			log.Printf("parse query: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		postings, err := col.svc.match(typ, terms)
+		if err != nil {
+			log.Printf("match: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		page, err := col.svc.rankedPage(postings, terms, params)
+		if err != nil {
+			log.Printf("ranked page: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		page.Next = ""
+		for i := range page.Documents {
+			page.Documents[i].Index = name
+		}
+		pages = append(pages, page)
+	}
+
+	jsonResp, err := json.Marshal(mergePages(pages, from, size))
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
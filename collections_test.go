@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// do sends a request to the handler and returns the status and body of the
+// response.
+func do(t *testing.T, h http.Handler, method, target, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res, err := io.ReadAll(w.Body)
+	require.Nil(t, err)
+	return w.Code, string(res)
+}
+
+func TestCollections(t *testing.T) {
+	root := t.TempDir()
+	c, err := openCollections(root, collectionsConfig{})
+	require.Nil(t, err)
+	h := NewService(NewIndex(), nil, nil, Config{Collections: c}).(*service).Handler()
+
+	code, _ := do(t, h, "PUT", "/indexes/books", `{"analyzer": "english", "schema": {"fields": {"year": {"type": "number"}}}}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, h, "PUT", "/indexes/books", "")
+	require.Equal(t, http.StatusConflict, code)
+	code, _ = do(t, h, "PUT", "/indexes/films", `{"store": "packed", "shards": 2}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, h, "PUT", "/indexes/Bad", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(t, h, "PUT", "/indexes/bad", `{"analyzer": "klingon"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(t, h, "PUT", "/indexes/bad", `{"shards": 1000}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Each index has its own schema and analyzer.
+	code, _ = do(t, h, "POST", "/indexes/books/doc?refresh=true&field.year=1954", "The lord of the rings")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(t, h, "POST", "/indexes/books/doc?field.year=long+ago", "The hobbit")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(t, h, "POST", "/indexes/films/doc?refresh=true", "The lord of the rings rings")
+	require.Equal(t, http.StatusOK, code)
+
+	var res GetResponseBody
+	code, body := do(t, h, "GET", "/indexes/books/search/union?query=the", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, 0, res.Hits)
+	code, body = do(t, h, "GET", "/indexes/films/search/union?query=the", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, 1, res.Hits)
+
+	// Searching across indexes merges the hits.
+	code, body = do(t, h, "GET", "/indexes/books,films/search/union?query=rings&size=1", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, 2, res.Hits)
+	require.Len(t, res.Documents, 1)
+	code, _ = do(t, h, "GET", "/indexes/books,none/search/union?query=rings", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// A term missing from one of the indexes matches nothing there.
+	code, _ = do(t, h, "POST", "/indexes/films/doc?refresh=true", "Dune")
+	require.Equal(t, http.StatusOK, code)
+	for _, typ := range []string{"intersection", "phrase", "union"} {
+		code, body = do(t, h, "GET", "/indexes/books,films/search/"+typ+"?query=dune", "")
+		require.Equal(t, http.StatusOK, code, typ)
+		require.Nil(t, json.Unmarshal([]byte(body), &res))
+		require.Equal(t, 1, res.Hits, typ)
+		require.Equal(t, "films", res.Documents[0].Index, typ)
+
+		code, body = do(t, h, "GET", "/indexes/books/search/"+typ+"?query=dune", "")
+		require.Equal(t, http.StatusOK, code, typ)
+		require.Nil(t, json.Unmarshal([]byte(body), &res))
+		require.Equal(t, 0, res.Hits, typ)
+	}
+
+	var infos []IndexInfo
+	code, body = do(t, h, "GET", "/indexes", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &infos))
+	require.Len(t, infos, 2)
+	require.Equal(t, "books", infos[0].Name)
+	require.Equal(t, "english", infos[0].Analyzer)
+	require.Equal(t, 1, infos[0].Docs)
+	require.Equal(t, "films", infos[1].Name)
+	require.Equal(t, storePacked, infos[1].Store)
+	require.Equal(t, 2, infos[1].Shards)
+
+	code, _ = do(t, h, "DELETE", "/indexes/films", "")
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = do(t, h, "GET", "/indexes/films/search/union?query=the", "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(t, h, "DELETE", "/indexes/films", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// The remaining index is recovered when reopened.
+	require.Nil(t, c.Close())
+	c, err = openCollections(root, collectionsConfig{})
+	require.Nil(t, err)
+	defer c.Close()
+	require.Len(t, c.List(), 1)
+	col, ok := c.Get("books")
+	require.True(t, ok)
+	require.Equal(t, 1, col.Info().Docs)
+	require.NotNil(t, col.svc.schema)
+}
+
+// TestReindex rebuilds an index with another analyzer and switches an
+// alias to it.
+func TestReindex(t *testing.T) {
+	c, err := openCollections(t.TempDir(), collectionsConfig{})
+	require.Nil(t, err)
+	defer c.Close()
+	s := NewService(NewIndex(), nil, nil, Config{Collections: c}).(*service)
+	h := s.Handler()
+
+	hits := func(target string) int {
+		t.Helper()
+		var res GetResponseBody
+		code, body := do(t, h, "GET", target, "")
+		require.Equal(t, http.StatusOK, code)
+		require.Nil(t, json.Unmarshal([]byte(body), &res))
+		return res.Hits
+	}
+
+	code, _ := do(t, h, "PUT", "/indexes/wiki_v1", "")
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, h, "PUT", "/aliases/wiki", `{"indexes": ["wiki_v1"]}`)
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = do(t, h, "PUT", "/aliases/wiki_v1", `{"indexes": ["wiki_v1"]}`)
+	require.Equal(t, http.StatusConflict, code)
+	code, _ = do(t, h, "PUT", "/aliases/other", `{"indexes": ["none"]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// Documents are written through the alias.
+	code, _ = do(t, h, "POST", "/indexes/wiki/doc?id=a&field.title=A", "The first page")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(t, h, "POST", "/indexes/wiki/doc?id=b&refresh=true", "The second page")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 2, hits("/indexes/wiki/search/union?query=the"))
+
+	code, _ = do(t, h, "PUT", "/indexes/wiki_v2", `{"analyzer": "english"}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, h, "POST", "/reindex", `{"source": "wiki", "dest": "none"}`)
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(t, h, "POST", "/reindex", `{"source": "wiki", "dest": "wiki_v1"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, body := do(t, h, "POST", "/reindex", `{"source": "wiki", "dest": "wiki_v2"}`)
+	require.Equal(t, http.StatusAccepted, code)
+	var job Job
+	require.Nil(t, json.Unmarshal([]byte(body), &job))
+	job = waitForJob(t, s.jobs, job.ID)
+	require.Equal(t, jobDone, job.Status)
+	require.Equal(t, ReindexResult{Source: "wiki_v1", Dest: "wiki_v2", Indexed: 2}, job.Result)
+
+	// The aliased index can't be dropped until the alias is switched.
+	code, _ = do(t, h, "DELETE", "/indexes/wiki_v1", "")
+	require.Equal(t, http.StatusConflict, code)
+	code, _ = do(t, h, "PUT", "/aliases/wiki", `{"indexes": ["wiki_v2"]}`)
+	require.Equal(t, http.StatusNoContent, code)
+	require.Equal(t, 0, hits("/indexes/wiki/search/union?query=the"))
+	require.Equal(t, 1, hits("/indexes/wiki/search/union?query=first"))
+	var meta DocMeta
+	code, body = do(t, h, "GET", "/indexes/wiki/doc/0/meta", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, json.Unmarshal([]byte(body), &meta))
+	require.Equal(t, "a", meta.ExternalID)
+	require.Equal(t, Fields{"title": {"A"}}, meta.Fields)
+
+	// An alias resolving to several indexes is searched across them.
+	code, _ = do(t, h, "PUT", "/aliases/all", `{"indexes": ["wiki_v1", "wiki_v2"]}`)
+	require.Equal(t, http.StatusNoContent, code)
+	require.Equal(t, 4, hits("/indexes/all,wiki_v2/search/union?query=page+the"))
+	code, _ = do(t, h, "POST", "/indexes/all/doc", "Which index?")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, h, "DELETE", "/aliases/all", "")
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = do(t, h, "DELETE", "/indexes/wiki_v1", "")
+	require.Equal(t, http.StatusNoContent, code)
+	require.Equal(t, []Alias{{Name: "wiki", Indexes: []string{"wiki_v2"}}}, c.Aliases())
+}
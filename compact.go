@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// compactBatchSize is the number of documents per record of a
+	// compacted write-ahead log.
+	compactBatchSize = 100
+
+	// minCompactOps is the number of changes to replaced or deleted
+	// documents the write-ahead log must hold before it's compacted
+	// periodically.
+	minCompactOps = 1000
+)
+
+var errNotCompactable = errors.New("write-ahead log can't be compacted")
+
+type CompactResponseBody struct {
+	Docs    int `json:"docs"`
+	Records int `json:"records"`
+}
+
+// compact rewrites the write-ahead log with one change per document in the
+// index, so replaced and deleted documents no longer take up space in it.
+// Documents keep their IDs. Sources of up to inlineSourceSize bytes are
+// kept in the records and larger ones copied to files of their own.
+//
+// The log of a replicated index isn't compacted, since followers refer to
+// its records by number.
+func (s *service) compact() (CompactResponseBody, error) {
+	if s.wal == nil || s.replication != nil {
+		return CompactResponseBody{}, errNotCompactable
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	s.refresh()
+	ids := s.idx.DocIDs()
+	var res CompactResponseBody
+	err := s.wal.Compact(func(add func([]walOp) error) error {
+		var ops []walOp
+		for i, id := range ids {
+			op, err := s.compactOp(id)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+			if len(ops) == compactBatchSize || i == len(ids)-1 {
+				if err := add(ops); err != nil {
+					return err
+				}
+				res.Records++
+				ops = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return CompactResponseBody{}, err
+	}
+	s.logOps = len(ids)
+	res.Docs = len(ids)
+	return res, nil
+}
+
+// compactOp returns the change indexing the document with the given ID as
+// it's in the index and the store.
+func (s *service) compactOp(id int) (walOp, error) {
+	op := walOp{
+		Action: actionIndex,
+		Fields: s.idx.Fields(id),
+		DocID:  &id,
+	}
+
+	r, err := s.store.Open(id)
+	if err != nil {
+		return walOp{}, fmt.Errorf("open %d: %w", id, err)
+	}
+	defer r.Close()
+
+	source, err := io.ReadAll(io.LimitReader(r, inlineSourceSize+1))
+	if err != nil {
+		return walOp{}, fmt.Errorf("read %d: %w", id, err)
+	}
+	if len(source) <= inlineSourceSize {
+		op.Source = source
+		return op, nil
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return walOp{}, fmt.Errorf("seek %d: %w", id, err)
+	}
+	f, err := s.wal.createSource()
+	if err != nil {
+		return walOp{}, fmt.Errorf("create source: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return walOp{}, fmt.Errorf("copy %d: %w", id, err)
+	}
+	if err := s.wal.closeSource(f); err != nil {
+		return walOp{}, fmt.Errorf("close source: %w", err)
+	}
+	op.Blob = filepath.Base(f.Name())
+	return op, nil
+}
+
+// compactEvery compacts the write-ahead log periodically, once at least
+// half of its changes, and at least minCompactOps, are to documents no
+// longer in the index.
+func (s *service) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.commitMu.Lock()
+			stale := s.logOps - s.idx.DocCount()
+			s.commitMu.Unlock()
+			if stale < minCompactOps || stale < s.idx.DocCount() {
+				continue
+			}
+			res, err := s.compact()
+			if err != nil {
+				log.Printf("compact: %v", err)
+				continue
+			}
+			log.Printf("Compacted write-ahead log to %d records, %d documents", res.Records, res.Docs)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// handleCompact compacts the write-ahead log.
+func (s *service) handleCompact(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := s.compact()
+	if errors.Is(err, errNotCompactable) {
+		log.Printf("compact: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("compact: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
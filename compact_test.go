@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCompact compacts a log with replaced and deleted documents and checks
+// that a service replaying it comes up with the same documents.
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal")
+	w, err := openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	require.Nil(t, s.recover())
+	h := s.Handler()
+
+	large := strings.Repeat("l", inlineSourceSize)
+	for _, doc := range []struct{ target, body string }{
+		{"/doc?id=a", "first version"},
+		{"/doc?id=a&field.title=A", "second version"},
+		{"/doc?id=b", "deleted"},
+		{"/doc?id=c", large},
+		{"/doc?id=c", large + "again"},
+	} {
+		code, _ := do(t, h, "POST", doc.target, doc.body)
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, _ := do(t, h, "POST", "/bulk", `{"action": "delete", "id": "b"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, h, "POST", "/admin/compact", "")
+	require.Equal(t, http.StatusOK, code)
+	var res CompactResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.Equal(t, CompactResponseBody{Docs: 2, Records: 1}, res)
+	require.Equal(t, 1, w.Len())
+	require.Equal(t, 2, s.logOps)
+
+	// Only the large source is kept in a file of its own.
+	entries, err := os.ReadDir(path + ".sources")
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+
+	// Changes after the compaction are appended to the compacted log.
+	code, _ = do(t, h, "POST", "/doc?id=d", "after compaction")
+	require.Equal(t, http.StatusOK, code)
+	ids := s.idx.DocIDs()
+	require.Len(t, ids, 3)
+	require.Nil(t, w.Close())
+
+	w, err = openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	replayed := newTestService(t, filepath.Join(dir, "replayed"), w)
+	require.Nil(t, replayed.recover())
+	require.Equal(t, ids, replayed.idx.DocIDs())
+	for _, id := range ids {
+		require.Equal(t, s.idx.Fields(id), replayed.idx.Fields(id))
+		want, err := s.store.Get(id)
+		require.Nil(t, err)
+		got, err := replayed.store.Get(id)
+		require.Nil(t, err)
+		require.Equal(t, want, got)
+	}
+
+	// A service without a log has nothing to compact.
+	code, _ = do(t, NewService(NewIndex(), nil, nil, Config{}).(*service).Handler(), "POST", "/admin/compact", "")
+	require.Equal(t, http.StatusConflict, code)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// dedupStore stores documents with identical sources once. Sources are
+// addressed by their SHA-256 hash: the first document with a source is
+// stored in the underlying store, and later documents with the same source
+// refer to it. A source is removed when the last document referring to it
+// is deleted.
+//
+// owners maps the IDs sources are stored as to their hashes. A source
+// outlives the document it's stored as if other documents refer to it, so
+// an ID may own a source without referring to it.
+type dedupStore struct {
+	mu    sync.RWMutex
+	store Store
+
+	hashes  map[int][sha256.Size]byte
+	sources map[[sha256.Size]byte]*dedupSource
+	owners  map[int][sha256.Size]byte
+}
+
+// dedupSource is a source held by the underlying store as the document id,
+// and the documents referring to it.
+type dedupSource struct {
+	id   int
+	refs map[int]bool
+}
+
+// NewDedupStore returns a store keeping a single copy of identical
+// documents in the given store.
+func NewDedupStore(store Store) Store {
+	return &dedupStore{
+		store:   store,
+		hashes:  make(map[int][sha256.Size]byte),
+		sources: make(map[[sha256.Size]byte]*dedupSource),
+		owners:  make(map[int][sha256.Size]byte),
+	}
+}
+
+// owner returns the ID the source of the document is stored as.
+func (s *dedupStore) owner(id int) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hash, ok := s.hashes[id]
+	if !ok {
+		return 0, false
+	}
+	return s.sources[hash].id, true
+}
+
+func (s *dedupStore) Get(id int) ([]byte, error) {
+	owner, ok := s.owner(id)
+	if !ok {
+		return nil, errDocNotInStore(id)
+	}
+	return s.store.Get(owner)
+}
+
+// Open opens the document with the given ID for reading.
+func (s *dedupStore) Open(id int) (io.ReadSeekCloser, error) {
+	owner, ok := s.owner(id)
+	if !ok {
+		return nil, errDocNotInStore(id)
+	}
+	return s.store.Open(owner)
+}
+
+// PutFromStream stores the document in the underlying store while hashing
+// it, and removes it from there again if the source was already stored. A
+// document already stored with the ID is replaced.
+func (s *dedupStore) PutFromStream(r io.Reader, id int) error {
+	s.mu.Lock()
+	err := s.release(id)
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+
+	h := sha256.New()
+	if err := s.store.PutFromStream(io.TeeReader(r, h), id); err != nil {
+		return err
+	}
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if src, ok := s.sources[hash]; ok {
+		src.refs[id] = true
+		s.hashes[id] = hash
+		if err := s.store.Delete(id); err != nil {
+			return fmt.Errorf("delete duplicate: %w", err)
+		}
+		return nil
+	}
+
+	s.sources[hash] = &dedupSource{
+		id:   id,
+		refs: map[int]bool{id: true},
+	}
+	s.hashes[id] = hash
+	s.owners[id] = hash
+	return nil
+}
+
+// release removes the document with the given ID, if stored, and frees the
+// ID in the underlying store. A source stored as the ID that other
+// documents still refer to is copied to one of them first. The caller must
+// hold mu.
+func (s *dedupStore) release(id int) error {
+	if hash, ok := s.hashes[id]; ok {
+		delete(s.hashes, id)
+		delete(s.sources[hash].refs, id)
+	}
+	hash, ok := s.owners[id]
+	if !ok {
+		return nil
+	}
+	delete(s.owners, id)
+
+	src := s.sources[hash]
+	if len(src.refs) == 0 {
+		delete(s.sources, hash)
+		return s.store.Delete(id)
+	}
+
+	to := -1
+	for ref := range src.refs {
+		if to == -1 || ref < to {
+			to = ref
+		}
+	}
+	r, err := s.store.Open(id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := s.store.PutFromStream(r, to); err != nil {
+		return err
+	}
+	src.id = to
+	s.owners[to] = hash
+	return nil
+}
+
+// Delete removes the document with the given ID.
+func (s *dedupStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash, ok := s.hashes[id]
+	if !ok {
+		return errDocNotInStore(id)
+	}
+	delete(s.hashes, id)
+
+	src := s.sources[hash]
+	delete(src.refs, id)
+	if len(src.refs) != 0 {
+		return nil
+	}
+	delete(s.sources, hash)
+	delete(s.owners, src.id)
+	return s.store.Delete(src.id)
+}
+
+// Duplicates returns the groups of documents with identical sources, each
+// group and the groups ordered by ID.
+func (s *dedupStore) Duplicates() [][]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out [][]int
+	for _, src := range s.sources {
+		if len(src.refs) < 2 {
+			continue
+		}
+		ids := make([]int, 0, len(src.refs))
+		for id := range src.refs {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		out = append(out, ids)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i][0] < out[j][0]
+	})
+	return out
+}
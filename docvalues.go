@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields holds the field values of a document, keyed by field name. A field
+// may have multiple values.
+type Fields map[string][]string
+
+// Fields with names starting with an underscore are reserved for metadata
+// set by the service.
+const (
+	contentTypeField = "_content_type"
+	indexedAtField   = "_indexed_at"
+	externalIDField  = "_external_id"
+)
+
+// public returns the fields without the reserved ones.
+func (f Fields) public() Fields {
+	var out Fields
+	for name, values := range f {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		if out == nil {
+			out = make(Fields)
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// first returns the first value of the field, or an empty string if the
+// field has no values.
+func (f Fields) first(name string) string {
+	if len(f[name]) == 0 {
+		return ""
+	}
+	return f[name][0]
+}
+
+type valueKind int
+
+const (
+	kindMissing valueKind = iota
+	kindNumber
+	kindDate
+	kindString
+)
+
+// dateLayouts are the formats recognized as dates in field values.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02",
+}
+
+// DocValue is a field value parsed into its sortable form. Numbers and
+// dates are kept as a number, dates as seconds since the Unix epoch. Str
+// always holds the original text.
+type DocValue struct {
+	Kind valueKind `json:"k"`
+	Num  float64   `json:"n,omitempty"`
+	Str  string    `json:"s,omitempty"`
+}
+
+// parseDocValue detects the type of the field value and parses it.
+func parseDocValue(s string) DocValue {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return DocValue{Kind: kindNumber, Num: n, Str: s}
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return DocValue{Kind: kindDate, Num: float64(t.UnixNano()) / 1e9, Str: s}
+		}
+	}
+	return DocValue{Kind: kindString, Str: s}
+}
+
+// compareDocValues returns -1, 0 or 1 depending on whether a sorts before,
+// equal to or after b. Numbers and dates sort before strings.
+func compareDocValues(a, b DocValue) int {
+	aNum := a.Kind == kindNumber || a.Kind == kindDate
+	bNum := b.Kind == kindNumber || b.Kind == kindDate
+
+	switch {
+	case aNum && bNum:
+		if a.Num < b.Num {
+			return -1
+		}
+		if a.Num > b.Num {
+			return 1
+		}
+		return 0
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+
+	if a.Str < b.Str {
+		return -1
+	}
+	if a.Str > b.Str {
+		return 1
+	}
+	return 0
+}
+
+// docValues is a column oriented store of document field values, used for
+// sorting and for returning fields with search results.
+type docValues struct {
+	columns map[string]map[int][]DocValue
+}
+
+func newDocValues() *docValues {
+	return &docValues{
+		columns: make(map[string]map[int][]DocValue),
+	}
+}
+
+// set replaces the field values of the document.
+func (dv *docValues) set(id int, fields Fields) {
+	for _, col := range dv.columns {
+		delete(col, id)
+	}
+
+	for name, values := range fields {
+		if len(values) == 0 {
+			continue
+		}
+		col, ok := dv.columns[name]
+		if !ok {
+			col = make(map[int][]DocValue)
+			dv.columns[name] = col
+		}
+
+		parsed := make([]DocValue, 0, len(values))
+		for _, v := range values {
+			parsed = append(parsed, parseDocValue(v))
+		}
+		col[id] = parsed
+	}
+}
+
+// get returns the values of the field for the document.
+func (dv *docValues) get(id int, field string) []DocValue {
+	return dv.columns[field][id]
+}
+
+// fields returns all field values of the document.
+func (dv *docValues) fields(id int) Fields {
+	var out Fields
+	for name, col := range dv.columns {
+		values, ok := col[id]
+		if !ok {
+			continue
+		}
+		if out == nil {
+			out = make(Fields)
+		}
+		for _, v := range values {
+			out[name] = append(out[name], v.Str)
+		}
+	}
+	return out
+}
+
+// sortValue picks the value used when sorting a document by a multi-valued
+// field: the lowest value for ascending sorts and the highest for descending.
+func sortValue(values []DocValue, desc bool) DocValue {
+	if len(values) == 0 {
+		return DocValue{Kind: kindMissing}
+	}
+
+	out := values[0]
+	for _, v := range values[1:] {
+		c := compareDocValues(v, out)
+		if (desc && c > 0) || (!desc && c < 0) {
+			out = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDocValue(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		kind valueKind
+		num  float64
+	}{
+		{
+			name: "number",
+			s:    "4.5",
+			kind: kindNumber,
+			num:  4.5,
+		},
+		{
+			name: "date",
+			s:    "1970-01-02",
+			kind: kindDate,
+			num:  86400,
+		},
+		{
+			name: "timestamp",
+			s:    "1970-01-01T00:01:00Z",
+			kind: kindDate,
+			num:  60,
+		},
+		{
+			name: "string",
+			s:    "hello",
+			kind: kindString,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := parseDocValue(tt.s)
+			require.Equal(t, tt.kind, v.Kind)
+			require.Equal(t, tt.num, v.Num)
+			require.Equal(t, tt.s, v.Str)
+		})
+	}
+}
+
+func TestSortValue(t *testing.T) {
+	values := []DocValue{
+		parseDocValue("5"),
+		parseDocValue("1"),
+		parseDocValue("10"),
+	}
+	require.Equal(t, "1", sortValue(values, false).Str)
+	require.Equal(t, "10", sortValue(values, true).Str)
+	require.Equal(t, kindMissing, sortValue(nil, false).Kind)
+}
+
+func TestDocValuesFields(t *testing.T) {
+	dv := newDocValues()
+	dv.set(0, Fields{"tag": {"a", "b"}, "size": {"10"}})
+	require.Equal(t, Fields{"tag": {"a", "b"}, "size": {"10"}}, dv.fields(0))
+
+	dv.set(0, Fields{"tag": {"c"}})
+	require.Equal(t, Fields{"tag": {"c"}}, dv.fields(0))
+	require.Nil(t, dv.fields(1))
+}
+
+func TestFieldsPublic(t *testing.T) {
+	f := Fields{"title": {"a"}, contentTypeField: {"text/plain"}}
+	require.Equal(t, Fields{"title": {"a"}}, f.public())
+	require.Equal(t, "text/plain", f.first(contentTypeField))
+	require.Equal(t, "", f.first("missing"))
+	require.Nil(t, Fields{indexedAtField: {"x"}}.public())
+}
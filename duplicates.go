@@ -0,0 +1,237 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+const (
+	// nearDuplicateDistance is the largest number of bits in which the
+	// fingerprints of near-duplicate documents differ.
+	nearDuplicateDistance = 3
+
+	// simHashBands is the number of equal parts fingerprints are split into
+	// to find candidate near-duplicates. With more bands than the distance,
+	// near-duplicates share at least one band.
+	simHashBands = nearDuplicateDistance + 1
+)
+
+// simHash returns the SimHash fingerprint of a document from its term
+// frequencies. Documents with similar terms get fingerprints differing in
+// few bits.
+func simHash(freqs map[string]int) uint64 {
+	var v [64]float64
+	for term, freq := range freqs {
+		h := fnv.New64a()
+		h.Write([]byte(term))
+		sum := h.Sum64()
+
+		w := tf(freq)
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				v[bit] += w
+			} else {
+				v[bit] -= w
+			}
+		}
+	}
+
+	var out uint64
+	for bit := 0; bit < 64; bit++ {
+		if v[bit] > 0 {
+			out |= 1 << bit
+		}
+	}
+	return out
+}
+
+// duplicates finds clusters of near-duplicate documents in the index by
+// their SimHash fingerprints. The clusters are recomputed on first use after
+// the index has changed. Fingerprints are kept between versions, since the
+// terms of a document never change.
+type duplicates struct {
+	idx Index
+
+	mu           sync.Mutex
+	built        bool
+	version      uint64
+	fingerprints map[int]uint64
+	clusters     [][]int
+	cluster      map[int]int
+}
+
+func newDuplicates(idx Index) *duplicates {
+	return &duplicates{
+		idx:          idx,
+		fingerprints: make(map[int]uint64),
+	}
+}
+
+// reset forgets the fingerprints of all documents, for when IDs are
+// assigned again after the index is reset.
+func (d *duplicates) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.built = false
+	d.fingerprints = make(map[int]uint64)
+}
+
+// Clusters returns the clusters of near-duplicate documents, each cluster
+// and the clusters ordered by ID.
+func (d *duplicates) Clusters() [][]int {
+	clusters, _ := d.build()
+	return clusters
+}
+
+// collapse removes the hits that are near-duplicates of a hit ranked above
+// them. It returns the remaining hits and how many hits were removed for
+// each of them.
+func (d *duplicates) collapse(hits []Hit) ([]Hit, map[int]int) {
+	_, cluster := d.build()
+
+	out := make([]Hit, 0, len(hits))
+	collapsed := make(map[int]int)
+	kept := make(map[int]int)
+	for _, h := range hits {
+		c, ok := cluster[h.DocID]
+		if !ok {
+			out = append(out, h)
+			continue
+		}
+		if id, ok := kept[c]; ok {
+			collapsed[id]++
+			continue
+		}
+		kept[c] = h.DocID
+		out = append(out, h)
+	}
+	return out, collapsed
+}
+
+// build returns the clusters of the current version of the index, and the
+// cluster of every document in one.
+func (d *duplicates) build() ([][]int, map[int]int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	version := d.idx.Version()
+	if d.built && d.version == version {
+		return d.clusters, d.cluster
+	}
+
+	ids := d.idx.DocIDs()
+	fingerprints := make(map[int]uint64, len(ids))
+	for _, id := range ids {
+		fp, ok := d.fingerprints[id]
+		if !ok {
+			tv, err := d.idx.TermVector(id)
+			if err != nil {
+				continue
+			}
+			fp = simHash(tv.freqs())
+		}
+		fingerprints[id] = fp
+	}
+
+	// Documents with equal fingerprints are duplicates of each other, so
+	// only one of them is compared with the rest.
+	byFingerprint := make(map[uint64][]int)
+	for _, id := range ids {
+		fp, ok := fingerprints[id]
+		if !ok {
+			continue
+		}
+		byFingerprint[fp] = append(byFingerprint[fp], id)
+	}
+
+	uf := newUnionFind()
+	for _, same := range byFingerprint {
+		for _, id := range same[1:] {
+			uf.union(same[0], id)
+		}
+	}
+
+	// Compare fingerprints sharing a band.
+	const bandBits = 64 / simHashBands
+	for band := 0; band < simHashBands; band++ {
+		shift := uint(band * bandBits)
+		buckets := make(map[uint64][]uint64)
+		for fp := range byFingerprint {
+			key := (fp >> shift) & (1<<bandBits - 1)
+			buckets[key] = append(buckets[key], fp)
+		}
+		for _, fps := range buckets {
+			for i := range fps {
+				for j := i + 1; j < len(fps); j++ {
+					if bits.OnesCount64(fps[i]^fps[j]) <= nearDuplicateDistance {
+						uf.union(byFingerprint[fps[i]][0], byFingerprint[fps[j]][0])
+					}
+				}
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	for _, id := range ids {
+		if _, ok := fingerprints[id]; !ok {
+			continue
+		}
+		root := uf.find(id)
+		groups[root] = append(groups[root], id)
+	}
+
+	var clusters [][]int
+	for _, group := range groups {
+		if len(group) > 1 {
+			clusters = append(clusters, group)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i][0] < clusters[j][0]
+	})
+	cluster := make(map[int]int)
+	for i, c := range clusters {
+		for _, id := range c {
+			cluster[id] = i
+		}
+	}
+
+	d.fingerprints = fingerprints
+	d.clusters = clusters
+	d.cluster = cluster
+	d.version = version
+	d.built = true
+	return clusters, cluster
+}
+
+// unionFind is a disjoint-set forest over document IDs.
+type unionFind map[int]int
+
+func newUnionFind() unionFind {
+	return make(unionFind)
+}
+
+func (uf unionFind) find(id int) int {
+	parent, ok := uf[id]
+	if !ok || parent == id {
+		return id
+	}
+	root := uf.find(parent)
+	uf[id] = root
+	return root
+}
+
+func (uf unionFind) union(a, b int) {
+	ra, rb := uf.find(a), uf.find(b)
+	if ra == rb {
+		return
+	}
+	if ra < rb {
+		uf[rb] = ra
+	} else {
+		uf[ra] = rb
+	}
+}
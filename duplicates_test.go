@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimHash(t *testing.T) {
+	freqs := func(s string) map[string]int {
+		out := make(map[string]int)
+		for _, term := range strings.Fields(s) {
+			out[term]++
+		}
+		return out
+	}
+
+	base := longText()
+	a := simHash(freqs(base))
+	require.Equal(t, a, simHash(freqs(base)))
+
+	near := simHash(freqs(base + " today"))
+	require.LessOrEqual(t, bits.OnesCount64(a^near), nearDuplicateDistance)
+
+	far := simHash(freqs("stock markets rallied as investors welcomed the central bank decision on interest rates"))
+	require.Greater(t, bits.OnesCount64(a^far), nearDuplicateDistance)
+}
+
+func TestDuplicates(t *testing.T) {
+	idx := NewIndex()
+	base := longText()
+	for _, s := range []string{
+		base,
+		"stock markets rallied as investors welcomed the central bank decision on interest rates",
+		base + " today",
+		base,
+	} {
+		idx.IndexDocument(strings.NewReader(s))
+	}
+
+	d := newDuplicates(idx)
+	require.Equal(t, [][]int{{0, 2, 3}}, d.Clusters())
+
+	hits, collapsed := d.collapse([]Hit{{DocID: 2}, {DocID: 1}, {DocID: 0}, {DocID: 3}})
+	require.Equal(t, []Hit{{DocID: 2}, {DocID: 1}}, hits)
+	require.Equal(t, map[int]int{2: 2}, collapsed)
+
+	// Clusters follow changes to the index.
+	require.Nil(t, idx.Delete(0))
+	require.Nil(t, idx.Delete(3))
+	require.Empty(t, d.Clusters())
+}
+
+// longText returns a document long enough for small edits to leave its
+// fingerprint nearly unchanged.
+func longText() string {
+	var b strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&b, "word%d ", i*7%101)
+	}
+	return b.String()
+}
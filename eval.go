@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Metrics holds the relevance metrics of a ranked result list.
+type Metrics struct {
+	Precision float64 `json:"precision_at_k"`
+	Recall    float64 `json:"recall"`
+	AP        float64 `json:"ap"`
+	RR        float64 `json:"rr"`
+	NDCG      float64 `json:"ndcg_at_k"`
+}
+
+// QueryRun holds the evaluation of one query.
+type QueryRun struct {
+	ID        string  `json:"id"`
+	Query     string  `json:"query"`
+	Retrieved int     `json:"retrieved"`
+	Relevant  int     `json:"relevant"`
+	Metrics   Metrics `json:"metrics"`
+}
+
+// Run holds the evaluation of all queries. Mean holds the metrics averaged
+// over the queries, so AP and RR become MAP and MRR.
+type Run struct {
+	Type    string     `json:"type"`
+	K       int        `json:"k"`
+	Depth   int        `json:"depth"`
+	Queries []QueryRun `json:"queries"`
+	Mean    Metrics    `json:"mean"`
+}
+
+// evalQuery is a query to evaluate.
+type evalQuery struct {
+	ID   string
+	Text string
+}
+
+// qrels holds relevance judgements by query ID and document name. Grades
+// above zero are relevant.
+type qrels map[string]map[string]int
+
+// runEval is the eval command. It indexes a local corpus, runs the queries
+// against it and reports relevance metrics for the rankings, based on the
+// relevance judgements in a TREC style qrels file.
+//
+// Documents are named by their path relative to the corpus directory. The
+// query file holds one query per line: its ID, whitespace, and the query
+// text. Lines starting with # are ignored.
+func runEval(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	corpus := flags.String("corpus", "", "directory of documents to index")
+	qrelsPath := flags.String("qrels", "", "TREC style qrels file: query ID, iteration, document name, grade")
+	queriesPath := flags.String("queries", "", "query file: query ID and query text per line")
+	typ := flags.String("type", "union", "query type: intersection, phrase or union")
+	k := flags.Int("k", 10, "cutoff for precision and nDCG")
+	depth := flags.Int("depth", 1000, "number of ranked documents to evaluate")
+	runPath := flags.String("out", "", "write the run as JSON to this file")
+	baselinePath := flags.String("baseline", "", "compare against a run written with -out")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *corpus == "" || *qrelsPath == "" || *queriesPath == "" {
+		return fmt.Errorf("-corpus, -qrels and -queries are required")
+	}
+
+	if _, ok := queryTypes(nil)[*typ]; !ok {
+		return fmt.Errorf("unknown query type '%s'", *typ)
+	}
+
+	idx, names, err := indexCorpus(*corpus)
+	if err != nil {
+		return fmt.Errorf("index corpus: %w", err)
+	}
+
+	queries, err := readQueries(*queriesPath)
+	if err != nil {
+		return fmt.Errorf("read queries: %w", err)
+	}
+
+	judgements, err := readQrels(*qrelsPath)
+	if err != nil {
+		return fmt.Errorf("read qrels: %w", err)
+	}
+
+	run, err := evaluate(NewQuerier(idx), names, queries, judgements, *typ, *k, *depth)
+	if err != nil {
+		return fmt.Errorf("evaluate: %w", err)
+	}
+
+	if *baselinePath != "" {
+		baseline, err := readRun(*baselinePath)
+		if err != nil {
+			return fmt.Errorf("read baseline: %w", err)
+		}
+		printDiff(out, baseline, run)
+	} else {
+		printRun(out, run)
+	}
+
+	if *runPath != "" {
+		if err := writeRun(*runPath, run); err != nil {
+			return fmt.Errorf("write run: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexCorpus indexes all files in the directory. Text is extracted by the
+// content type of a file, like for documents posted to the service. It
+// returns the index and the names of the documents by ID.
+func indexCorpus(dir string) (Index, map[int]string, error) {
+	idx := NewIndex()
+	names := make(map[int]string)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("open: %w", err)
+		}
+		defer file.Close()
+
+		contentType, err := corpusContentType(file)
+		if err != nil {
+			return err
+		}
+		b := newBatch(nil)
+		if err := b.Index(file, Fields{contentTypeField: {contentType}}); err != nil {
+			return fmt.Errorf("index document: %w", err)
+		}
+		txn, results := idx.Prepare(b)
+		if results[0].Err != nil {
+			return fmt.Errorf("prepare: %w", results[0].Err)
+		}
+		if err := idx.Commit(txn); err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		id := results[0].ID
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return fmt.Errorf("rel: %w", err)
+		}
+		names[id] = filepath.ToSlash(name)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("walk: %w", err)
+	}
+	if _, err := idx.Refresh(); err != nil {
+		return nil, nil, fmt.Errorf("refresh: %w", err)
+	}
+	return idx, names, nil
+}
+
+// corpusContentType returns the content type of a corpus file, by its
+// extension or else by its first bytes, like the ingester does.
+func corpusContentType(file *os.File) (string, error) {
+	switch strings.ToLower(filepath.Ext(file.Name())) {
+	case ".md", ".markdown":
+		return "text/markdown; charset=utf-8", nil
+	}
+	if t := mime.TypeByExtension(filepath.Ext(file.Name())); t != "" {
+		return t, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("read: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("seek: %w", err)
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// readQueries reads a query file.
+func readQueries(path string) ([]evalQuery, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	var out []evalQuery
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("query '%s' has no text", fields[0])
+		}
+		out = append(out, evalQuery{
+			ID:   fields[0],
+			Text: strings.Join(fields[1:], " "),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	return out, nil
+}
+
+// readQrels reads a TREC style qrels file, where each line holds a query ID,
+// an iteration which is ignored, a document name and a relevance grade.
+func readQrels(path string) (qrels, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	out := make(qrels)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 4 fields, got %d", n, len(fields))
+		}
+
+		grade, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid grade: %w", n, err)
+		}
+
+		if out[fields[0]] == nil {
+			out[fields[0]] = make(map[string]int)
+		}
+		out[fields[0]][fields[2]] = grade
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	return out, nil
+}
+
+// evaluate runs the queries and computes the metrics of their rankings.
+// Queries without matches are evaluated as an empty ranking.
+func evaluate(q Querier, names map[int]string, queries []evalQuery, judgements qrels, typ string, k, depth int) (Run, error) {
+	qt := queryTypes(q)[typ]
+	run := Run{
+		Type:  typ,
+		K:     k,
+		Depth: depth,
+	}
+
+	for _, query := range queries {
+		terms, err := qt.parse(query.Text)
+		if err != nil {
+			return Run{}, fmt.Errorf("parse query %s: %w", query.ID, err)
+		}
+
+		var ranking []string
+		if len(terms) != 0 {
+			postings, err := qt.match(terms)
+			if errors.Is(err, errNotFound) {
+				// A term isn't in the index, so nothing matched.
+				postings, err = nil, nil
+			}
+			if err != nil {
+				return Run{}, fmt.Errorf("match query %s: %w", query.ID, err)
+			}
+			hits, err := q.Rank(postings, terms...)
+			if err != nil {
+				return Run{}, fmt.Errorf("rank query %s: %w", query.ID, err)
+			}
+			for i := 0; i < len(hits) && i < depth; i++ {
+				ranking = append(ranking, names[hits[i].DocID])
+			}
+		}
+
+		grades := judgements[query.ID]
+		run.Queries = append(run.Queries, QueryRun{
+			ID:        query.ID,
+			Query:     query.Text,
+			Retrieved: len(ranking),
+			Relevant:  numRelevant(grades),
+			Metrics:   metrics(ranking, grades, k),
+		})
+	}
+
+	run.Mean = meanMetrics(run.Queries)
+	return run, nil
+}
+
+// metrics computes the relevance metrics of the ranking.
+func metrics(ranking []string, grades map[string]int, k int) Metrics {
+	var m Metrics
+	relevant := numRelevant(grades)
+
+	found := 0
+	var sumPrecision float64
+	for i, name := range ranking {
+		if grades[name] <= 0 {
+			continue
+		}
+		found++
+		sumPrecision += float64(found) / float64(i+1)
+		if m.RR == 0 {
+			m.RR = 1 / float64(i+1)
+		}
+		if i < k {
+			m.Precision++
+		}
+	}
+
+	if k > 0 {
+		m.Precision /= float64(k)
+	}
+	if relevant > 0 {
+		m.Recall = float64(found) / float64(relevant)
+		m.AP = sumPrecision / float64(relevant)
+	}
+	m.NDCG = ndcg(ranking, grades, k)
+	return m
+}
+
+// ndcg computes the normalized discounted cumulative gain of the top k
+// documents of the ranking, with gains 2^grade - 1.
+func ndcg(ranking []string, grades map[string]int, k int) float64 {
+	var dcg float64
+	for i := 0; i < len(ranking) && i < k; i++ {
+		dcg += gain(grades[ranking[i]]) / math.Log2(float64(i+2))
+	}
+
+	var ideal []int
+	for _, g := range grades {
+		if g > 0 {
+			ideal = append(ideal, g)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+
+	var idcg float64
+	for i := 0; i < len(ideal) && i < k; i++ {
+		idcg += gain(ideal[i]) / math.Log2(float64(i+2))
+	}
+
+	if idcg == 0 {
+		return 0
+	}
+	return dcg / idcg
+}
+
+func gain(grade int) float64 {
+	if grade <= 0 {
+		return 0
+	}
+	return math.Pow(2, float64(grade)) - 1
+}
+
+func numRelevant(grades map[string]int) int {
+	n := 0
+	for _, g := range grades {
+		if g > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// meanMetrics averages the metrics over the queries.
+func meanMetrics(queries []QueryRun) Metrics {
+	var m Metrics
+	if len(queries) == 0 {
+		return m
+	}
+
+	for _, q := range queries {
+		m.Precision += q.Metrics.Precision
+		m.Recall += q.Metrics.Recall
+		m.AP += q.Metrics.AP
+		m.RR += q.Metrics.RR
+		m.NDCG += q.Metrics.NDCG
+	}
+
+	n := float64(len(queries))
+	m.Precision /= n
+	m.Recall /= n
+	m.AP /= n
+	m.RR /= n
+	m.NDCG /= n
+	return m
+}
+
+// sub returns the difference between the metrics.
+func (m Metrics) sub(o Metrics) Metrics {
+	return Metrics{
+		Precision: m.Precision - o.Precision,
+		Recall:    m.Recall - o.Recall,
+		AP:        m.AP - o.AP,
+		RR:        m.RR - o.RR,
+		NDCG:      m.NDCG - o.NDCG,
+	}
+}
+
+// printRun prints the metrics of every query and the means.
+func printRun(out io.Writer, run Run) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "query\tretrieved\trelevant\tP@%d\trecall\tAP\tRR\tnDCG@%d\t\n", run.K, run.K)
+	for _, q := range run.Queries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", q.ID, q.Retrieved, q.Relevant, formatMetrics(q.Metrics, "%.4f"))
+	}
+	fmt.Fprintf(w, "mean\t\t\t%s\n", formatMetrics(run.Mean, "%.4f"))
+	w.Flush()
+
+	fmt.Fprintf(out, "\nMAP: %.4f  MRR: %.4f  P@%d: %.4f  nDCG@%d: %.4f  (%d queries)\n",
+		run.Mean.AP, run.Mean.RR, run.K, run.Mean.Precision, run.K, run.Mean.NDCG, len(run.Queries))
+}
+
+// printDiff prints the change of the metrics of every query and of the
+// means, from the baseline to the run. Queries missing from either run are
+// left out.
+func printDiff(out io.Writer, baseline, run Run) {
+	base := make(map[string]Metrics)
+	for _, q := range baseline.Queries {
+		base[q.ID] = q.Metrics
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "query\tΔP@%d\tΔrecall\tΔAP\tΔRR\tΔnDCG@%d\t\n", run.K, run.K)
+	for _, q := range run.Queries {
+		b, ok := base[q.ID]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", q.ID, formatMetrics(q.Metrics.sub(b), "%+.4f"))
+	}
+	fmt.Fprintf(w, "mean\t%s\n", formatMetrics(run.Mean.sub(baseline.Mean), "%+.4f"))
+	w.Flush()
+
+	fmt.Fprintf(out, "\nMAP: %.4f -> %.4f  MRR: %.4f -> %.4f  nDCG@%d: %.4f -> %.4f\n",
+		baseline.Mean.AP, run.Mean.AP, baseline.Mean.RR, run.Mean.RR, run.K, baseline.Mean.NDCG, run.Mean.NDCG)
+}
+
+func formatMetrics(m Metrics, format string) string {
+	var parts []string
+	for _, v := range []float64{m.Precision, m.Recall, m.AP, m.RR, m.NDCG} {
+		parts = append(parts, fmt.Sprintf(format, v))
+	}
+	return strings.Join(parts, "\t") + "\t"
+}
+
+func readRun(path string) (Run, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Run{}, fmt.Errorf("read file: %w", err)
+	}
+
+	var run Run
+	if err := json.Unmarshal(b, &run); err != nil {
+		return Run{}, fmt.Errorf("unmarshal: %w", err)
+	}
+	return run, nil
+}
+
+func writeRun(path string, run Run) error {
+	b, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	return nil
+}
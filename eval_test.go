@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	grades := map[string]int{"a": 1, "c": 2, "e": 1, "x": 0}
+
+	tests := []struct {
+		name    string
+		ranking []string
+		k       int
+		res     Metrics
+	}{
+		{
+			name: "no results",
+			k:    2,
+		},
+		{
+			name:    "relevant documents at rank 2 and 3",
+			ranking: []string{"b", "a", "c", "d"},
+			k:       2,
+			res: Metrics{
+				Precision: 0.5,
+				Recall:    2.0 / 3,
+				AP:        (1.0/2 + 2.0/3) / 3,
+				RR:        0.5,
+				NDCG:      (1 / 1.584962500721156) / (3 + 1/1.584962500721156),
+			},
+		},
+		{
+			name:    "perfect ranking",
+			ranking: []string{"c", "a", "e"},
+			k:       3,
+			res: Metrics{
+				Precision: 1,
+				Recall:    1,
+				AP:        1,
+				RR:        1,
+				NDCG:      1,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := metrics(tt.ranking, grades, tt.k)
+			require.InDelta(t, tt.res.Precision, res.Precision, 1e-9)
+			require.InDelta(t, tt.res.Recall, res.Recall, 1e-9)
+			require.InDelta(t, tt.res.AP, res.AP, 1e-9)
+			require.InDelta(t, tt.res.RR, res.RR, 1e-9)
+			require.InDelta(t, tt.res.NDCG, res.NDCG, 1e-9)
+		})
+	}
+}
+
+func TestRunEval(t *testing.T) {
+	dir := t.TempDir()
+	corpus := filepath.Join(dir, "corpus")
+	require.Nil(t, os.MkdirAll(filepath.Join(corpus, "sub"), 0755))
+
+	files := map[string]string{
+		"bikes.txt":     "davis is a bike town with bike lanes",
+		"market.txt":    "the farmers market in davis",
+		"sub/shops.txt": "bike shops and repairs",
+	}
+	for name, content := range files {
+		require.Nil(t, os.WriteFile(filepath.Join(corpus, name), []byte(content), 0644))
+	}
+
+	queries := filepath.Join(dir, "queries.txt")
+	require.Nil(t, os.WriteFile(queries, []byte("# id query\n1 bike\n2 farmers market\n3 unknown\n"), 0644))
+
+	qrelsFile := filepath.Join(dir, "qrels.txt")
+	require.Nil(t, os.WriteFile(qrelsFile, []byte("1 0 bikes.txt 2\n1 0 sub/shops.txt 1\n2 0 market.txt 1\n3 0 market.txt 1\n"), 0644))
+
+	runFile := filepath.Join(dir, "run.json")
+	var out bytes.Buffer
+	err := runEval([]string{
+		"-corpus", corpus,
+		"-queries", queries,
+		"-qrels", qrelsFile,
+		"-out", runFile,
+	}, &out)
+	require.Nil(t, err)
+	require.Contains(t, out.String(), "MAP: 0.6667")
+
+	run, err := readRun(runFile)
+	require.Nil(t, err)
+	require.Len(t, run.Queries, 3)
+	require.Equal(t, 1.0, run.Queries[0].Metrics.AP)
+	require.Equal(t, 0, run.Queries[2].Retrieved)
+
+	out.Reset()
+	err = runEval([]string{
+		"-corpus", corpus,
+		"-queries", queries,
+		"-qrels", qrelsFile,
+		"-type", "intersection",
+		"-baseline", runFile,
+	}, &out)
+	require.Nil(t, err)
+	require.Contains(t, out.String(), "MAP: 0.6667 -> 0.6667")
+}
+
+// TestIndexCorpus checks that text is extracted from corpus files by their
+// content type.
+func TestIndexCorpus(t *testing.T) {
+	corpus := t.TempDir()
+	files := map[string]string{
+		"page.html": `<html><head><title>Bike lanes</title></head><body><div class="main">bike <b>lanes</b></div></body></html>`,
+		"notes.md":  "# Shops\n\nSee [the list](http://example.com/shops).",
+		"plain.txt": "<div>not markup</div>",
+	}
+	for name, content := range files {
+		require.Nil(t, os.WriteFile(filepath.Join(corpus, name), []byte(content), 0644))
+	}
+
+	idx, names, err := indexCorpus(corpus)
+	require.Nil(t, err)
+	require.Len(t, names, 3)
+	require.Equal(t, 1, idx.DocFreq("lanes"))
+	require.Equal(t, 0, idx.DocFreq("main"))
+	require.Equal(t, 1, idx.DocFreq("list"))
+	require.Equal(t, 0, idx.DocFreq("example"))
+	require.Equal(t, 1, idx.DocFreq("div"))
+}
+
+// failingQuerier fails union queries.
+type failingQuerier struct {
+	Querier
+}
+
+func (failingQuerier) Union(tokens ...string) ([]Posting, error) {
+	return nil, errors.New("union failed")
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	idx := NewIndex()
+	_, err := idx.IndexDocument(strings.NewReader("bike lanes"))
+	require.Nil(t, err)
+	names := map[int]string{0: "bikes.txt"}
+	queries := []evalQuery{{ID: "1", Text: "bike unknown"}}
+	judgements := qrels{"1": {"bikes.txt": 1}}
+
+	// Terms missing from the index match nothing.
+	run, err := evaluate(NewQuerier(idx), names, queries, judgements, "intersection", 10, 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, run.Queries[0].Retrieved)
+
+	// Other failures fail the evaluation.
+	_, err = evaluate(failingQuerier{NewQuerier(idx)}, names, queries, judgements, "union", 10, 10)
+	require.NotNil(t, err)
+}
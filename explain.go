@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Explanation describes how a part of a document's score was computed. The
+// score of a node is computed from the values of its details.
+type Explanation struct {
+	Match       bool          `json:"match"`
+	Value       float64       `json:"value"`
+	Description string        `json:"description"`
+	Details     []Explanation `json:"details,omitempty"`
+}
+
+// Explain describes whether the document with the given ID is in the
+// postings list matching the query terms, and how Rank computes its score.
+func (q *querier) Explain(postings []Posting, id int, terms ...QueryTerm) (Explanation, error) {
+	n := q.idx.DocCount()
+
+	termPostings, err := q.termPostings(terms)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	var clauses []Explanation
+	var missing []string
+	var sum float64
+	for i, tp := range termPostings {
+		c := explainTerm(terms[i], id, n, tp)
+		if !c.Match {
+			missing = append(missing, terms[i].Token)
+		}
+		sum += c.Value
+		clauses = append(clauses, c)
+	}
+
+	if freq(postings, id) == 0 {
+		desc := fmt.Sprintf("no match for doc %d", id)
+		switch {
+		case len(terms) == 0:
+			desc += ", the query has no terms"
+		case len(missing) != 0:
+			desc += fmt.Sprintf(", missing terms: %s", strings.Join(missing, ", "))
+		default:
+			desc += ", all terms occur but not as required by the query"
+		}
+		return Explanation{
+			Description: desc,
+			Details:     clauses,
+		}, nil
+	}
+
+	length := q.idx.DocLength(id)
+	norm := lengthNorm(length)
+
+	return Explanation{
+		Match:       true,
+		Value:       sum * norm,
+		Description: fmt.Sprintf("score(doc=%d), product of:", id),
+		Details: []Explanation{
+			{
+				Match:       true,
+				Value:       sum,
+				Description: "sum of:",
+				Details:     clauses,
+			},
+			{
+				Match:       true,
+				Value:       norm,
+				Description: "fieldNorm, computed as 1 / sqrt(length) from:",
+				Details: []Explanation{
+					{Match: true, Value: float64(length), Description: "length, number of tokens in the document"},
+				},
+			},
+		},
+	}, nil
+}
+
+// explainTerm describes the weight of a query term in a document.
+func explainTerm(t QueryTerm, id, n int, postings []Posting) Explanation {
+	f := freq(postings, id)
+	if f == 0 {
+		return Explanation{
+			Description: fmt.Sprintf("no occurrences of term '%s' in doc %d", t.Token, id),
+		}
+	}
+
+	df := len(postings)
+	termTf := tf(f)
+	termIdf := idf(n, df)
+
+	return Explanation{
+		Match:       true,
+		Value:       termTf * termIdf * t.Boost,
+		Description: fmt.Sprintf("weight(%s in %d), product of:", t.Token, id),
+		Details: []Explanation{
+			{Match: true, Value: t.Boost, Description: "boost"},
+			{
+				Match:       true,
+				Value:       termTf,
+				Description: "tf, computed as sqrt(freq) from:",
+				Details: []Explanation{
+					{Match: true, Value: float64(f), Description: "freq, occurrences of term within document"},
+				},
+			},
+			{
+				Match:       true,
+				Value:       termIdf,
+				Description: "idf, computed as 1 + log(docCount / (docFreq + 1)) from:",
+				Details: []Explanation{
+					{Match: true, Value: float64(df), Description: "docFreq, number of documents containing term"},
+					{Match: true, Value: float64(n), Description: "docCount, total number of documents"},
+				},
+			},
+		},
+	}
+}
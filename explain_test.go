@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []string{
+		"hello world foo",
+		"hello hello world",
+		"world hello",
+	} {
+		_, err := idx.IndexDocument(strings.NewReader(doc))
+		require.Nil(t, err)
+	}
+	q := NewQuerier(idx)
+
+	t.Run("score matches rank", func(t *testing.T) {
+		terms := []QueryTerm{{Token: "hello", Boost: 2}, {Token: "world", Boost: 1}}
+		postings, err := q.Intersection(tokens(terms)...)
+		require.Nil(t, err)
+
+		hits, err := q.Rank(postings, terms...)
+		require.Nil(t, err)
+
+		for _, h := range hits {
+			e, err := q.Explain(postings, h.DocID, terms...)
+			require.Nil(t, err)
+			require.True(t, e.Match)
+			require.InDelta(t, h.Score, e.Value, 1e-9)
+		}
+	})
+
+	t.Run("phrase not matching", func(t *testing.T) {
+		terms := []QueryTerm{{Token: "hello", Boost: 1}, {Token: "world", Boost: 1}}
+		postings, err := q.Phrase("hello world")
+		require.Nil(t, err)
+
+		e, err := q.Explain(postings, 2, terms...)
+		require.Nil(t, err)
+		require.False(t, e.Match)
+		require.Equal(t, 0.0, e.Value)
+		require.Len(t, e.Details, 2)
+		require.True(t, e.Details[0].Match)
+	})
+
+	t.Run("missing term", func(t *testing.T) {
+		terms := []QueryTerm{{Token: "foo", Boost: 1}}
+		postings, err := q.Intersection("foo")
+		require.Nil(t, err)
+
+		e, err := q.Explain(postings, 1, terms...)
+		require.Nil(t, err)
+		require.False(t, e.Match)
+		require.Equal(t, "no match for doc 1, missing terms: foo", e.Description)
+	})
+}
+
+// TestHandleExplain explains queries with terms not in the index and with
+// stop words only.
+func TestHandleExplain(t *testing.T) {
+	idx := NewIndex()
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+	h := NewService(idx, NewQuerier(idx), store, Config{Analyzer: analyzers["english"]}).(*service).Handler()
+	code, _ := do(t, h, "POST", "/doc?refresh=true", "hello world")
+	require.Equal(t, http.StatusOK, code)
+
+	tests := []struct {
+		query string
+		desc  string
+	}{
+		{query: "hello+zebra", desc: "no match for doc 0, missing terms: zebra"},
+		{query: "the", desc: "no match for doc 0, the query has no terms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			code, body := do(t, h, "GET", "/explain?id=0&query="+tt.query, "")
+			require.Equal(t, http.StatusOK, code)
+			var e Explanation
+			require.Nil(t, json.Unmarshal([]byte(body), &e))
+			require.False(t, e.Match)
+			require.Equal(t, tt.desc, e.Description)
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+const (
+	// linksField holds the outgoing links of a document, extracted along
+	// with its title.
+	linksField = "links"
+
+	// maxTagLength is the longest tag kept to find its name and
+	// attributes, maxEntityLength the longest character reference decoded
+	// and maxTitleLength the longest title extracted.
+	maxTagLength    = 4096
+	maxEntityLength = 32
+	maxTitleLength  = 1024
+
+	// maxLinks is the largest number of links extracted from a document.
+	maxLinks = 1000
+)
+
+// extractor reads the text of a document from its source. Markup is
+// replaced by spaces rather than removed, so the text is as long as the
+// source and the offsets of terms in the text are offsets in the source.
+type extractor interface {
+	io.Reader
+
+	// Fields returns the fields found in the document, once the text has
+	// been read to the end.
+	Fields() Fields
+}
+
+// newExtractor returns an extractor for a source with the given content
+// type. Sources that aren't HTML, XML or Markdown are read as plain text.
+func newExtractor(contentType string, r io.Reader) extractor {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "text/xml", "application/xml":
+		return newHTMLExtractor(r)
+	case "text/markdown", "text/x-markdown":
+		return newMarkdownExtractor(r)
+	}
+	return plainText{r}
+}
+
+// plainText is the extractor for plain text, which is its own text.
+type plainText struct {
+	io.Reader
+}
+
+func (plainText) Fields() Fields { return nil }
+
+// extractedFields returns the fields of a document with a title and links.
+func extractedFields(title string, links []string) Fields {
+	fields := make(Fields)
+	if title = strings.Join(strings.Fields(title), " "); title != "" {
+		fields[titleField] = []string{title}
+	}
+	if len(links) != 0 {
+		fields[linksField] = links
+	}
+	return fields
+}
+
+// withExtracted returns the fields of a document with the fields extracted
+// from its source added. Fields given with the document take precedence.
+func withExtracted(fields, extracted Fields) Fields {
+	if len(extracted) == 0 {
+		return fields
+	}
+	out := make(Fields, len(fields)+len(extracted))
+	for name, values := range extracted {
+		out[name] = values
+	}
+	for name, values := range fields {
+		out[name] = values
+	}
+	return out
+}
+
+// linkSet collects the distinct links of a document, in order.
+type linkSet struct {
+	links []string
+	seen  map[string]bool
+}
+
+func (s *linkSet) add(link string) {
+	link = strings.TrimSpace(link)
+	if link == "" || strings.HasPrefix(link, "#") || len(s.links) == maxLinks {
+		return
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	if s.seen[link] {
+		return
+	}
+	s.seen[link] = true
+	s.links = append(s.links, link)
+}
+
+type htmlState int
+
+const (
+	htmlText htmlState = iota
+	htmlTag
+	htmlComment
+	htmlEntity
+)
+
+// htmlExtractor extracts the text of HTML and XML documents. Tags, comments
+// and the contents of scripts and style sheets are blanked out, and
+// character references are decoded. The title is taken from the title
+// element and the links from the href attributes of anchors.
+type htmlExtractor struct {
+	r   *bufio.Reader
+	out []byte
+	err error
+
+	state htmlState
+	// tag holds the tag being read, quote the quote of the attribute value
+	// being read, if any, and entity the character reference being read.
+	tag    []byte
+	quote  byte
+	entity []byte
+	// raw is the name of the script or style element being read, whose
+	// contents aren't text.
+	raw string
+
+	inTitle bool
+	title   bytes.Buffer
+	links   linkSet
+}
+
+func newHTMLExtractor(r io.Reader) *htmlExtractor {
+	return &htmlExtractor{
+		r: bufio.NewReader(r),
+	}
+}
+
+func (e *htmlExtractor) Read(p []byte) (int, error) {
+	for len(e.out) < len(p) && e.err == nil {
+		c, err := e.r.ReadByte()
+		if err != nil {
+			if e.state == htmlEntity {
+				e.text(e.entity...)
+			}
+			e.err = err
+			break
+		}
+		e.next(c)
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	if len(e.out) == 0 && e.err != nil {
+		return n, e.err
+	}
+	return n, nil
+}
+
+// next processes a byte of the source.
+func (e *htmlExtractor) next(c byte) {
+	switch e.state {
+	case htmlText:
+		switch {
+		case c == '<' && isTagStart(e.peek()) && (e.raw == "" || e.peek() == '/'):
+			e.state = htmlTag
+			e.tag = e.tag[:0]
+			e.quote = 0
+			e.blank(c)
+		case c == '&' && e.raw == "":
+			e.state = htmlEntity
+			e.entity = append(e.entity[:0], c)
+		case e.raw != "":
+			e.blank(c)
+		default:
+			e.text(c)
+		}
+
+	case htmlTag:
+		e.blank(c)
+		switch {
+		case e.quote != 0:
+			if c == e.quote {
+				e.quote = 0
+			}
+		case c == '"' || c == '\'':
+			e.quote = c
+		case c == '>':
+			e.state = htmlText
+			e.endTag()
+			return
+		}
+		if len(e.tag) < maxTagLength {
+			e.tag = append(e.tag, c)
+		}
+		if string(e.tag) == "!--" {
+			e.state = htmlComment
+		}
+
+	case htmlComment:
+		e.blank(c)
+		e.tag = append(e.tag, c)
+		if bytes.HasSuffix(e.tag, []byte("-->")) {
+			e.state = htmlText
+		}
+		if len(e.tag) > 3 {
+			e.tag = e.tag[len(e.tag)-3:]
+		}
+
+	case htmlEntity:
+		isName := c == '#' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if c == ';' {
+			e.entity = append(e.entity, c)
+			e.state = htmlText
+			e.decode()
+			return
+		}
+		if !isName || len(e.entity) == maxEntityLength {
+			// Not a character reference after all.
+			e.state = htmlText
+			e.text(e.entity...)
+			e.r.UnreadByte()
+			return
+		}
+		e.entity = append(e.entity, c)
+	}
+}
+
+// isTagStart returns if the byte after a < starts a tag, rather than the <
+// being text.
+func isTagStart(c byte) bool {
+	return c == '/' || c == '!' || c == '?' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (e *htmlExtractor) peek() byte {
+	b, err := e.r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+// text outputs text of the document.
+func (e *htmlExtractor) text(b ...byte) {
+	e.out = append(e.out, b...)
+	if e.inTitle && e.title.Len() < maxTitleLength {
+		e.title.Write(b)
+	}
+}
+
+// blank outputs the space of markup, keeping line breaks.
+func (e *htmlExtractor) blank(c byte) {
+	if c != '\n' {
+		c = ' '
+	}
+	e.out = append(e.out, c)
+}
+
+// decode outputs the decoded character reference, padded with spaces to
+// its length in the source.
+func (e *htmlExtractor) decode() {
+	decoded := html.UnescapeString(string(e.entity))
+	if decoded == "\u00a0" {
+		decoded = " "
+	}
+	if len(decoded) > len(e.entity) || decoded == string(e.entity) {
+		e.text(e.entity...)
+		return
+	}
+	e.text([]byte(decoded)...)
+	for i := len(decoded); i < len(e.entity); i++ {
+		e.blank(' ')
+	}
+}
+
+// endTag handles the tag just read.
+func (e *htmlExtractor) endTag() {
+	tag := e.tag
+	closing := len(tag) > 0 && tag[0] == '/'
+	if closing {
+		tag = tag[1:]
+	}
+	end := bytes.IndexAny(tag, " \t\r\n/")
+	if end == -1 {
+		end = len(tag)
+	}
+	name := strings.ToLower(string(tag[:end]))
+
+	if e.raw != "" {
+		if closing && name == e.raw {
+			e.raw = ""
+		}
+		return
+	}
+
+	switch name {
+	case "script", "style":
+		if !closing && !bytes.HasSuffix(tag, []byte("/")) {
+			e.raw = name
+		}
+	case "title":
+		e.inTitle = !closing
+	case "a":
+		if !closing {
+			e.links.add(html.UnescapeString(attribute(tag[end:], "href")))
+		}
+	}
+}
+
+// attribute returns the value of the attribute with the given name among
+// the attributes of a tag.
+func attribute(attrs []byte, name string) string {
+	i := 0
+	for i < len(attrs) {
+		for i < len(attrs) && strings.IndexByte(" \t\r\n/", attrs[i]) != -1 {
+			i++
+		}
+		start := i
+		for i < len(attrs) && strings.IndexByte(" \t\r\n/=", attrs[i]) == -1 {
+			i++
+		}
+		key := strings.ToLower(string(attrs[start:i]))
+		if i >= len(attrs) || attrs[i] != '=' {
+			continue
+		}
+		i++
+
+		var value []byte
+		if i < len(attrs) && (attrs[i] == '"' || attrs[i] == '\'') {
+			quote := attrs[i]
+			end := bytes.IndexByte(attrs[i+1:], quote)
+			if end == -1 {
+				end = len(attrs) - i - 1
+			}
+			value = attrs[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			start := i
+			for i < len(attrs) && strings.IndexByte(" \t\r\n", attrs[i]) == -1 {
+				i++
+			}
+			value = attrs[start:i]
+		}
+		if key == name {
+			return string(value)
+		}
+	}
+	return ""
+}
+
+func (e *htmlExtractor) Fields() Fields {
+	return extractedFields(e.title.String(), e.links.links)
+}
+
+var (
+	// markdownHeading matches an ATX heading, with its level and text.
+	markdownHeading = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?[ \t#]*$`)
+	// markdownMarker matches the block quote and list markers at the start
+	// of a line.
+	markdownMarker = regexp.MustCompile(`^[ \t]*(?:>[ \t]?)*(?:[-*+][ \t]|[0-9]+[.)][ \t])?`)
+	// markdownLink matches inline links and images, with the text and the
+	// destination.
+	markdownLink = regexp.MustCompile(`!?\[([^\]]*)\]\(<?([^)\s>]*)>?(?:\s+"[^"]*")?\)`)
+	// markdownRefLink matches reference links, with the text.
+	markdownRefLink = regexp.MustCompile(`\[([^\]]+)\]\[[^\]]*\]`)
+	// markdownAutolink matches autolinks.
+	markdownAutolink = regexp.MustCompile(`<((?:https?|ftp|mailto):[^>\s]*)>`)
+	// markdownReference matches link reference definitions.
+	markdownReference = regexp.MustCompile(`^ {0,3}\[[^\]]+\]:\s*<?(\S+?)>?(?:\s+.*)?$`)
+	// markdownRule matches thematic breaks, code fences and setext heading
+	// underlines.
+	markdownRule = regexp.MustCompile("^ {0,3}(?:[-*_=][ \\t]*){3,}$|^ {0,3}(?:```|~~~)")
+)
+
+// maxMarkdownLine is the longest line read from a Markdown document. Longer
+// lines are split into several, which keeps the memory used for a single
+// line bounded.
+const maxMarkdownLine = 64 << 10
+
+// markdownExtractor extracts the text of Markdown documents line by line.
+// Heading, quote and list markers, emphasis and the destinations of links
+// are blanked out. The title is taken from the first level 1 heading and
+// the links from inline links, autolinks and reference definitions.
+type markdownExtractor struct {
+	r   *bufio.Reader
+	out []byte
+	err error
+
+	title string
+	links linkSet
+}
+
+func newMarkdownExtractor(r io.Reader) *markdownExtractor {
+	return &markdownExtractor{
+		r: bufio.NewReaderSize(r, maxMarkdownLine),
+	}
+}
+
+func (e *markdownExtractor) Read(p []byte) (int, error) {
+	for len(e.out) < len(p) && e.err == nil {
+		line, err := e.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = nil
+		}
+		if len(line) != 0 {
+			e.out = append(e.out, e.line(line)...)
+		}
+		if err != nil {
+			e.err = err
+		}
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	if len(e.out) == 0 && e.err != nil {
+		return n, e.err
+	}
+	return n, nil
+}
+
+// line returns the text of a line of the source.
+func (e *markdownExtractor) line(line []byte) []byte {
+	content := bytes.TrimRight(line, "\r\n")
+	out := make([]byte, len(line))
+	copy(out, line)
+	blank := func(start, end int) {
+		for i := start; i < end; i++ {
+			out[i] = ' '
+		}
+	}
+
+	if markdownRule.Match(content) {
+		blank(0, len(content))
+		return out
+	}
+	if m := markdownReference.FindSubmatch(content); m != nil {
+		e.links.add(string(m[1]))
+		blank(0, len(content))
+		return out
+	}
+
+	// title is the span of the text of a level 1 heading.
+	var title []int
+	if m := markdownHeading.FindSubmatchIndex(content); m != nil {
+		blank(m[2], m[3])
+		if m[3]-m[2] == 1 && m[4] != -1 {
+			title = m[4:6]
+		}
+	} else if m := markdownMarker.FindIndex(content); m != nil {
+		blank(m[0], m[1])
+	}
+
+	for _, m := range markdownLink.FindAllSubmatchIndex(content, -1) {
+		e.links.add(string(content[m[4]:m[5]]))
+		blank(m[0], m[2])
+		blank(m[3], m[1])
+	}
+	for _, m := range markdownRefLink.FindAllSubmatchIndex(content, -1) {
+		blank(m[0], m[2])
+		blank(m[3], m[1])
+	}
+	for _, m := range markdownAutolink.FindAllSubmatchIndex(content, -1) {
+		e.links.add(string(content[m[2]:m[3]]))
+		blank(m[0], m[2])
+		blank(m[3], m[1])
+	}
+
+	// Emphasis and code spans. Underscores within words are kept.
+	for i, c := range content {
+		switch c {
+		case '*', '`', '~':
+			out[i] = ' '
+		case '_':
+			if i == 0 || i == len(content)-1 || !isWordByte(content[i-1]) || !isWordByte(content[i+1]) {
+				out[i] = ' '
+			}
+		}
+	}
+
+	if title != nil && e.title == "" {
+		e.title = string(out[title[0]:title[1]])
+	}
+	return out
+}
+
+func isWordByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+func (e *markdownExtractor) Fields() Fields {
+	return extractedFields(e.title, e.links.links)
+}
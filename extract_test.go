@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// extract reads the text and the fields of the source.
+func extract(t *testing.T, contentType, source string) (string, Fields) {
+	t.Helper()
+	e := newExtractor(contentType, strings.NewReader(source))
+	text, err := io.ReadAll(e)
+	require.Nil(t, err)
+	require.Equal(t, len(source), len(text))
+	return string(text), e.Fields()
+}
+
+func TestExtractHTML(t *testing.T) {
+	source := `<!DOCTYPE html>
+<html><head><title>Davis &amp; Co</title>
+<style>body { color: red; }</style>
+<script>if (a < b && c > d) { x = "</p>"; }</script></head>
+<body><!-- a <b>comment</b> -->
+<h1 class="big">Hello&nbsp;world</h1>
+<p>Fish &amp; chips cost &lt; 5 &euro; at <a href="http://example.com/?a=1&amp;b=2">the shop</a>.
+See <A HREF='/wiki/Other'>other</A>, <a href=#top>top</a> and <a name="x">this</a>.
+2 < 3 &unknown; &#65;&#x42;</p>
+</body></html>`
+
+	text, fields := extract(t, "text/html; charset=utf-8", source)
+	require.Equal(t, Fields{
+		titleField: {"Davis & Co"},
+		linksField: {"http://example.com/?a=1&b=2", "/wiki/Other"},
+	}, fields)
+	require.Equal(t, []string{
+		"Davis", "&", "Co",
+		"Hello", "world",
+		"Fish", "&", "chips", "cost", "<", "5", "€", "at", "the", "shop", ".",
+		"See", "other", ",", "top", "and", "this", ".",
+		"2", "<", "3", "&unknown;", "A", "B",
+	}, strings.Fields(text))
+
+	// Offsets in the text are offsets in the source.
+	require.Equal(t, "chips", text[strings.Index(source, "chips"):][:5])
+}
+
+func TestExtractMarkdown(t *testing.T) {
+	source := `# The *Title*
+
+Some **bold** and _emphasized_ text with a snake_case word.
+
+## Links
+- A [link](http://example.com/a "Title") and ![an image](img.png).
+> Quoted <https://example.com/b>
+1. See [the docs][docs].
+
+[docs]: http://example.com/docs
+---
+` + "```go\nfmt.Println(\"code\")\n```\n"
+
+	text, fields := extract(t, "text/markdown", source)
+	require.Equal(t, Fields{
+		titleField: {"The Title"},
+		linksField: {"http://example.com/a", "img.png", "https://example.com/b", "http://example.com/docs"},
+	}, fields)
+	require.Equal(t, []string{
+		"The", "Title",
+		"Some", "bold", "and", "emphasized", "text", "with", "a", "snake_case", "word.",
+		"Links",
+		"A", "link", "and", "an", "image", ".",
+		"Quoted", "https://example.com/b",
+		"See", "the", "docs", ".",
+		"fmt.Println(\"code\")",
+	}, strings.Fields(text))
+}
+
+// TestExtractMarkdownLongLine extracts a line longer than maxMarkdownLine,
+// which is read in parts.
+func TestExtractMarkdownLongLine(t *testing.T) {
+	n := 2*maxMarkdownLine/len("**bold** ") + 1
+	source := "# Title\n" + strings.Repeat("**bold** ", n) + "\nend\n"
+
+	text, fields := extract(t, "text/markdown", source)
+	require.Equal(t, Fields{titleField: {"Title"}}, fields)
+	words := strings.Fields(text)
+	require.Len(t, words, n+2)
+	require.Equal(t, "bold", words[n])
+	require.Equal(t, "end", words[n+1])
+}
+
+func TestExtractPlainText(t *testing.T) {
+	text, fields := extract(t, "application/octet-stream", "<p>not html</p>")
+	require.Equal(t, "<p>not html</p>", text)
+	require.Nil(t, fields)
+
+	text, _ = extract(t, "invalid;;", "# not markdown")
+	require.Equal(t, "# not markdown", text)
+}
+
+// TestExtractFields indexes an HTML document and checks that the extracted
+// fields are added, unless given with the document.
+func TestExtractFields(t *testing.T) {
+	source := `<title>Page</title><a href="/x">x</a>`
+
+	var b Batch
+	require.Nil(t, b.Index(strings.NewReader(source), Fields{contentTypeField: {"text/html"}}))
+	require.Nil(t, b.Index(strings.NewReader(source), Fields{contentTypeField: {"text/html"}, titleField: {"Given"}}))
+	require.Equal(t, Fields{contentTypeField: {"text/html"}, titleField: {"Page"}, linksField: {"/x"}}, b.ops[0].fields)
+	require.Equal(t, Fields{contentTypeField: {"text/html"}, titleField: {"Given"}, linksField: {"/x"}}, b.ops[1].fields)
+
+	_, ok := b.ops[0].doc.terms["href"]
+	require.False(t, ok)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// rocchioParams weights the parts of a reformulated query.
+type rocchioParams struct {
+	// Alpha weights the original query.
+	Alpha float64 `json:"alpha"`
+
+	// Beta weights the centroid of the relevant documents.
+	Beta float64 `json:"beta"`
+
+	// Gamma weights the centroid of the non-relevant documents, which is
+	// subtracted from the query.
+	Gamma float64 `json:"gamma"`
+
+	// MaxTerms is the maximum number of terms in the reformulated query.
+	MaxTerms int `json:"max_terms"`
+}
+
+var defaultRocchioParams = rocchioParams{
+	Alpha:    1,
+	Beta:     0.75,
+	Gamma:    0.15,
+	MaxTerms: 25,
+}
+
+// termVector maps tokens to weights.
+type termVector map[string]float64
+
+// tfidfVector weights the term frequencies of a document by tf-idf against
+// the index and normalizes the vector to unit length.
+func tfidfVector(idx Index, freqs map[string]int) termVector {
+	n := idx.DocCount()
+
+	v := make(termVector, len(freqs))
+	for t, f := range freqs {
+		df := idx.DocFreq(t)
+		if df == 0 {
+			continue
+		}
+		v[t] = tf(f) * idf(n, df)
+	}
+	v.normalize()
+	return v
+}
+
+// queryVector returns the vector of the query terms, weighted by their
+// boosts and normalized to unit length.
+func queryVector(terms []QueryTerm) termVector {
+	v := make(termVector, len(terms))
+	for _, t := range terms {
+		v[t.Token] += t.Boost
+	}
+	v.normalize()
+	return v
+}
+
+// normalize scales the vector to unit length.
+func (v termVector) normalize() {
+	var sum float64
+	for _, w := range v {
+		sum += w * w
+	}
+	if sum == 0 {
+		return
+	}
+
+	norm := math.Sqrt(sum)
+	for t := range v {
+		v[t] /= norm
+	}
+}
+
+// rocchio reformulates the query vector by moving it towards the centroid
+// of the relevant documents and away from the centroid of the non-relevant
+// ones:
+//
+//	q' = alpha * q + beta * mean(relevant) - gamma * mean(nonRelevant)
+//
+// Terms with a non-positive weight are dropped, and the MaxTerms terms with
+// the highest weights are returned.
+func rocchio(query termVector, relevant, nonRelevant []termVector, p rocchioParams) []QueryTerm {
+	out := make(termVector)
+	for t, w := range query {
+		out[t] += p.Alpha * w
+	}
+	for _, d := range relevant {
+		for t, w := range d {
+			out[t] += p.Beta * w / float64(len(relevant))
+		}
+	}
+	for _, d := range nonRelevant {
+		for t, w := range d {
+			out[t] -= p.Gamma * w / float64(len(nonRelevant))
+		}
+	}
+
+	var terms []QueryTerm
+	for t, w := range out {
+		if w <= 0 {
+			continue
+		}
+		terms = append(terms, QueryTerm{Token: t, Boost: w})
+	}
+
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Boost != terms[j].Boost {
+			return terms[i].Boost > terms[j].Boost
+		}
+		return terms[i].Token < terms[j].Token
+	})
+	if len(terms) > p.MaxTerms {
+		terms = terms[:p.MaxTerms]
+	}
+	return terms
+}
+
+// validate checks that the parameters are usable.
+func (p rocchioParams) validate() error {
+	if p.Alpha < 0 || p.Beta < 0 || p.Gamma < 0 {
+		return fmt.Errorf("alpha, beta and gamma must not be negative")
+	}
+	if p.MaxTerms <= 0 {
+		return fmt.Errorf("max_terms must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRocchio(t *testing.T) {
+	query := termVector{"bike": 1}
+	relevant := []termVector{
+		{"bike": 0.6, "lanes": 0.8},
+		{"bike": 0.6, "shop": 0.8},
+	}
+	nonRelevant := []termVector{
+		{"motor": 0.6, "lanes": 0.8},
+	}
+
+	tests := []struct {
+		name string
+		p    rocchioParams
+		res  []QueryTerm
+	}{
+		{
+			name: "expanded query",
+			p:    rocchioParams{Alpha: 1, Beta: 1, Gamma: 0.5, MaxTerms: 10},
+			res: []QueryTerm{
+				{Token: "bike", Boost: 1.6},
+				{Token: "shop", Boost: 0.4},
+			},
+		},
+		{
+			name: "max terms",
+			p:    rocchioParams{Alpha: 1, Beta: 1, Gamma: 0, MaxTerms: 1},
+			res: []QueryTerm{
+				{Token: "bike", Boost: 1.6},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := rocchio(query, relevant, nonRelevant, tt.p)
+			require.Equal(t, len(tt.res), len(res))
+			for i := range tt.res {
+				require.Equal(t, tt.res[i].Token, res[i].Token)
+				require.InDelta(t, tt.res[i].Boost, res[i].Boost, 1e-9)
+			}
+		})
+	}
+}
+
+func TestTfidfVector(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []string{"bike lanes", "bike shop"} {
+		_, err := idx.IndexDocument(strings.NewReader(doc))
+		require.Nil(t, err)
+	}
+
+	v := tfidfVector(idx, map[string]int{"bike": 1, "lanes": 2, "unknown": 1})
+	require.NotContains(t, v, "unknown")
+	require.Greater(t, v["lanes"], v["bike"])
+
+	var sum float64
+	for _, w := range v {
+		sum += w * w
+	}
+	require.InDelta(t, 1, math.Sqrt(sum), 1e-9)
+}
+
+func TestFeedbackRequestBody(t *testing.T) {
+	body := FeedbackRequestBody{rocchioParams: defaultRocchioParams}
+	err := json.Unmarshal([]byte(`{"query":"bike","relevant":[1],"beta":0.5}`), &body)
+	require.Nil(t, err)
+	require.Equal(t, []int{1}, body.Relevant)
+	require.Equal(t, 1.0, body.Alpha)
+	require.Equal(t, 0.5, body.Beta)
+	require.Nil(t, body.validate())
+}
+
+// TestHandleFeedback expands a query with a term not in the index from the
+// term vector of a relevant document.
+func TestHandleFeedback(t *testing.T) {
+	idx := NewIndex()
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+	s := NewService(idx, NewQuerier(idx), store, Config{}).(*service)
+	h := s.Handler()
+	for _, doc := range []string{"bike lanes downtown", "bike shop", "motor cars"} {
+		code, _ := do(t, h, "POST", "/doc?refresh=true", doc)
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	// The expansion comes from the index, not from the stored source.
+	require.Nil(t, store.PutFromStream(strings.NewReader("unrelated words"), 0))
+
+	code, body := do(t, h, "POST", "/feedback", `{"query": "bike nothere", "relevant": [0]}`)
+	require.Equal(t, http.StatusOK, code)
+	var res ExpandedQueryResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	expanded := tokens(res.Terms)
+	require.Contains(t, expanded, "lanes")
+	require.NotContains(t, expanded, "unrelated")
+	require.Equal(t, 2, res.Hits)
+}
@@ -1,24 +1,70 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 )
 
 type Index interface {
 	IndexDocument(r io.Reader) (int, error)
+	Delete(id int) error
+	Prepare(b *Batch) (*Txn, []BatchResult)
+	Commit(txn *Txn) error
+	Refresh() (bool, error)
+	Lookup(externalID string) (int, bool)
 	Postings(token string) ([]Posting, error)
+	DocCount() int
+	DocLength(id int) int
+	SetFields(id int, fields Fields)
+	Fields(id int) Fields
+	DocValues(id int, field string) []DocValue
+	Version() uint64
+	Terms() []string
+	DocFreq(token string) int
+	DocIDs() []int
+	TermVector(id int) (TermVector, error)
+	TotalTermFreq(token string) int
+	SumTotalTermFreq() int
+	Reset()
 }
 
 type index struct {
-	dict   map[string][]Posting
-	nextID int
+	mu sync.RWMutex
+
+	dict    map[string][]Posting
+	lengths map[int]int
+	values  *docValues
+	nextID  int
+
+	// vectors holds the term vector of every document. ttf holds the
+	// total number of occurrences of every token and tokens the total
+	// number of tokens in the index.
+	vectors map[int][]storedTerm
+	ttf     map[string]int
+	tokens  int
+
+	// external maps external document IDs to internal ones. It includes
+	// the documents of committed transactions not yet refreshed, which are
+	// held in pending.
+	external map[string]int
+	pending  []*Txn
+
+	// version is incremented on every change to the index.
+	version uint64
 }
 
 func NewIndex() Index {
 	return &index{
-		dict:   make(map[string][]Posting),
-		nextID: 0,
+		dict:     make(map[string][]Posting),
+		lengths:  make(map[int]int),
+		values:   newDocValues(),
+		nextID:   0,
+		vectors:  make(map[int][]storedTerm),
+		ttf:      make(map[string]int),
+		external: make(map[string]int),
 	}
 }
 
@@ -44,52 +90,311 @@ type Posting struct {
 
 // IndexDocument tokenizes the document from the reader and adds the tokens to
 // the index. It returns the ID of the new document.
+//
+// The document is tokenized before the index is locked, so readers are only
+// blocked while the tokens are added.
 func (idx *index) IndexDocument(r io.Reader) (int, error) {
+	doc, err := analyzers[defaultAnalyzer].analyze(r)
+	if err != nil {
+		return 0, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	id := idx.add(doc)
+	idx.version++
+	return id, nil
+}
+
+// add adds an analyzed document to the index and returns its ID. The caller
+// must hold the write lock.
+func (idx *index) add(doc analyzedDoc) int {
 	id := idx.id()
-	tokenizer := NewTokenizer(r)
-	position := 0
+	idx.addAs(id, doc)
+	return id
+}
 
-	for tokenizer.HasMoreTokens() {
-		t, err := tokenizer.NextToken()
-		if err != nil {
-			return 0, fmt.Errorf("next token: %w", err)
-		}
-		if t == "" {
-			break
-		}
+// addAs adds an analyzed document to the index with an ID already assigned.
+// The caller must hold the write lock.
+func (idx *index) addAs(id int, doc analyzedDoc) {
+	for t, at := range doc.terms {
+		idx.dict[t] = append(idx.dict[t], Posting{
+			DocID:     id,
+			Freq:      len(at.positions),
+			Positions: at.positions,
+		})
+		idx.ttf[t] += len(at.positions)
+	}
+	idx.lengths[id] = doc.length
+	idx.vectors[id] = newStoredTerms(doc.offsets())
+	idx.tokens += doc.length
+}
 
-		if _, ok := idx.dict[t]; !ok {
-			idx.dict[t] = []Posting{}
-		}
+// analyzedDoc is a tokenized document, not yet added to the index.
+type analyzedDoc struct {
+	terms  map[string]*analyzedTerm
+	length int
+}
+
+// analyzedTerm holds the occurrences of a term in a document.
+type analyzedTerm struct {
+	positions []int
+	offsets   []int
+}
+
+// offsets returns the start offsets of every term.
+func (d analyzedDoc) offsets() map[string][]int {
+	out := make(map[string][]int, len(d.terms))
+	for t, at := range d.terms {
+		out[t] = at.offsets
+	}
+	return out
+}
 
-		var posting *Posting
-		found, i := hasDocID(idx.dict[t], id)
-		if found {
-			posting = &idx.dict[t][i]
-		} else {
-			idx.dict[t] = append(idx.dict[t], Posting{
-				DocID: id,
-			})
-			posting = &idx.dict[t][len(idx.dict[t])-1]
+// Delete removes the document with the given ID from the index.
+//
+// Postings lists are copied rather than changed in place, since readers may
+// still hold them.
+func (idx *index) Delete(id int) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if ext := idx.values.get(id, externalIDField); len(ext) != 0 && idx.external[ext[0].Str] == id {
+		delete(idx.external, ext[0].Str)
+	}
+	if err := idx.remove(id); err != nil {
+		return err
+	}
+	idx.version++
+	return nil
+}
+
+// remove removes the document with the given ID from the index. The caller
+// must hold the write lock.
+func (idx *index) remove(id int) error {
+	stored, ok := idx.vectors[id]
+	if !ok {
+		return errDocNotInIndex(id)
+	}
+
+	for _, st := range stored {
+		postings := idx.dict[st.term]
+		i := sort.Search(len(postings), func(i int) bool {
+			return postings[i].DocID >= id
+		})
+		if i == len(postings) || postings[i].DocID != id {
+			continue
 		}
 
-		posting.Freq++
-		posting.Positions = append(posting.Positions, position)
-		position++
+		if len(postings) == 1 {
+			delete(idx.dict, st.term)
+			delete(idx.ttf, st.term)
+			continue
+		}
+		rest := make([]Posting, 0, len(postings)-1)
+		rest = append(rest, postings[:i]...)
+		rest = append(rest, postings[i+1:]...)
+		idx.dict[st.term] = rest
+		idx.ttf[st.term] -= len(st.offsets)
 	}
-	return id, nil
+
+	idx.tokens -= idx.lengths[id]
+	delete(idx.lengths, id)
+	delete(idx.vectors, id)
+	idx.values.set(id, nil)
+	return nil
 }
 
-var errTokenNotInIndex = func(token string) error { return fmt.Errorf("token '%s' not found in index", token) }
+// errNotFound is wrapped by errors about documents and tokens that don't
+// exist.
+var errNotFound = errors.New("not found")
+
+var errTokenNotInIndex = func(token string) error { return fmt.Errorf("token '%s' %w in index", token, errNotFound) }
+
+var errDocNotInIndex = func(id int) error { return fmt.Errorf("document %d %w in index", id, errNotFound) }
 
 // Postings returns the full postings list for the given token.
 func (idx *index) Postings(token string) ([]Posting, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
 	if _, ok := idx.dict[token]; !ok {
 		return nil, errTokenNotInIndex(token)
 	}
 	return idx.dict[token], nil
 }
 
+// DocCount returns the number of documents in the index.
+func (idx *index) DocCount() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return len(idx.lengths)
+}
+
+// DocLength returns the number of tokens in the document with the given ID.
+func (idx *index) DocLength(id int) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.lengths[id]
+}
+
+// SetFields replaces the field values of the document with the given ID.
+// If the fields hold an external ID, it's mapped to the document.
+func (idx *index) SetFields(id int, fields Fields) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if ext := fields.first(externalIDField); ext != "" {
+		idx.external[ext] = id
+	}
+	idx.values.set(id, fields)
+	idx.version++
+}
+
+// Lookup returns the internal ID of the document with the given external ID.
+// Documents committed but not yet refreshed are included.
+func (idx *index) Lookup(externalID string) (int, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	id, ok := idx.external[externalID]
+	return id, ok
+}
+
+// Fields returns the field values of the document with the given ID.
+func (idx *index) Fields(id int) Fields {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.values.fields(id)
+}
+
+// DocValues returns the parsed values of a field of the document with the
+// given ID.
+func (idx *index) DocValues(id int, field string) []DocValue {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.values.get(id, field)
+}
+
+// Terms returns all tokens in the index, in no particular order.
+func (idx *index) Terms() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	out := make([]string, 0, len(idx.dict))
+	for t := range idx.dict {
+		out = append(out, t)
+	}
+	return out
+}
+
+// DocFreq returns the number of documents containing the token.
+func (idx *index) DocFreq(token string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return len(idx.dict[token])
+}
+
+// DocIDs returns the IDs of all documents in the index in ascending order.
+func (idx *index) DocIDs() []int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	out := make([]int, 0, len(idx.lengths))
+	for id := range idx.lengths {
+		out = append(out, id)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// TermVector returns the terms of the document with the given ID, with
+// their frequencies, positions and offsets.
+func (idx *index) TermVector(id int) (TermVector, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	stored, ok := idx.vectors[id]
+	if !ok {
+		return TermVector{}, errDocNotInIndex(id)
+	}
+
+	tv := TermVector{
+		DocID: id,
+		Terms: make([]TermVectorEntry, 0, len(stored)),
+	}
+	for _, st := range stored {
+		e := TermVectorEntry{
+			Term: st.term,
+			Freq: len(st.offsets),
+		}
+
+		postings := idx.dict[st.term]
+		i := sort.Search(len(postings), func(i int) bool {
+			return postings[i].DocID >= id
+		})
+		if i < len(postings) && postings[i].DocID == id {
+			e.Positions = postings[i].Positions
+		}
+
+		for _, o := range st.offsets {
+			e.Offsets = append(e.Offsets, Offset{Start: o, End: o + len(st.term)})
+		}
+		tv.Terms = append(tv.Terms, e)
+	}
+	return tv, nil
+}
+
+// TotalTermFreq returns the total number of occurrences of the token in all
+// documents.
+func (idx *index) TotalTermFreq(token string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.ttf[token]
+}
+
+// SumTotalTermFreq returns the total number of tokens in all documents.
+func (idx *index) SumTotalTermFreq() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.tokens
+}
+
+// Version returns a number that changes whenever the index changes.
+func (idx *index) Version() uint64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.version
+}
+
+// Reset removes all documents and pending transactions from the index. IDs
+// are assigned from zero again, while the version keeps increasing, so
+// anything keyed by it sees the change.
+func (idx *index) Reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.dict = make(map[string][]Posting)
+	idx.lengths = make(map[int]int)
+	idx.values = newDocValues()
+	idx.nextID = 0
+	idx.vectors = make(map[int][]storedTerm)
+	idx.ttf = make(map[string]int)
+	idx.tokens = 0
+	idx.external = make(map[string]int)
+	idx.pending = nil
+	idx.version++
+}
+
 func (idx *index) id() int {
 	id := idx.nextID
 	idx.nextID++
@@ -228,3 +228,81 @@ func TestMin(t *testing.T) {
 		require.Equal(t, tt.res, res)
 	}
 }
+
+func TestDocStats(t *testing.T) {
+	idx := NewIndex()
+	require.Equal(t, 0, idx.DocCount())
+
+	id, err := idx.IndexDocument(strings.NewReader("Hello hello, world!"))
+	require.Nil(t, err)
+	require.Equal(t, 1, idx.DocCount())
+	require.Equal(t, 3, idx.DocLength(id))
+}
+
+func TestTermVector(t *testing.T) {
+	idx := NewIndex()
+	_, err := idx.IndexDocument(strings.NewReader("Hello world"))
+	require.Nil(t, err)
+	id, err := idx.IndexDocument(strings.NewReader("Hello hello, world!"))
+	require.Nil(t, err)
+
+	tv, err := idx.TermVector(id)
+	require.Nil(t, err)
+	require.Equal(t, TermVector{
+		DocID: id,
+		Terms: []TermVectorEntry{
+			{
+				Term:      "hello",
+				Freq:      2,
+				Positions: []int{0, 1},
+				Offsets:   []Offset{{Start: 0, End: 5}, {Start: 6, End: 11}},
+			},
+			{
+				Term:      "world",
+				Freq:      1,
+				Positions: []int{2},
+				Offsets:   []Offset{{Start: 13, End: 18}},
+			},
+		},
+	}, tv)
+	require.Equal(t, map[string]int{"hello": 2, "world": 1}, tv.freqs())
+
+	require.Equal(t, 3, idx.TotalTermFreq("hello"))
+	require.Equal(t, 5, idx.SumTotalTermFreq())
+
+	_, err = idx.TermVector(10)
+	require.Equal(t, errDocNotInIndex(10), err)
+}
+
+func TestDelete(t *testing.T) {
+	idx := NewIndex()
+	first, err := idx.IndexDocument(strings.NewReader("hello world"))
+	require.Nil(t, err)
+	idx.SetFields(first, Fields{externalIDField: {"a"}, "title": {"first"}})
+	second, err := idx.IndexDocument(strings.NewReader("hello again"))
+	require.Nil(t, err)
+
+	id, ok := idx.Lookup("a")
+	require.True(t, ok)
+	require.Equal(t, first, id)
+
+	version := idx.Version()
+	require.Nil(t, idx.Delete(first))
+	require.NotEqual(t, version, idx.Version())
+
+	postings, err := idx.Postings("hello")
+	require.Nil(t, err)
+	require.Equal(t, []Posting{{DocID: second, Freq: 1, Positions: []int{0}}}, postings)
+
+	_, err = idx.Postings("world")
+	require.Equal(t, errTokenNotInIndex("world"), err)
+
+	_, ok = idx.Lookup("a")
+	require.False(t, ok)
+	require.Nil(t, idx.Fields(first))
+	require.Equal(t, 1, idx.DocCount())
+	require.Equal(t, 2, idx.SumTotalTermFreq())
+	require.Equal(t, 1, idx.TotalTermFreq("hello"))
+
+	require.Equal(t, errDocNotInIndex(first), idx.Delete(first))
+}
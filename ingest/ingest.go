@@ -1,33 +1,70 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
+var (
+	addr      = flag.String("addr", "http://localhost:5001", "address of the service")
+	bulk      = flag.Bool("bulk", false, "send files in bulk requests")
+	bulkDocs  = flag.Int("bulk-docs", 500, "maximum number of files per bulk request")
+	bulkBytes = flag.Int("bulk-bytes", 10<<20, "maximum size in bytes of a bulk request")
+)
+
 // Ingest accepts an arbitrary number of arguments with relative paths to corpuses.
 // All provided directories are crawled and all documents are indexed.
+//
+// With -bulk, files are sent in batches of at most -bulk-docs files and
+// -bulk-bytes bytes instead of one request per file.
 func main() {
-	// First arg is always the program name.
-	if len(os.Args) == 1 {
+	flag.Parse()
+	if flag.NArg() == 0 {
 		log.Fatal("no corpuses provided")
 	}
 
-	corpusDirs := os.Args[1:]
-	n := 0
+	var b *bulker
+	if *bulk {
+		b = &bulker{
+			maxDocs:  *bulkDocs,
+			maxBytes: *bulkBytes,
+		}
+	}
+
+	corpusDirs := flag.Args()
+	n, failed := 0, 0
 	for i, src := range corpusDirs {
 		log.Printf("Processing %s (%d/%d)...", src, i+1, len(corpusDirs))
 		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
 			if info.IsDir() {
 				return nil
 			}
-			log.Printf("%s", path)
-			if err := ingestFile(path); err != nil {
-				return fmt.Errorf("ingest file: %w", err)
+			id, err := filepath.Rel(src, path)
+			if err != nil {
+				return fmt.Errorf("rel: %w", err)
+			}
+			id = filepath.ToSlash(id)
+
+			if b != nil {
+				if err := b.add(path, id, info); err != nil {
+					return fmt.Errorf("bulk add: %w", err)
+				}
+			} else if err := ingestFile(path, id, info); err != nil {
+				log.Printf("ingest %s: %v", id, err)
+				failed++
 			}
 
 			n++
@@ -39,31 +76,205 @@ func main() {
 		}
 		log.Printf("Done processing %s.", src)
 	}
-	log.Printf("Ingested %d files", n)
+	if b != nil {
+		if err := b.flush(); err != nil {
+			log.Fatalf("bulk flush: %v", err)
+		}
+		failed += b.failed
+	}
+	log.Printf("Ingested %d files, %d failed", n-failed, failed)
+}
+
+// fileFields returns the document fields of a file: its name and
+// modification time, so that search results can be sorted by them, and its
+// size. HTML and Markdown files get their title from their contents
+// instead of their name.
+func fileFields(info os.FileInfo, contentType string) map[string][]string {
+	fields := map[string][]string{
+		"modified": {info.ModTime().UTC().Format(time.RFC3339)},
+		"size":     {strconv.FormatInt(info.Size(), 10)},
+	}
+	if !hasTitle(contentType) {
+		fields["title"] = []string{strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))}
+	}
+	return fields
+}
+
+// fileContentType returns the content type of a file, by its extension or
+// else by the first bytes of its contents.
+func fileContentType(path string, head []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		return "text/markdown; charset=utf-8"
+	}
+	if t := mime.TypeByExtension(filepath.Ext(path)); t != "" {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+// hasTitle returns if the service extracts the title of documents with the
+// content type.
+func hasTitle(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml" || mediaType == "text/markdown"
 }
 
-func ingestFile(src string) error {
+// ingestFile posts a single file to the service, using its path relative
+// to the corpus directory as external ID so re-ingesting a corpus updates
+// existing documents instead of duplicating them.
+func ingestFile(src, id string, info os.FileInfo) error {
 	file, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("open: %w", err)
 	}
 	defer file.Close()
 
-	req, err := http.NewRequest("POST", "http://localhost:5001/doc", file)
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("read: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	contentType := fileContentType(src, head[:n])
+
+	params := url.Values{}
+	params.Set("id", id)
+	for name, values := range fileFields(info, contentType) {
+		params["field."+name] = values
+	}
+
+	req, err := http.NewRequest("POST", *addr+"/doc?"+params.Encode(), file)
 	if err != nil {
-		log.Printf("new request: %v", err)
+		return fmt.Errorf("new request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Type", contentType)
 
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		log.Printf("do req: %v", err)
+		return fmt.Errorf("do req: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed with status: %d", res.StatusCode)
+	}
+
+	var body struct {
+		ID     int    `json:"id"`
+		Result string `json:"result"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	log.Printf("%s -> %d (%s)", id, body.ID, body.Result)
+	return nil
+}
+
+// bulker collects files into bulk requests, sending a request once it holds
+// maxDocs files or adding a file would make it larger than maxBytes. failed
+// counts the files the service failed to index.
+type bulker struct {
+	maxDocs  int
+	maxBytes int
+
+	buf    bytes.Buffer
+	n      int
+	failed int
+}
+
+// bulkAction is one line of a bulk request. The source is sent base64
+// encoded, so files that aren't valid UTF-8 are indexed as they are.
+type bulkAction struct {
+	Action      string              `json:"action"`
+	ID          string              `json:"id"`
+	Source      []byte              `json:"source_base64"`
+	Fields      map[string][]string `json:"fields"`
+	ContentType string              `json:"content_type"`
+}
+
+// add adds the file to the current bulk request.
+func (b *bulker) add(src, id string, info os.FileInfo) error {
+	source, err := ioutil.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("read file: %w", err)
+	}
+
+	contentType := fileContentType(src, source)
+	line, err := json.Marshal(bulkAction{
+		Action:      "index",
+		ID:          id,
+		Source:      source,
+		Fields:      fileFields(info, contentType),
+		ContentType: contentType,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	if b.n > 0 && b.buf.Len()+len(line)+1 > b.maxBytes {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	b.buf.Write(line)
+	b.buf.WriteByte('\n')
+	b.n++
+
+	if b.n >= b.maxDocs {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush sends the current bulk request, if any.
+func (b *bulker) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	defer func() {
+		b.buf.Reset()
+		b.n = 0
+	}()
+
+	client := &http.Client{
+		Timeout: 5 * time.Minute,
+	}
+	res, err := client.Post(*addr+"/bulk", "application/x-ndjson", &b.buf)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		log.Printf("failed with status: %d", res.StatusCode)
+		return fmt.Errorf("failed with status: %d", res.StatusCode)
+	}
+
+	var body struct {
+		Items []struct {
+			ExternalID string `json:"external_id"`
+			Status     int    `json:"status"`
+			Error      string `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+
+	failed := 0
+	for _, item := range body.Items {
+		if item.Error != "" {
+			log.Printf("%s failed with status %d: %s", item.ExternalID, item.Status, item.Error)
+			failed++
+		}
 	}
+	log.Printf("Sent %d files, %d failed", b.n, failed)
+	b.failed += failed
 	return nil
 }
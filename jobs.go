@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// Job is a unit of work run in the background by a job queue. Result holds
+// the result of a job that is done and Error the reason a job failed.
+type Job struct {
+	ID       int         `json:"id"`
+	Status   string      `json:"status"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Queued   time.Time   `json:"queued"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// JobFunc is the work of a job.
+type JobFunc func() (interface{}, error)
+
+var errQueueFull = errors.New("job queue full")
+
+var errQueueClosed = errors.New("job queue closed")
+
+var errJobNotFound = func(id int) error { return fmt.Errorf("job %d %w", id, errNotFound) }
+
+// jobQueue runs jobs on a fixed number of workers. Jobs wait in a queue of
+// bounded size until a worker is free, and submitting a job to a full queue
+// fails.
+//
+// Finished jobs are kept so their status can be looked up, up to a limit
+// after which the oldest ones are forgotten.
+type jobQueue struct {
+	mu       sync.Mutex
+	jobs     map[int]*Job
+	finished []int
+	nextID   int
+
+	maxFinished int
+	queue       chan queuedJob
+	closed      bool
+	workers     sync.WaitGroup
+}
+
+type queuedJob struct {
+	job *Job
+	fn  JobFunc
+}
+
+// newJobQueue starts a job queue with the given number of workers, holding
+// at most size waiting jobs and remembering at most maxFinished finished
+// ones.
+func newJobQueue(workers, size, maxFinished int) *jobQueue {
+	q := &jobQueue{
+		jobs:        make(map[int]*Job),
+		maxFinished: maxFinished,
+		queue:       make(chan queuedJob, size),
+	}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Submit queues a job. It returns errQueueFull if the queue is full.
+func (q *jobQueue) Submit(fn JobFunc) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return Job{}, errQueueClosed
+	}
+
+	job := &Job{
+		ID:     q.nextID,
+		Status: jobQueued,
+		Queued: time.Now().UTC(),
+	}
+
+	select {
+	case q.queue <- queuedJob{job: job, fn: fn}:
+	default:
+		return Job{}, errQueueFull
+	}
+
+	q.nextID++
+	q.jobs[job.ID] = job
+	return *job, nil
+}
+
+// Get returns the job with the given ID.
+func (q *jobQueue) Get(id int) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound(id)
+	}
+	return *job, nil
+}
+
+// Close stops the workers once the queued jobs are done, and waits for
+// them. Jobs can't be submitted after the queue is closed.
+func (q *jobQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+
+	q.workers.Wait()
+}
+
+func (q *jobQueue) work() {
+	defer q.workers.Done()
+
+	for qj := range q.queue {
+		q.mu.Lock()
+		started := time.Now().UTC()
+		qj.job.Status = jobRunning
+		qj.job.Started = &started
+		q.mu.Unlock()
+
+		res, err := qj.fn()
+
+		q.mu.Lock()
+		finished := time.Now().UTC()
+		qj.job.Finished = &finished
+		if err != nil {
+			qj.job.Status = jobFailed
+			qj.job.Error = err.Error()
+		} else {
+			qj.job.Status = jobDone
+			qj.job.Result = res
+		}
+		q.finish(qj.job.ID)
+		q.mu.Unlock()
+	}
+}
+
+// finish records a job as finished, forgetting the oldest finished job if
+// there are too many. The caller must hold the lock.
+func (q *jobQueue) finish(id int) {
+	q.finished = append(q.finished, id)
+	if len(q.finished) > q.maxFinished {
+		delete(q.jobs, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitForJob polls the queue until the job with the given ID has finished.
+func waitForJob(t *testing.T, q *jobQueue, id int) Job {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		job, err := q.Get(id)
+		require.Nil(t, err)
+		if job.Status == jobDone || job.Status == jobFailed {
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %d didn't finish", id)
+	return Job{}
+}
+
+func TestJobQueue(t *testing.T) {
+	q := newJobQueue(1, 1, 2)
+
+	done, err := q.Submit(func() (interface{}, error) { return 1, nil })
+	require.Nil(t, err)
+	require.Equal(t, jobQueued, done.Status)
+	job := waitForJob(t, q, done.ID)
+	require.Equal(t, jobDone, job.Status)
+	require.Equal(t, 1, job.Result)
+	require.NotNil(t, job.Started)
+	require.NotNil(t, job.Finished)
+
+	failed, err := q.Submit(func() (interface{}, error) { return nil, errors.New("oops") })
+	require.Nil(t, err)
+	job = waitForJob(t, q, failed.ID)
+	require.Equal(t, jobFailed, job.Status)
+	require.Equal(t, "oops", job.Error)
+
+	// Block the worker and fill the queue.
+	release := make(chan struct{})
+	running, err := q.Submit(func() (interface{}, error) { <-release; return nil, nil })
+	require.Nil(t, err)
+	for {
+		job, err := q.Get(running.ID)
+		require.Nil(t, err)
+		if job.Status == jobRunning {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	waiting, err := q.Submit(func() (interface{}, error) { return nil, nil })
+	require.Nil(t, err)
+	_, err = q.Submit(func() (interface{}, error) { return nil, nil })
+	require.Equal(t, errQueueFull, err)
+
+	close(release)
+	waitForJob(t, q, running.ID)
+	waitForJob(t, q, waiting.ID)
+
+	// Only the two most recently finished jobs are kept.
+	_, err = q.Get(done.ID)
+	require.Equal(t, errJobNotFound(done.ID), err)
+	_, err = q.Get(failed.ID)
+	require.Equal(t, errJobNotFound(failed.ID), err)
+}
+
+func TestJobQueueClose(t *testing.T) {
+	q := newJobQueue(1, 1, 1)
+	release := make(chan struct{})
+	job, err := q.Submit(func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	require.Nil(t, err)
+
+	// Close waits for the running job.
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	require.Eventually(t, func() bool {
+		_, err := q.Submit(func() (interface{}, error) { return nil, nil })
+		return err == errQueueClosed
+	}, time.Second, time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("closed with a job running")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	<-closed
+	job, err = q.Get(job.ID)
+	require.Nil(t, err)
+	require.Equal(t, jobDone, job.Status)
+}
@@ -1,18 +1,118 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		if err := runEval(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("eval: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "coordinator" {
+		if err := runCoordinator(os.Args[2:]); err != nil {
+			log.Fatalf("coordinator: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestore(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("restore: %v", err)
+		}
+		return
+	}
+
+	addr := flag.String("addr", ":5001", "address to listen on")
+	walPath := flag.String("wal", "./wal", "write-ahead log, replayed on startup")
+	fsync := flag.String("fsync", "always", "when to sync the write-ahead log to disk: always, interval or never")
+	fsyncInterval := flag.Duration("fsync-interval", time.Second, "how often to sync the write-ahead log with -fsync interval")
+	compactInterval := flag.Duration("compact-interval", 10*time.Minute, "how often to check whether to compact the write-ahead log, 0 for only on request")
+	storeType := flag.String("store", "files", "document store: files for a file per document, packed for compressed pack files")
+	dedup := flag.Bool("dedup", true, "store identical documents once")
+	shards := flag.Int("shards", 1, "number of shards the index is split into")
+	indexesPath := flag.String("indexes", "./indexes", "directory of the named indexes")
+	snapshotsPath := flag.String("snapshots", "./snapshots", "snapshot repository")
+	maxDocSize := flag.Int64("max-doc-size", 1<<30, "largest document accepted in bytes, 0 for no limit")
+	refreshInterval := flag.Duration("refresh-interval", time.Second, "how often indexed documents are made searchable, 0 for at once")
+	replicas := flag.String("replicas", "", "comma-separated base URLs of the other replicas of the index, to replicate it")
+	self := flag.String("self", "", "base URL the other replicas reach this node at, like http://localhost:5001")
+	primary := flag.Bool("primary", false, "start as the primary of a new replica set")
+	heartbeat := flag.Duration("heartbeat", time.Second, "how often the primary contacts followers with nothing to replicate")
+	flag.Parse()
+
+	policy, err := parseSyncPolicy(*fsync)
+	if err != nil {
+		log.Fatalf("parse sync policy: %v", err)
+	}
+	wal, err := openWAL(*walPath, policy, *fsyncInterval)
+	if err != nil {
+		log.Fatalf("open wal: %v", err)
+	}
+	defer wal.Close()
+
+	snapshots, err := newSnapshotRepo(*snapshotsPath)
+	if err != nil {
+		log.Fatalf("open snapshot repository: %v", err)
+	}
+
+	if err := validateShards(*shards); err != nil {
+		log.Fatal(err)
+	}
 	idx := NewIndex()
+	if *shards > 1 {
+		idx = NewShardedIndex(*shards)
+	}
 	querier := NewQuerier(idx)
-	store, err := NewStore("./store")
+	store, err := openStore(*storeType, "./store", *dedup)
 	if err != nil {
-		log.Fatalf("new store: %v", err)
+		log.Fatalf("open store: %v", err)
+	}
+
+	collections, err := openCollections(*indexesPath, collectionsConfig{
+		policy:          policy,
+		syncInterval:    *fsyncInterval,
+		refreshInterval: *refreshInterval,
+		compactInterval: *compactInterval,
+		maxDocSize:      *maxDocSize,
+		dedup:           *dedup,
+	})
+	if err != nil {
+		log.Fatalf("open collections: %v", err)
+	}
+	defer collections.Close()
+
+	cfg := Config{
+		Addr:            *addr,
+		WAL:             wal,
+		CompactInterval: *compactInterval,
+		RefreshInterval: *refreshInterval,
+		Snapshots:       snapshots,
+		MaxDocSize:      *maxDocSize,
+		Collections:     collections,
+	}
+	if *replicas != "" {
+		if *self == "" {
+			log.Fatal("-self is required with -replicas")
+		}
+		var peers []string
+		for _, peer := range strings.Split(*replicas, ",") {
+			peers = append(peers, strings.TrimSuffix(strings.TrimSpace(peer), "/"))
+		}
+		cfg.Replication = &ReplicationConfig{
+			Self:      strings.TrimSuffix(*self, "/"),
+			Peers:     peers,
+			Primary:   *primary,
+			Heartbeat: *heartbeat,
+		}
 	}
 
-	s := NewService(idx, querier, store)
+	s := NewService(idx, querier, store, cfg)
 	if err := s.Start(); err != nil {
 		log.Fatal(err)
 	}
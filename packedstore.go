@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	// defaultBlockSize is the uncompressed size at which a block is
+	// compressed and written, and defaultPackSize the size at which a new
+	// pack file is started.
+	defaultBlockSize = 64 << 10
+	defaultPackSize  = 256 << 20
+
+	// blockCacheSize is the number of decompressed blocks kept in memory.
+	blockCacheSize = 64
+
+	// blockHeaderSize is the size of the header of a block, its compressed
+	// length as big endian uint64.
+	blockHeaderSize = 8
+)
+
+// packedStore stores documents in blocks of several documents, compressed
+// with DEFLATE and appended to a few large pack files instead of a file per
+// document. An in-memory offset index maps every document to its block and
+// its position within it.
+//
+// Documents are buffered until their block is full, and served from the
+// buffer until then. Documents larger than a block are streamed to a block
+// of their own instead, so they're never held in memory while stored or
+// read. Their blocks go to pack files of their own, so they're compressed
+// without holding the lock of the store. Deleted documents are only dropped
+// from the offset index, their space is reclaimed when the store is rebuilt
+// on startup.
+type packedStore struct {
+	mu   sync.RWMutex
+	root string
+
+	blockSize int
+	packSize  int64
+
+	docs   map[int]packedDoc
+	blocks []blockRef
+	packs  []*os.File
+	// pack is the pack file blocks are appended to, and size its size.
+	pack int
+	size int64
+
+	// large is the pack file large documents are appended to, or -1 before
+	// the first one, and largeSize its size. Both are guarded by largeMu,
+	// which is held while a large document is stored.
+	largeMu   sync.Mutex
+	large     int
+	largeSize int64
+
+	// open holds the documents of the block not yet written, which will
+	// get the index len(blocks).
+	open bytes.Buffer
+
+	cache *lruCache
+}
+
+// packedDoc is the position of a document in the store.
+type packedDoc struct {
+	block  int
+	offset int
+	length int
+}
+
+// blockRef is the position of a compressed block in the pack files. A block
+// is stored as its header followed by the compressed data. Blocks holding a
+// single large document aren't cached when they're read.
+type blockRef struct {
+	pack   int
+	offset int64
+	length int64
+	large  bool
+}
+
+// NewPackedStore returns a packed store in the given directory. Like
+// NewStore, it starts out empty.
+func NewPackedStore(root string) (Store, error) {
+	return newPackedStore(root, defaultBlockSize, defaultPackSize)
+}
+
+func newPackedStore(root string, blockSize int, packSize int64) (*packedStore, error) {
+	if err := os.RemoveAll(root); err != nil {
+		return nil, fmt.Errorf("remove root: %w", err)
+	}
+	if err := os.Mkdir(root, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	s := &packedStore{
+		root:      root,
+		blockSize: blockSize,
+		packSize:  packSize,
+		docs:      make(map[int]packedDoc),
+		large:     -1,
+		cache:     newLRUCache(blockCacheSize),
+	}
+	if err := s.newPack(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newPack starts a new pack file for blocks. The caller must hold the write
+// lock.
+func (s *packedStore) newPack() error {
+	pack, err := s.createPack()
+	if err != nil {
+		return err
+	}
+	s.pack = pack
+	s.size = 0
+	return nil
+}
+
+// createPack creates a pack file and returns its index. The caller must
+// hold the write lock.
+func (s *packedStore) createPack() (int, error) {
+	path := filepath.Join(s.root, fmt.Sprintf("pack-%06d", len(s.packs)))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("create pack: %w", err)
+	}
+	s.packs = append(s.packs, file)
+	return len(s.packs) - 1, nil
+}
+
+func (s *packedStore) Get(id int) ([]byte, error) {
+	s.mu.RLock()
+	d, ok := s.docs[id]
+	if !ok {
+		s.mu.RUnlock()
+		return nil, errDocNotInStore(id)
+	}
+	if d.block == len(s.blocks) {
+		out := make([]byte, d.length)
+		copy(out, s.open.Bytes()[d.offset:])
+		s.mu.RUnlock()
+		return out, nil
+	}
+	ref := s.blocks[d.block]
+	pack := s.packs[ref.pack]
+	s.mu.RUnlock()
+
+	block, err := s.readBlock(d.block, pack, ref)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, d.length)
+	copy(out, block[d.offset:])
+	return out, nil
+}
+
+// readBlock reads and decompresses a block, through the block cache.
+func (s *packedStore) readBlock(i int, pack *os.File, ref blockRef) ([]byte, error) {
+	key := strconv.Itoa(i)
+	if v, ok := s.cache.Get(key, 0); ok {
+		return v.([]byte), nil
+	}
+
+	block, err := ioutil.ReadAll(flate.NewReader(ref.section(pack)))
+	if err != nil {
+		return nil, fmt.Errorf("decompress block: %w", err)
+	}
+
+	if !ref.large {
+		s.cache.Put(key, 0, block)
+	}
+	return block, nil
+}
+
+// section returns the compressed data of the block.
+func (ref blockRef) section(pack *os.File) *io.SectionReader {
+	return io.NewSectionReader(pack, ref.offset+blockHeaderSize, ref.length)
+}
+
+// Open opens the document with the given ID for reading. Large documents
+// are decompressed as they're read.
+func (s *packedStore) Open(id int) (io.ReadSeekCloser, error) {
+	s.mu.RLock()
+	d, ok := s.docs[id]
+	if ok && d.block < len(s.blocks) && s.blocks[d.block].large {
+		ref := s.blocks[d.block]
+		pack := s.packs[ref.pack]
+		s.mu.RUnlock()
+		return newBlockReader(ref.section(pack), int64(d.length)), nil
+	}
+	s.mu.RUnlock()
+
+	b, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+// blockReader reads a block as it's decompressed. Seeking backwards starts
+// over from the start of the block, seeking forwards skips ahead.
+type blockReader struct {
+	compressed *io.SectionReader
+	r          io.ReadCloser
+	size       int64
+	// pos is the position of r and offset the one seeked to.
+	pos    int64
+	offset int64
+}
+
+func newBlockReader(compressed *io.SectionReader, size int64) *blockReader {
+	return &blockReader{
+		compressed: compressed,
+		r:          flate.NewReader(compressed),
+		size:       size,
+	}
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	if b.offset != b.pos {
+		if err := b.skip(); err != nil {
+			return 0, err
+		}
+	}
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	b.pos += int64(n)
+	b.offset = b.pos
+	return n, err
+}
+
+// skip moves r to the offset seeked to, or the end of the block if that's
+// past it.
+func (b *blockReader) skip() error {
+	if b.offset < b.pos {
+		if _, err := b.compressed.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := b.r.(flate.Resetter).Reset(b.compressed, nil); err != nil {
+			return err
+		}
+		b.pos = 0
+	}
+	target := b.offset
+	if target > b.size {
+		target = b.size
+	}
+	n, err := io.CopyN(ioutil.Discard, b.r, target-b.pos)
+	b.pos += n
+	if err != nil {
+		return fmt.Errorf("decompress block: %w", err)
+	}
+	return nil
+}
+
+func (b *blockReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative offset %d", offset)
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *blockReader) Close() error {
+	return b.r.Close()
+}
+
+// nopCloser is a ReadSeeker with a Close method that does nothing.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (s *packedStore) PutFromStream(r io.Reader, id int) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r, int64(s.blockSize)+1))
+	if err != nil {
+		return fmt.Errorf("read all: %w", err)
+	}
+
+	if len(b) > s.blockSize {
+		return s.putLarge(io.MultiReader(bytes.NewReader(b), r), id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.docs[id] = packedDoc{
+		block:  len(s.blocks),
+		offset: s.open.Len(),
+		length: len(b),
+	}
+	s.open.Write(b)
+
+	if s.open.Len() >= s.blockSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush compresses the open block and appends it to the last pack file. The
+// caller must hold the write lock.
+func (s *packedStore) flush() error {
+	if s.size >= s.packSize {
+		if err := s.newPack(); err != nil {
+			return err
+		}
+	}
+
+	length, _, err := writeBlock(s.packs[s.pack], s.size, bytes.NewReader(s.open.Bytes()))
+	if err != nil {
+		return err
+	}
+	s.blocks = append(s.blocks, blockRef{
+		pack:   s.pack,
+		offset: s.size,
+		length: length,
+	})
+	s.size += blockHeaderSize + length
+	s.open.Reset()
+	return nil
+}
+
+// putLarge stores a document larger than a block in a block of its own.
+// The block is reserved after the open block with the write lock held, and
+// the document compressed into it without.
+func (s *packedStore) putLarge(r io.Reader, id int) error {
+	s.largeMu.Lock()
+	defer s.largeMu.Unlock()
+
+	s.mu.Lock()
+	if s.open.Len() != 0 {
+		if err := s.flush(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	if s.large == -1 || s.largeSize >= s.packSize {
+		pack, err := s.createPack()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.large = pack
+		s.largeSize = 0
+	}
+	block := len(s.blocks)
+	s.blocks = append(s.blocks, blockRef{
+		pack:   s.large,
+		offset: s.largeSize,
+		large:  true,
+	})
+	pack := s.packs[s.large]
+	s.mu.Unlock()
+
+	// Nothing refers to the block until the document is added, so it's
+	// left empty if compressing fails.
+	length, n, err := writeBlock(pack, s.largeSize, r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocks[block].length = length
+	s.largeSize += blockHeaderSize + length
+	s.docs[id] = packedDoc{
+		block:  block,
+		length: int(n),
+	}
+	return nil
+}
+
+// writeBlock compresses the data from the reader to a block at the given
+// offset of the pack file. It returns the compressed and the uncompressed
+// size.
+func writeBlock(pack *os.File, offset int64, r io.Reader) (int64, int64, error) {
+	cw := &packWriter{file: pack, offset: offset + blockHeaderSize}
+	w, err := flate.NewWriter(cw, flate.DefaultCompression)
+	if err != nil {
+		return 0, 0, fmt.Errorf("new writer: %w", err)
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return 0, 0, fmt.Errorf("compress: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, 0, fmt.Errorf("compress: %w", err)
+	}
+
+	var header [blockHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(cw.n))
+	if _, err := pack.WriteAt(header[:], offset); err != nil {
+		return 0, 0, fmt.Errorf("write block: %w", err)
+	}
+	return cw.n, n, nil
+}
+
+// packWriter writes to a pack file from the given offset on, and counts the
+// bytes written.
+type packWriter struct {
+	file   *os.File
+	offset int64
+	n      int64
+}
+
+func (w *packWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset+w.n)
+	w.n += int64(n)
+	return n, err
+}
+
+// Delete removes the document with the given ID.
+func (s *packedStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.docs[id]; !ok {
+		return errDocNotInStore(id)
+	}
+	delete(s.docs, id)
+	return nil
+}
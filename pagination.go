@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const (
+	// defaultPageSize is the number of hits returned when no size is given.
+	defaultPageSize = 10
+
+	// maxResultWindow is the maximum value of from+size. Deeper pages must
+	// be fetched with a cursor.
+	maxResultWindow = 10000
+)
+
+// cursor points at the last hit of a page by its sort values and document
+// ID. It is handed to clients as an opaque string and used to continue the
+// search after that hit.
+type cursor struct {
+	Values []DocValue `json:"v"`
+	DocID  int        `json:"d"`
+}
+
+// String encodes the cursor into its opaque representation.
+func (c cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseCursor decodes a cursor from its opaque representation.
+func parseCursor(s string) (cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, fmt.Errorf("decode: %w", err)
+	}
+
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return cursor{}, fmt.Errorf("unmarshal: %w", err)
+	}
+	return c, nil
+}
+
+// page returns the window of hits starting at offset from, holding at most
+// size hits. If after is given, the window starts after the hit the cursor
+// points at instead. The hits must be sorted by the fields.
+func page(hits []Hit, from, size int, after *cursor, fields []sortField) []Hit {
+	start := from
+	if after != nil {
+		c := Hit{DocID: after.DocID, Sort: after.Values}
+		start = sort.Search(len(hits), func(i int) bool {
+			return compareHits(fields, c, hits[i]) < 0
+		})
+	}
+
+	if start > len(hits) {
+		start = len(hits)
+	}
+	end := min(start+size, len(hits))
+	return hits[start:end]
+}
+
+// mergePages merges pages of hits from separate searches, each holding the
+// hits up to from+size, by descending score and returns the page at from.
+// Documents with equal scores keep the order of the pages.
+func mergePages(pages []GetResponseBody, from, size int) GetResponseBody {
+	res := GetResponseBody{
+		Documents: []Document{},
+	}
+	for _, p := range pages {
+		res.Hits += p.Hits
+		res.Documents = append(res.Documents, p.Documents...)
+	}
+	sort.SliceStable(res.Documents, func(i, j int) bool {
+		return res.Documents[i].Score > res.Documents[j].Score
+	})
+
+	if from > len(res.Documents) {
+		from = len(res.Documents)
+	}
+	res.Documents = res.Documents[from:]
+	if len(res.Documents) > size {
+		res.Documents = res.Documents[:size]
+	}
+	return res
+}
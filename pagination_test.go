@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	c := cursor{
+		Values: []DocValue{
+			{Kind: kindNumber, Num: 1.5},
+			{Kind: kindString, Str: "x"},
+		},
+		DocID: 10,
+	}
+
+	res, err := parseCursor(c.String())
+	require.Nil(t, err)
+	require.Equal(t, c, res)
+
+	_, err = parseCursor("not a cursor")
+	require.NotNil(t, err)
+}
+
+func TestPage(t *testing.T) {
+	score := func(s float64) []DocValue {
+		return []DocValue{{Kind: kindNumber, Num: s}}
+	}
+	hits := []Hit{
+		{DocID: 4, Score: 3, Sort: score(3)},
+		{DocID: 1, Score: 2, Sort: score(2)},
+		{DocID: 2, Score: 2, Sort: score(2)},
+		{DocID: 0, Score: 1, Sort: score(1)},
+	}
+
+	tests := []struct {
+		name  string
+		from  int
+		size  int
+		after *cursor
+		res   []Hit
+	}{
+		{
+			name: "first page",
+			size: 2,
+			res:  hits[:2],
+		},
+		{
+			name: "offset",
+			from: 1,
+			size: 2,
+			res:  hits[1:3],
+		},
+		{
+			name: "offset beyond hits",
+			from: 10,
+			size: 2,
+			res:  []Hit{},
+		},
+		{
+			name:  "after cursor",
+			size:  2,
+			after: &cursor{Values: score(2), DocID: 1},
+			res:   hits[2:4],
+		},
+		{
+			name:  "after last hit",
+			size:  2,
+			after: &cursor{Values: score(1), DocID: 0},
+			res:   []Hit{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := page(hits, tt.from, tt.size, tt.after, defaultSort)
+			require.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{query: "from=10&size=20", ok: true},
+		{query: "from=0&size=10000", ok: true},
+		{query: "from=1&size=10000"},
+		{query: "from=1&size=9223372036854775807"},
+		{query: "from=9223372036854775807&size=1"},
+		{query: "size=-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, _, _, err := pageParams(httptest.NewRequest("GET", "/search/union?"+tt.query, nil))
+			require.Equal(t, tt.ok, err == nil, err)
+		})
+	}
+}
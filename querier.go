@@ -8,6 +8,9 @@ import (
 type Querier interface {
 	Intersection(tokens ...string) ([]Posting, error)
 	Phrase(phrase string) ([]Posting, error)
+	Union(tokens ...string) ([]Posting, error)
+	Rank(postings []Posting, terms ...QueryTerm) ([]Hit, error)
+	Explain(postings []Posting, id int, terms ...QueryTerm) (Explanation, error)
 }
 
 type querier struct {
@@ -16,7 +19,18 @@ type querier struct {
 	intersectionFn func(a, b []Posting) []Posting
 }
 
+// NewQuerier returns a querier for the index. Queries against a sharded
+// index are run in all shards in parallel, see shardedQuerier.
 func NewQuerier(idx Index) Querier {
+	if sharded, ok := idx.(*shardedIndex); ok {
+		return newShardedQuerier(sharded)
+	}
+	return newQuerier(idx)
+}
+
+// newQuerier returns a querier running queries against the index as one
+// index.
+func newQuerier(idx Index) *querier {
 	return &querier{
 		idx: idx,
 
@@ -104,6 +118,49 @@ func intersection(a, b []Posting) []Posting {
 	return res
 }
 
+// Union fetches the postings lists for all given tokens and returns the
+// document ID's present in any of the lists. Tokens not in the index are
+// ignored.
+func (q *querier) Union(tokens ...string) ([]Posting, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens provided")
+	}
+
+	var res []Posting
+	for _, t := range tokens {
+		postings, err := q.idx.Postings(t)
+		if err != nil {
+			continue
+		}
+		res = union(res, postings)
+	}
+	return res, nil
+}
+
+// union returns the document ID's present in any of the two given postings
+// lists. Frequencies of documents present in both lists are summed.
+func union(a, b []Posting) []Posting {
+	res := make([]Posting, 0, max(len(a), len(b)))
+
+	i := 0
+	j := 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || i < len(a) && a[i].DocID < b[j].DocID:
+			res = append(res, Posting{DocID: a[i].DocID, Freq: a[i].Freq})
+			i++
+		case i == len(a) || b[j].DocID < a[i].DocID:
+			res = append(res, Posting{DocID: b[j].DocID, Freq: b[j].Freq})
+			j++
+		default:
+			res = append(res, Posting{DocID: a[i].DocID, Freq: a[i].Freq + b[j].Freq})
+			i++
+			j++
+		}
+	}
+	return res
+}
+
 // Phrase search for an exact phrase and returns all matching documents.
 func (q *querier) Phrase(phrase string) ([]Posting, error) {
 	tokens := strings.Split(phrase, " ")
@@ -215,3 +215,50 @@ func TestPrivatePhrase(t *testing.T) {
 		})
 	}
 }
+
+func TestPrivateUnion(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []Posting
+		res  []Posting
+	}{
+		{
+			name: "both empty",
+			res:  []Posting{},
+		},
+		{
+			name: "a empty",
+			b:    []Posting{{DocID: 1, Freq: 1}},
+			res:  []Posting{{DocID: 1, Freq: 1}},
+		},
+		{
+			name: "ok",
+			a:    []Posting{{DocID: 0, Freq: 1}, {DocID: 2, Freq: 2}, {DocID: 5, Freq: 1}},
+			b:    []Posting{{DocID: 1, Freq: 1}, {DocID: 2, Freq: 1}},
+			res:  []Posting{{DocID: 0, Freq: 1}, {DocID: 1, Freq: 1}, {DocID: 2, Freq: 3}, {DocID: 5, Freq: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := union(tt.a, tt.b)
+			require.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestUnion(t *testing.T) {
+	idx := NewIndex().(*index)
+	idx.dict = map[string][]Posting{
+		"x": {{DocID: 0, Freq: 1}},
+		"y": {{DocID: 1, Freq: 1}},
+	}
+	q := NewQuerier(idx)
+
+	res, err := q.Union("x", "y", "z")
+	require.Nil(t, err)
+	require.Equal(t, []Posting{{DocID: 0, Freq: 1}, {DocID: 1, Freq: 1}}, res)
+
+	_, err = q.Union()
+	require.Equal(t, fmt.Errorf("no tokens provided"), err)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// QueryTerm is a token of a query. The boost multiplies the weight of the
+// term when scoring documents.
+type QueryTerm struct {
+	Token string  `json:"token"`
+	Boost float64 `json:"boost"`
+}
+
+// parseTerms splits a query into terms. A term can be boosted by suffixing
+// it with ^ and a number, e.g. "hello^2 world". Terms are lowercased like the
+// tokens in the index.
+func parseTerms(query string) ([]QueryTerm, error) {
+	var out []QueryTerm
+	for _, f := range strings.Fields(strings.ToLower(query)) {
+		t := QueryTerm{Token: f, Boost: 1}
+		if i := strings.LastIndex(f, "^"); i > 0 {
+			boost, err := strconv.ParseFloat(f[i+1:], 64)
+			if err != nil || boost <= 0 {
+				return nil, fmt.Errorf("invalid boost in '%s'", f)
+			}
+			t.Token = f[:i]
+			t.Boost = boost
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// parsePhrase splits a phrase query into unboosted terms.
+func parsePhrase(query string) ([]QueryTerm, error) {
+	var out []QueryTerm
+	for _, f := range strings.Fields(strings.ToLower(query)) {
+		out = append(out, QueryTerm{Token: f, Boost: 1})
+	}
+	return out, nil
+}
+
+// queryKey returns the normalized form of a query of the given type, used
+// as a cache key.
+func queryKey(typ string, terms []QueryTerm) string {
+	var b strings.Builder
+	b.WriteString(typ)
+	for _, t := range terms {
+		fmt.Fprintf(&b, " %s^%g", t.Token, t.Boost)
+	}
+	return b.String()
+}
+
+// filterKey returns the normalized form of the terms matched by a query of
+// the given type. Boosts are left out since they don't affect matching.
+func filterKey(typ string, terms []QueryTerm) string {
+	return typ + " " + strings.Join(tokens(terms), " ")
+}
+
+// tokens returns the tokens of the terms.
+func tokens(terms []QueryTerm) []string {
+	out := make([]string, 0, len(terms))
+	for _, t := range terms {
+		out = append(out, t.Token)
+	}
+	return out
+}
+
+// queryType parses and matches one type of query.
+type queryType struct {
+	parse func(query string) ([]QueryTerm, error)
+	match func(terms []QueryTerm) ([]Posting, error)
+}
+
+// queryTypes returns the query types supported by the querier, by name.
+func queryTypes(q Querier) map[string]queryType {
+	return map[string]queryType{
+		"intersection": {
+			parse: parseTerms,
+			match: func(terms []QueryTerm) ([]Posting, error) {
+				postings, err := q.Intersection(tokens(terms)...)
+				if err != nil {
+					return nil, fmt.Errorf("intersection: %w", err)
+				}
+				return postings, nil
+			},
+		},
+		"phrase": {
+			parse: parsePhrase,
+			match: func(terms []QueryTerm) ([]Posting, error) {
+				postings, err := q.Phrase(strings.Join(tokens(terms), " "))
+				if err != nil {
+					return nil, fmt.Errorf("phrase: %w", err)
+				}
+				return postings, nil
+			},
+		},
+		"union": {
+			parse: parseTerms,
+			match: func(terms []QueryTerm) ([]Posting, error) {
+				postings, err := q.Union(tokens(terms)...)
+				if err != nil {
+					return nil, fmt.Errorf("union: %w", err)
+				}
+				return postings, nil
+			},
+		},
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTerms(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		res   []QueryTerm
+		err   error
+	}{
+		{
+			name:  "plain terms",
+			query: "hello  world",
+			res: []QueryTerm{
+				{Token: "hello", Boost: 1},
+				{Token: "world", Boost: 1},
+			},
+		},
+		{
+			name:  "boosted term",
+			query: "hello^2.5 world",
+			res: []QueryTerm{
+				{Token: "hello", Boost: 2.5},
+				{Token: "world", Boost: 1},
+			},
+		},
+		{
+			name:  "invalid boost",
+			query: "hello^x",
+			err:   fmt.Errorf("invalid boost in 'hello^x'"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := parseTerms(tt.query)
+			require.Equal(t, tt.err, err)
+			require.Equal(t, tt.res, res)
+		})
+	}
+}
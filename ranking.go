@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Hit is a document matching a query, together with its relevance score.
+type Hit struct {
+	DocID int
+	Score float64
+
+	// Sort holds the values the hit is sorted by.
+	Sort []DocValue
+}
+
+// Rank scores the matching documents in the postings list against the query
+// terms and returns them sorted by descending score. Documents with equal
+// scores are ordered by ascending document ID.
+//
+// The score of a document is the sum of the weights of the query terms,
+// normalized by the length of the document. The weight of a term is
+// tf * idf * boost.
+func (q *querier) Rank(postings []Posting, terms ...QueryTerm) ([]Hit, error) {
+	termPostings, err := q.termPostings(terms)
+	if err != nil {
+		return nil, err
+	}
+
+	dfs := make([]int, len(termPostings))
+	for i, tp := range termPostings {
+		dfs[i] = len(tp)
+	}
+
+	hits := q.score(postings, terms, termPostings, q.idx.DocCount(), dfs)
+	sortHits(hits)
+	return hits, nil
+}
+
+// score scores the documents in the postings list, with the idf of the
+// terms computed from the document frequencies dfs in n documents. The
+// statistics are passed in, so a shard can score its documents with the
+// statistics of the whole index.
+func (q *querier) score(postings []Posting, terms []QueryTerm, termPostings [][]Posting, n int, dfs []int) []Hit {
+	hits := make([]Hit, 0, len(postings))
+	for _, p := range postings {
+		var score float64
+		for i, tp := range termPostings {
+			score += tf(freq(tp, p.DocID)) * idf(n, dfs[i]) * terms[i].Boost
+		}
+		score *= lengthNorm(q.idx.DocLength(p.DocID))
+
+		hits = append(hits, Hit{
+			DocID: p.DocID,
+			Score: score,
+		})
+	}
+	return hits
+}
+
+// termPostings fetches the postings lists of the terms. Terms not in the
+// index get an empty postings list.
+func (q *querier) termPostings(terms []QueryTerm) ([][]Posting, error) {
+	out := make([][]Posting, 0, len(terms))
+	for _, t := range terms {
+		if q.idx.DocFreq(t.Token) == 0 {
+			out = append(out, nil)
+			continue
+		}
+		p, err := q.idx.Postings(t.Token)
+		if err != nil {
+			return nil, fmt.Errorf("postings: %w", err)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// sortHits sorts hits by descending score and ascending document ID.
+func sortHits(hits []Hit) {
+	sort.Slice(hits, func(i, j int) bool {
+		return hitLess(hits[i], hits[j])
+	})
+}
+
+// hitLess reports whether a should be ranked before b.
+func hitLess(a, b Hit) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	return a.DocID < b.DocID
+}
+
+// freq returns the term frequency of the document in the postings list.
+func freq(postings []Posting, id int) int {
+	i := sort.Search(len(postings), func(i int) bool {
+		return postings[i].DocID >= id
+	})
+	if i < len(postings) && postings[i].DocID == id {
+		return postings[i].Freq
+	}
+	return 0
+}
+
+// tf returns the weight of a term occurring freq times in a document.
+func tf(freq int) float64 {
+	return math.Sqrt(float64(freq))
+}
+
+// idf returns the inverse document frequency of a term occurring in df of n
+// documents.
+func idf(n, df int) float64 {
+	return 1 + math.Log(float64(n)/float64(df+1))
+}
+
+// lengthNorm returns the normalization factor for a document with the given
+// number of tokens, so that long documents don't rank above short ones just
+// by containing more words.
+func lengthNorm(length int) float64 {
+	if length == 0 {
+		return 0
+	}
+	return 1 / math.Sqrt(float64(length))
+}
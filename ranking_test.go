@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRank(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []string{
+		"hello world foo",
+		"hello hello world",
+		"hello world and everyone else in it",
+	} {
+		_, err := idx.IndexDocument(strings.NewReader(doc))
+		require.Nil(t, err)
+	}
+
+	q := NewQuerier(idx)
+	postings, err := q.Intersection("hello", "world")
+	require.Nil(t, err)
+
+	hits, err := q.Rank(postings, QueryTerm{Token: "hello", Boost: 1}, QueryTerm{Token: "world", Boost: 1})
+	require.Nil(t, err)
+
+	var ids []int
+	for _, h := range hits {
+		ids = append(ids, h.DocID)
+	}
+	require.Equal(t, []int{1, 0, 2}, ids)
+}
+
+// TestRankMissingTerms ranks the hits of a union query with a term not in
+// the index, which matches nothing and adds nothing to the scores.
+func TestRankMissingTerms(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []string{"hello world", "hello"} {
+		_, err := idx.IndexDocument(strings.NewReader(doc))
+		require.Nil(t, err)
+	}
+
+	q := NewQuerier(idx)
+	postings, err := q.Union("hello", "nothere")
+	require.Nil(t, err)
+
+	hits, err := q.Rank(postings, QueryTerm{Token: "hello", Boost: 1}, QueryTerm{Token: "nothere", Boost: 1})
+	require.Nil(t, err)
+	want, err := q.Rank(postings, QueryTerm{Token: "hello", Boost: 1})
+	require.Nil(t, err)
+	require.Equal(t, want, hits)
+	require.Len(t, hits, 2)
+}
+
+func TestHitLess(t *testing.T) {
+	require.True(t, hitLess(Hit{DocID: 1, Score: 2}, Hit{DocID: 0, Score: 1}))
+	require.True(t, hitLess(Hit{DocID: 0, Score: 1}, Hit{DocID: 1, Score: 1}))
+	require.False(t, hitLess(Hit{DocID: 1, Score: 1}, Hit{DocID: 0, Score: 1}))
+}
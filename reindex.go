@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// reindexBatchSize is the number of documents committed to the destination
+// of a reindex at once.
+const reindexBatchSize = 500
+
+// ReindexRequest names the index to read documents from and the index to
+// index them into. The source can be an alias resolving to one index.
+type ReindexRequest struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+// ReindexResult is the outcome of a reindex. Failed is the number of
+// documents the destination rejected.
+type ReindexResult struct {
+	Source  string `json:"source"`
+	Dest    string `json:"dest"`
+	Indexed int    `json:"indexed"`
+	Failed  int    `json:"failed"`
+}
+
+// reindex resolves the source and the destination of a reindex. The
+// destination must be an index, not an alias, since the documents must end
+// up in a known place.
+func (c *collections) reindex(r ReindexRequest) (src, dest *collection, err error) {
+	names, err := c.resolve([]string{r.Source})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(names) != 1 {
+		return nil, nil, fmt.Errorf("source '%s' resolves to several indexes", r.Source)
+	}
+	src, ok := c.Get(names[0])
+	if !ok {
+		return nil, nil, errIndexNotFound(names[0])
+	}
+	dest, ok = c.Get(r.Dest)
+	if !ok {
+		return nil, nil, errIndexNotFound(r.Dest)
+	}
+	if src == dest {
+		return nil, nil, fmt.Errorf("can't reindex '%s' into itself", names[0])
+	}
+	return src, dest, nil
+}
+
+// Reindex rebuilds the destination index from the stored documents of the
+// source index. Documents are analyzed with the analyzer of the destination
+// and keep their fields and external IDs, so they replace documents with
+// the same external IDs in the destination. Documents the schema of the
+// destination rejects are skipped.
+//
+// The documents are read as of when the reindex starts. Changes made to the
+// source after that aren't included.
+func (c *collections) Reindex(r ReindexRequest) (ReindexResult, error) {
+	src, dest, err := c.reindex(r)
+	if err != nil {
+		return ReindexResult{}, err
+	}
+	res := ReindexResult{
+		Source: src.info.Name,
+		Dest:   dest.info.Name,
+	}
+
+	docs, unpin := src.svc.pinDocs()
+	defer unpin()
+
+	b := newBatch(dest.svc.analyzer)
+	var ops []walOp
+	flush := func(refresh bool) error {
+		results, err := dest.svc.commit(b, ops, refresh)
+		if err != nil {
+			return fmt.Errorf("commit: %w", err)
+		}
+		for _, r := range results {
+			if r.Err != nil {
+				log.Printf("reindex: %v", r.Err)
+				res.Failed++
+				continue
+			}
+			res.Indexed++
+		}
+		b = newBatch(dest.svc.analyzer)
+		ops = nil
+		return nil
+	}
+
+	for _, d := range docs {
+		if err := dest.svc.schema.check(d.Fields); err != nil {
+			log.Printf("reindex document %d: %v", d.ID, err)
+			res.Failed++
+			continue
+		}
+		source, err := src.svc.store.Get(d.ID)
+		if err != nil {
+			return res, fmt.Errorf("get %d: %w", d.ID, err)
+		}
+		op := walOp{
+			Action: actionIndex,
+			Fields: d.Fields,
+			Source: source,
+		}
+		if err := op.addTo(b); err != nil {
+			return res, fmt.Errorf("add %d: %w", d.ID, err)
+		}
+		ops = append(ops, op)
+
+		if b.Len() == reindexBatchSize {
+			if err := flush(false); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := flush(true); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// handleReindex starts a reindex, see Reindex, with the ReindexRequest in
+// the body. The reindex runs as a job: the response is 202 Accepted with
+// the job, which is polled at /jobs/{id}.
+func (s *service) handleReindex(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var r ReindexRequest
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		log.Printf("read body: %v", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		log.Printf("unmarshal: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fail early on unknown indexes, rather than in the job.
+	if _, _, err := s.collections.reindex(r); err != nil {
+		log.Printf("reindex: %v", err)
+		if errors.Is(err, errNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.jobs.Submit(func() (interface{}, error) {
+		return s.collections.Reindex(r)
+	})
+	if err != nil {
+		log.Printf("submit: %v", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "", http.StatusTooManyRequests)
+		return
+	}
+
+	jsonResp, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(jsonResp)
+}
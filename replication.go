@@ -0,0 +1,966 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replicator replicates the index of a service to the other nodes of its
+// replica set. One node is the primary, which commits all changes; the
+// others are followers.
+//
+// The write-ahead log is the operation log: record n of the primary's log
+// is change n of the index. The primary ships new records to every
+// follower, which commits them through its own write-ahead log to its own
+// index and store, so a follower's log is always a prefix of the
+// primary's, or diverged from it.
+//
+// Every primary has a term, increased whenever a follower is promoted, and
+// every record the term of the primary that committed it. A replica
+// rejects records from an older term, and a primary stepping down when it
+// learns of a newer one. Before applying records a follower checks that
+// its log matches the primary's up to them, by the number and term of the
+// record before. If it doesn't, for instance because an old primary
+// committed records the new one never saw, the primary backs up until the
+// logs match, and the follower drops its diverged records and rebuilds its
+// index from the rest.
+//
+// Sources are shipped in the records as long as the request stays within
+// maxShipBytes. The others, like those of large documents, are left out,
+// and the follower fetches them from the primary one at a time.
+//
+// Followers reject writes with 421 Misdirected Request. They serve reads
+// while they're in sync: they've applied all records of the primary as of
+// the last time it was heard from, within three heartbeats.
+//
+// Only the index of the service is replicated. Named indexes and aliases
+// are kept on the primary alone, and followers reject all requests to them.
+// They aren't carried over to a promoted follower.
+//
+// There are no elections: a follower is promoted by an operator, or by a
+// tool watching the replica set, with POST /replication/promote. Promote
+// one follower at a time, since two primaries of the same term don't step
+// down for each other.
+type replicator struct {
+	svc   *service
+	self  string
+	peers []string
+	// client ships records, and sources fetches sources, which may take
+	// longer than shipTimeout.
+	client    *http.Client
+	sources   *http.Client
+	heartbeat time.Duration
+	path      string
+	primary   bool
+
+	// applyMu serializes the handling of shipped records.
+	applyMu sync.Mutex
+
+	// mu guards the fields below. It's taken after commitMu when both are
+	// held.
+	mu    sync.Mutex
+	state replicaState
+
+	// leader, leaderSeq and contact are the primary, the number of records
+	// in its log and the time it was last heard from, on followers.
+	leader    string
+	leaderSeq int
+	contact   time.Time
+
+	// followers holds the progress of every follower, and changed is
+	// closed when records are appended, on the primary. done is closed when
+	// the node stops being the primary.
+	followers map[string]*followerProgress
+	changed   chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// ReplicationConfig holds the settings of a replica.
+type ReplicationConfig struct {
+	// Self is the base URL the other replicas reach the node at.
+	Self string
+
+	// Peers are the base URLs of the other replicas.
+	Peers []string
+
+	// Primary makes the node the primary of a new replica set. Once the
+	// node has taken part in replication, it starts with the role it had.
+	Primary bool
+
+	// Heartbeat is how often the primary contacts followers with no
+	// records to ship. If zero, it's one second.
+	Heartbeat time.Duration
+
+	// Transport carries the requests to the other replicas. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+}
+
+const (
+	rolePrimary  = "primary"
+	roleFollower = "follower"
+
+	// maxShipRecords and maxShipBytes limit the records shipped in one
+	// request, and shipTimeout is how long the primary waits for a
+	// follower to apply them. maxApplyBytes is the largest request a
+	// follower accepts, which leaves room for a single record holding
+	// more than maxShipBytes without its sources.
+	maxShipRecords = 100
+	maxShipBytes   = 8 << 20
+	maxApplyBytes  = 8 * maxShipBytes
+	shipTimeout    = 30 * time.Second
+)
+
+var (
+	errNotPrimary = errors.New("not the primary")
+	errNotInSync  = errors.New("not in sync with the primary")
+)
+
+// replicaState is the state of a replica kept on disk, next to the
+// write-ahead log.
+type replicaState struct {
+	Role string `json:"role"`
+	Term uint64 `json:"term"`
+
+	// Terms holds the record each term of the log begins at, in order.
+	Terms []termStart `json:"terms,omitempty"`
+}
+
+// termStart is the first record of a term in the log.
+type termStart struct {
+	Term uint64 `json:"term"`
+	Seq  int    `json:"seq"`
+}
+
+// followerProgress is what the primary knows about a follower: the number of
+// records in its log and when it last responded.
+type followerProgress struct {
+	seq     int
+	contact time.Time
+}
+
+// shipRequest ships records to a follower. PrevSeq is the number of the
+// first record shipped, and PrevTerm the term of the record before it. Seq
+// is the number of records in the primary's log.
+type shipRequest struct {
+	Term     uint64     `json:"term"`
+	Leader   string     `json:"leader"`
+	PrevSeq  int        `json:"prev_seq"`
+	PrevTerm uint64     `json:"prev_term"`
+	Entries  []logEntry `json:"entries,omitempty"`
+	Seq      int        `json:"seq"`
+}
+
+// logEntry is a record of the log with its term. Fetch holds the changes
+// whose sources were left out of the record, to be fetched from the
+// primary.
+type logEntry struct {
+	Term  uint64  `json:"term"`
+	Ops   []walOp `json:"ops"`
+	Fetch []int   `json:"fetch,omitempty"`
+}
+
+// shipResponse is a follower's response to shipped records. If the records
+// were applied, Seq is the number of records in its log. Otherwise it's
+// the record the primary should ship from instead.
+type shipResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	Seq     int    `json:"seq"`
+}
+
+// ReplicationStatus describes the replica. Primary is the primary as far as
+// the replica knows, and Seq the number of records in its log.
+type ReplicationStatus struct {
+	Role      string           `json:"role"`
+	Term      uint64           `json:"term"`
+	Primary   string           `json:"primary,omitempty"`
+	Seq       int              `json:"seq"`
+	InSync    bool             `json:"in_sync"`
+	Followers []FollowerStatus `json:"followers,omitempty"`
+}
+
+// FollowerStatus describes a follower as seen by the primary.
+type FollowerStatus struct {
+	Node    string    `json:"node"`
+	Seq     int       `json:"seq"`
+	InSync  bool      `json:"in_sync"`
+	Contact time.Time `json:"contact"`
+}
+
+func newReplicator(svc *service, cfg ReplicationConfig) *replicator {
+	heartbeat := cfg.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = time.Second
+	}
+	return &replicator{
+		svc:       svc,
+		self:      cfg.Self,
+		peers:     cfg.Peers,
+		heartbeat: heartbeat,
+		primary:   cfg.Primary,
+		client: &http.Client{
+			Transport: cfg.Transport,
+			Timeout:   shipTimeout,
+		},
+		sources: &http.Client{
+			Transport: cfg.Transport,
+		},
+		changed: make(chan struct{}),
+	}
+}
+
+// start loads the state of the replica and, on the primary, starts
+// shipping records to the followers.
+func (r *replicator) start() error {
+	if r.svc.wal == nil {
+		return errors.New("replication requires a write-ahead log")
+	}
+	r.path = r.svc.wal.path + ".replication"
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := ioutil.ReadFile(r.path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &r.state); err != nil {
+			return fmt.Errorf("unmarshal state: %w", err)
+		}
+	case os.IsNotExist(err):
+		r.state = replicaState{Role: roleFollower}
+		if r.primary {
+			r.state = replicaState{
+				Role:  rolePrimary,
+				Term:  1,
+				Terms: []termStart{{Term: 1}},
+			}
+		}
+		if err := r.save(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("read state: %w", err)
+	}
+
+	log.Printf("Replica is %s in term %d", r.state.Role, r.state.Term)
+	if r.state.Role == rolePrimary {
+		r.lead()
+	}
+	return nil
+}
+
+// stop stops shipping records.
+func (r *replicator) stop() {
+	r.mu.Lock()
+	if r.state.Role == rolePrimary {
+		close(r.done)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// save writes the state of the replica to disk. The caller must hold mu.
+func (r *replicator) save() error {
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	if err := writeFileAtomic(r.path, data); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// lead starts shipping records to the followers. The caller must hold mu.
+func (r *replicator) lead() {
+	r.leader = r.self
+	r.done = make(chan struct{})
+	r.followers = make(map[string]*followerProgress, len(r.peers))
+	for _, peer := range r.peers {
+		r.followers[peer] = &followerProgress{}
+		r.wg.Add(1)
+		go r.ship(peer, r.done)
+	}
+}
+
+// follow makes the replica a follower of the primary of the term. The
+// caller must hold mu.
+func (r *replicator) follow(term uint64, leader string) {
+	if r.state.Role == rolePrimary {
+		log.Printf("Stepping down as primary of term %d for term %d", r.state.Term, term)
+		close(r.done)
+		r.followers = nil
+	}
+	r.state.Role = roleFollower
+	r.state.Term = term
+	r.leader = leader
+	if err := r.save(); err != nil {
+		log.Printf("save replica state: %v", err)
+	}
+}
+
+// isPrimary reports whether the replica is the primary.
+func (r *replicator) isPrimary() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.state.Role == rolePrimary
+}
+
+// inSync reports whether the replica may serve reads: the primary always
+// may, and a follower if it has applied all records of the primary and has
+// heard from it recently.
+func (r *replicator) inSync() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.Role == rolePrimary {
+		return true
+	}
+	return time.Since(r.contact) < 3*r.heartbeat && r.svc.wal.Len() >= r.leaderSeq
+}
+
+// notify wakes up the shippers after records are appended.
+func (r *replicator) notify() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// termAt returns the term of record seq, or zero if there's no such record.
+func (r *replicator) termAt(seq int) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.state.Terms) - 1; i >= 0; i-- {
+		if r.state.Terms[i].Seq <= seq {
+			return r.state.Terms[i].Term
+		}
+	}
+	return 0
+}
+
+// termStartOf returns the first record of the term of record seq.
+func (r *replicator) termStartOf(seq int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.state.Terms) - 1; i >= 0; i-- {
+		if r.state.Terms[i].Seq <= seq {
+			return r.state.Terms[i].Seq
+		}
+	}
+	return 0
+}
+
+// setTermFrom records that the records from seq on are of the term. It
+// reports whether the terms changed. The caller must hold mu.
+func (r *replicator) setTermFrom(seq int, term uint64) bool {
+	changed := r.trimTerms(seq)
+	terms := r.state.Terms
+	if len(terms) == 0 || terms[len(terms)-1].Term != term {
+		r.state.Terms = append(terms, termStart{Term: term, Seq: seq})
+		changed = true
+	}
+	return changed
+}
+
+// trimTerms forgets the terms of the records from seq on. It reports
+// whether the terms changed. The caller must hold mu.
+func (r *replicator) trimTerms(seq int) bool {
+	terms := r.state.Terms
+	for len(terms) > 0 && terms[len(terms)-1].Seq >= seq {
+		terms = terms[:len(terms)-1]
+	}
+	changed := len(terms) != len(r.state.Terms)
+	r.state.Terms = terms
+	return changed
+}
+
+// ship ships records to a follower until done is closed. It starts from the
+// end of the log, and backs up if the follower is behind or diverged.
+func (r *replicator) ship(peer string, done <-chan struct{}) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+
+	next := r.svc.wal.Len()
+	failing := false
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		r.mu.Lock()
+		changed := r.changed
+		r.mu.Unlock()
+
+		seq, ok, err := r.shipTo(peer, next)
+		if err != nil {
+			if !failing {
+				log.Printf("ship to %s: %v", peer, err)
+			}
+			failing = true
+		} else {
+			if failing {
+				log.Printf("Shipping to %s again", peer)
+			}
+			failing = false
+
+			more := (ok && seq < r.svc.wal.Len()) || (!ok && seq < next)
+			next = seq
+			if more {
+				continue
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// shipTo ships the records from next on to the follower, at most
+// maxShipRecords of them. It returns whether the follower applied them, and
+// the record to ship from next.
+func (r *replicator) shipTo(peer string, next int) (int, bool, error) {
+	r.mu.Lock()
+	term := r.state.Term
+	r.mu.Unlock()
+
+	ship, err := r.entries(next)
+	if err != nil {
+		return next, false, err
+	}
+	ship.Term = term
+	ship.Leader = r.self
+
+	body, err := json.Marshal(ship)
+	if err != nil {
+		return next, false, fmt.Errorf("marshal: %w", err)
+	}
+	resp, err := r.client.Post(peer+"/replication/apply", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return next, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return next, false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var res shipResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return next, false, fmt.Errorf("decode: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if res.Term > r.state.Term {
+		r.follow(res.Term, "")
+		return next, false, nil
+	}
+	if f, ok := r.followers[peer]; ok {
+		f.contact = time.Now()
+		if res.Success {
+			f.seq = res.Seq
+		}
+	}
+	return res.Seq, res.Success, nil
+}
+
+// entries returns a request shipping the records from next on. Records are
+// added while the request stays within maxShipBytes, and at least one. The
+// sources kept in files, and those of a first record too large with them,
+// are left to be fetched.
+func (r *replicator) entries(next int) (shipRequest, error) {
+	n := r.svc.wal.Len()
+	if next > n {
+		next = n
+	}
+	ship := shipRequest{
+		PrevSeq: next,
+		Seq:     n,
+	}
+	if next > 0 {
+		ship.PrevTerm = r.termAt(next - 1)
+	}
+
+	size := 0
+	for seq := next; seq < n && len(ship.Entries) < maxShipRecords; seq++ {
+		ops, err := r.svc.wal.Read(seq)
+		if err != nil {
+			return shipRequest{}, err
+		}
+		e := logEntry{
+			Term: r.termAt(seq),
+			Ops:  ops,
+		}
+		for i, op := range ops {
+			if op.path != "" {
+				e.Fetch = append(e.Fetch, i)
+			}
+		}
+		esize, err := entrySize(e)
+		if err != nil {
+			return shipRequest{}, err
+		}
+		if size+esize > maxShipBytes {
+			if len(ship.Entries) > 0 {
+				break
+			}
+			e.Fetch = e.Fetch[:0]
+			for i, op := range ops {
+				if op.path != "" || len(op.Source) > 0 {
+					ops[i].Source = nil
+					e.Fetch = append(e.Fetch, i)
+				}
+			}
+			if esize, err = entrySize(e); err != nil {
+				return shipRequest{}, err
+			}
+		}
+		size += esize
+		ship.Entries = append(ship.Entries, e)
+	}
+	return ship, nil
+}
+
+// entrySize returns the size of the record in a request.
+func entrySize(e logEntry) (int, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, fmt.Errorf("marshal: %w", err)
+	}
+	return len(data), nil
+}
+
+// fetchSource fetches the source of change op of record seq of the given
+// term from the primary to a source file.
+func (r *replicator) fetchSource(leader string, seq int, term uint64, op int) (*os.File, error) {
+	q := url.Values{}
+	q.Set("seq", strconv.Itoa(seq))
+	q.Set("term", strconv.FormatUint(term, 10))
+	q.Set("op", strconv.Itoa(op))
+	resp, err := r.sources.Get(leader + "/replication/source?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	f, err := r.svc.wal.createSource()
+	if err != nil {
+		return nil, fmt.Errorf("create source: %w", err)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("read source: %w", err)
+	}
+	return f, nil
+}
+
+// apply applies records shipped by a primary, see replicator.
+func (r *replicator) apply(ship shipRequest) (shipResponse, error) {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	term := r.state.Term
+	if ship.Term < term || (ship.Term == term && r.state.Role == rolePrimary) {
+		r.mu.Unlock()
+		return shipResponse{Term: term, Seq: ship.PrevSeq}, nil
+	}
+	if ship.Term > term || r.leader != ship.Leader {
+		r.follow(ship.Term, ship.Leader)
+		term = ship.Term
+	}
+	r.leaderSeq = ship.Seq
+	r.contact = time.Now()
+	r.mu.Unlock()
+
+	s := r.svc
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	n := s.wal.Len()
+	if ship.PrevSeq > n {
+		return shipResponse{Term: term, Seq: n}, nil
+	}
+	if ship.PrevSeq > 0 && r.termAt(ship.PrevSeq-1) != ship.PrevTerm {
+		return shipResponse{Term: term, Seq: r.termStartOf(ship.PrevSeq - 1)}, nil
+	}
+
+	applied := false
+	for i, e := range ship.Entries {
+		seq := ship.PrevSeq + i
+		if seq < s.wal.Len() {
+			if r.termAt(seq) == e.Term {
+				continue
+			}
+			log.Printf("Dropping records from %d, diverged from the primary", seq)
+			if err := r.truncate(seq); err != nil {
+				return shipResponse{}, err
+			}
+		}
+		if err := r.append(ship.Leader, seq, e); err != nil {
+			return shipResponse{}, err
+		}
+		applied = true
+	}
+
+	// Records past the end of the primary's log were never committed by
+	// it.
+	if end := ship.PrevSeq + len(ship.Entries); end == ship.Seq && s.wal.Len() > end {
+		log.Printf("Dropping records from %d, not in the primary's log", end)
+		if err := r.truncate(end); err != nil {
+			return shipResponse{}, err
+		}
+		applied = true
+	}
+
+	if applied && s.refreshInterval == 0 {
+		s.refresh()
+	}
+	return shipResponse{Term: term, Success: true, Seq: s.wal.Len()}, nil
+}
+
+// truncate drops the records from seq on, see service.truncate. The caller
+// must hold commitMu.
+func (r *replicator) truncate(seq int) error {
+	if err := r.svc.truncate(seq); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.trimTerms(seq) {
+		return r.save()
+	}
+	return nil
+}
+
+// append commits a shipped record as record seq of the log. The sources
+// left out of the record are fetched from the leader, and kept in the
+// record or in source files like those of documents posted one at a time.
+// The caller must hold commitMu.
+func (r *replicator) append(leader string, seq int, e logEntry) error {
+	s := r.svc
+	for _, i := range e.Fetch {
+		if i < 0 || i >= len(e.Ops) {
+			return fmt.Errorf("fetch source of change %d of %d", i, len(e.Ops))
+		}
+		f, err := r.fetchSource(leader, seq, e.Term, i)
+		if err != nil {
+			return fmt.Errorf("fetch source: %w", err)
+		}
+		source, ok, err := readInlineSource(f)
+		if err == nil && !ok {
+			err = s.wal.closeSource(f)
+		} else {
+			f.Close()
+		}
+		if err != nil || ok {
+			os.Remove(f.Name())
+		}
+		if err != nil {
+			return fmt.Errorf("write source: %w", err)
+		}
+		e.Ops[i].Source = source
+		e.Ops[i].Blob = ""
+		if !ok {
+			e.Ops[i].Blob = filepath.Base(f.Name())
+			e.Ops[i].path = f.Name()
+		}
+	}
+
+	b := newBatch(s.analyzer)
+	for _, op := range e.Ops {
+		if err := op.addTo(b); err != nil {
+			return err
+		}
+	}
+
+	// The term is saved first, so the record is never taken for one of an
+	// older term.
+	r.mu.Lock()
+	var err error
+	if r.setTermFrom(seq, e.Term) {
+		err = r.save()
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.apply(b, e.Ops, s.wal); err != nil {
+		return fmt.Errorf("apply record %d: %w", seq, err)
+	}
+	return nil
+}
+
+// promote makes a follower the primary of a new term. Unless force is set,
+// it fails if the follower hadn't applied all records of the old primary
+// when it was last heard from.
+func (r *replicator) promote(force bool) error {
+	s := r.svc
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state.Role == rolePrimary {
+		return nil
+	}
+	n := s.wal.Len()
+	if n < r.leaderSeq && !force {
+		return fmt.Errorf("%w: %d of %d records", errNotInSync, n, r.leaderSeq)
+	}
+
+	r.state.Role = rolePrimary
+	r.state.Term++
+	r.setTermFrom(n, r.state.Term)
+	if err := r.save(); err != nil {
+		return err
+	}
+	log.Printf("Promoted to primary of term %d", r.state.Term)
+	r.lead()
+	return nil
+}
+
+// status returns the status of the replica.
+func (r *replicator) status() ReplicationStatus {
+	seq := r.svc.wal.Len()
+	inSync := r.inSync()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := ReplicationStatus{
+		Role:    r.state.Role,
+		Term:    r.state.Term,
+		Primary: r.leader,
+		Seq:     seq,
+		InSync:  inSync,
+	}
+	for _, peer := range r.peers {
+		f, ok := r.followers[peer]
+		if !ok {
+			continue
+		}
+		st.Followers = append(st.Followers, FollowerStatus{
+			Node:    peer,
+			Seq:     f.seq,
+			InSync:  f.seq == seq && time.Since(f.contact) < 3*r.heartbeat,
+			Contact: f.contact,
+		})
+	}
+	return st
+}
+
+// guard rejects writes on followers, and reads on followers out of sync.
+// The replication endpoints are always served. Named indexes and aliases
+// aren't replicated, so followers reject all requests to them.
+func (r *replicator) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/replication") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		write := req.URL.Path == "/doc" || req.URL.Path == "/bulk"
+		if (write || primaryOnly(req.URL.Path)) && !r.isPrimary() {
+			log.Printf("%s on follower: %s", req.Method, req.URL.Path)
+			http.Error(w, "", http.StatusMisdirectedRequest)
+			return
+		}
+		if !write && !r.inSync() {
+			log.Printf("read on follower out of sync: %s", req.URL.Path)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// primaryOnly reports whether the path is served by the primary only: the
+// endpoints of the named indexes and aliases, and reindexing between them.
+func primaryOnly(path string) bool {
+	return path == "/indexes" || strings.HasPrefix(path, "/indexes/") ||
+		path == "/aliases" || strings.HasPrefix(path, "/aliases/") ||
+		path == "/reindex"
+}
+
+// handleStatus serves the status of the replica.
+func (r *replicator) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResp, err := json.Marshal(r.status())
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
+
+// handleApply applies records shipped by the primary.
+func (r *replicator) handleApply(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ship shipRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxApplyBytes)).Decode(&ship); err != nil {
+		log.Printf("decode: %v", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	res, err := r.apply(ship)
+	if err != nil {
+		log.Printf("apply: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
+
+// handleSource serves the source of change op of record seq of the log,
+// for followers fetching the sources left out of shipped records. It fails
+// with 404 Not Found unless the record is of the given term.
+func (r *replicator) handleSource(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := req.URL.Query()
+	seq, err := strconv.Atoi(q.Get("seq"))
+	if err != nil {
+		log.Printf("seq: %v", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	term, err := strconv.ParseUint(q.Get("term"), 10, 64)
+	if err != nil {
+		log.Printf("term: %v", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	i, err := strconv.Atoi(q.Get("op"))
+	if err != nil {
+		log.Printf("op: %v", err)
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if seq < 0 || seq >= r.svc.wal.Len() || r.termAt(seq) != term {
+		log.Printf("no record %d of term %d", seq, term)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	ops, err := r.svc.wal.Read(seq)
+	if err != nil {
+		log.Printf("read record: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if i < 0 || i >= len(ops) || ops[i].Action == actionDelete {
+		log.Printf("no source of change %d of record %d", i, seq)
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	source, err := ops[i].open()
+	if err != nil {
+		log.Printf("open source: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+	defer source.Close()
+	if _, err := io.Copy(w, source); err != nil {
+		log.Printf("write source: %v", err)
+	}
+}
+
+// handlePromote promotes the replica to primary, see promote. With
+// force=true, a follower that's behind is promoted, losing the records it
+// missed. It responds with the status of the replica.
+func (r *replicator) handlePromote(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	force := false
+	if v := req.URL.Query().Get("force"); v != "" {
+		var err error
+		force, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("invalid force: %v", err)
+			http.Error(w, "invalid force", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := r.promote(force); err != nil {
+		log.Printf("promote: %v", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNotInSync) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	jsonResp, err := json.Marshal(r.status())
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Write(jsonResp)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// network carries the requests between replicas. Isolated hosts can't
+// reach any other replica, nor be reached by them, but clients can still
+// reach them.
+type network struct {
+	mu       sync.Mutex
+	isolated map[string]bool
+}
+
+func (n *network) isolate(host string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated[host] = true
+}
+
+func (n *network) heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated = make(map[string]bool)
+}
+
+// transport returns the transport of the replica on the host.
+func (n *network) transport(host string) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		n.mu.Lock()
+		cut := n.isolated[host] || n.isolated[req.URL.Host]
+		n.mu.Unlock()
+		if cut {
+			return nil, errors.New("network partition")
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// startReplicas starts a replica set of n services on ports of their own,
+// the first of them the primary. They store documents like the service does
+// by default, with identical documents stored once.
+func startReplicas(t *testing.T, net *network, n int) []string {
+	t.Helper()
+	servers := make([]*httptest.Server, n)
+	urls := make([]string, n)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+
+	for i, srv := range servers {
+		dir := t.TempDir()
+		w, err := openWAL(filepath.Join(dir, "wal"), syncNever, 0)
+		require.Nil(t, err)
+		store, err := openStore(storeFiles, filepath.Join(dir, "store"), true)
+		require.Nil(t, err)
+
+		var peers []string
+		for j, u := range urls {
+			if j != i {
+				peers = append(peers, u)
+			}
+		}
+		idx := NewIndex()
+		s := NewService(idx, NewQuerier(idx), store, Config{
+			WAL: w,
+			Replication: &ReplicationConfig{
+				Self:      urls[i],
+				Peers:     peers,
+				Primary:   i == 0,
+				Heartbeat: 10 * time.Millisecond,
+				Transport: net.transport(srv.Listener.Addr().String()),
+			},
+		}).(*service)
+		require.Nil(t, s.open())
+		srv.Config.Handler = s.Handler()
+		srv.Start()
+		t.Cleanup(func() {
+			srv.Close()
+			s.close()
+		})
+	}
+	return urls
+}
+
+// replicationStatus returns the status of the replica.
+func replicationStatus(t *testing.T, replica string) ReplicationStatus {
+	t.Helper()
+	code, body := send(t, "GET", replica+"/replication", "")
+	require.Equal(t, http.StatusOK, code)
+	var st ReplicationStatus
+	require.Nil(t, json.Unmarshal([]byte(body), &st))
+	return st
+}
+
+// search searches the replica and returns the status and the sources of
+// the hits.
+func search(t *testing.T, replica, query string) (int, []string) {
+	t.Helper()
+	code, body := send(t, "GET", replica+"/search/union?size=100&query="+url.QueryEscape(query), "")
+	if code != http.StatusOK {
+		return code, nil
+	}
+	var res GetResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	var sources []string
+	for _, d := range res.Documents {
+		sources = append(sources, d.Source)
+	}
+	return code, sources
+}
+
+// waitInSync waits until the followers have applied all records of the
+// primary.
+func waitInSync(t *testing.T, primary string, followers ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		seq := replicationStatus(t, primary).Seq
+		for _, f := range followers {
+			st := replicationStatus(t, f)
+			if !st.InSync || st.Seq != seq {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	net := &network{isolated: make(map[string]bool)}
+	replicas := startReplicas(t, net, 3)
+	primary, followers := replicas[0], replicas[1:]
+
+	// Index documents one by one, with their sources next to the log, and
+	// in bulk, with their sources in the records.
+	for i := 0; i < 5; i++ {
+		code, _ := send(t, "POST", fmt.Sprintf("%s/doc?id=doc%d", primary, i), fmt.Sprintf("common single %d", i))
+		require.Equal(t, http.StatusOK, code)
+	}
+	var bulk []string
+	for i := 5; i < 10; i++ {
+		bulk = append(bulk, fmt.Sprintf(`{"action": "index", "id": "doc%d", "source": "common bulk %d"}`, i, i))
+	}
+	code, _ := send(t, "POST", primary+"/bulk", strings.Join(bulk, "\n"))
+	require.Equal(t, http.StatusOK, code)
+
+	waitInSync(t, primary, followers...)
+	_, want := search(t, primary, "common")
+	require.Len(t, want, 10)
+	for _, f := range followers {
+		code, got := search(t, f, "common")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, want, got)
+
+		code, body := send(t, "GET", f+"/doc/0", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, "common single 0", body)
+	}
+
+	// Sources kept next to the log are fetched by the followers.
+	large := "large" + strings.Repeat(" ", inlineSourceSize)
+	code, _ = send(t, "POST", primary+"/doc?id=large", large)
+	require.Equal(t, http.StatusOK, code)
+	waitInSync(t, primary, followers...)
+	for _, f := range followers {
+		code, body := send(t, "GET", f+"/doc/10", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, large, body)
+	}
+
+	st := replicationStatus(t, primary)
+	require.Equal(t, rolePrimary, st.Role)
+	require.Len(t, st.Followers, 2)
+	for _, f := range st.Followers {
+		require.Equal(t, st.Seq, f.Seq)
+	}
+
+	// Followers don't take writes.
+	code, _ = send(t, "POST", followers[0]+"/doc", "common rejected")
+	require.Equal(t, http.StatusMisdirectedRequest, code)
+	code, _ = send(t, "POST", followers[0]+"/bulk", `{"action": "delete", "id": "doc0"}`)
+	require.Equal(t, http.StatusMisdirectedRequest, code)
+
+	// Named indexes and aliases aren't replicated, so they're left to the
+	// primary.
+	for _, req := range []struct{ method, path string }{
+		{"PUT", "/indexes/books"},
+		{"GET", "/indexes"},
+		{"POST", "/indexes/books/doc"},
+		{"PUT", "/aliases/all"},
+		{"POST", "/reindex"},
+	} {
+		code, _ = send(t, req.method, followers[0]+req.path, "")
+		require.Equal(t, http.StatusMisdirectedRequest, code, req.path)
+	}
+
+	// Deletions are replicated too.
+	code, _ = send(t, "POST", primary+"/bulk", `{"action": "delete", "id": "doc0"}`)
+	require.Equal(t, http.StatusOK, code)
+	waitInSync(t, primary, followers...)
+	for _, f := range followers {
+		_, got := search(t, f, "common")
+		require.Len(t, got, 9)
+	}
+}
+
+// TestShipEntries checks that records are shipped within maxShipBytes, with
+// the sources of a record too large for it left to be fetched.
+func TestShipEntries(t *testing.T) {
+	root := t.TempDir()
+	w, err := openWAL(filepath.Join(root, "wal"), syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	s := newTestService(t, filepath.Join(root, "store"), w)
+	require.Nil(t, s.open())
+	r := newReplicator(s, ReplicationConfig{})
+
+	code, _ := do(t, s.Handler(), "POST", "/doc?id=small", "small")
+	require.Equal(t, http.StatusOK, code)
+	// Blank sources, which are quick to index.
+	source := strings.Repeat(" ", inlineSourceSize)
+	var bulk []string
+	for i := 0; i <= maxShipBytes/inlineSourceSize; i++ {
+		bulk = append(bulk, fmt.Sprintf(`{"action": "index", "id": "doc%d", "source": "%s"}`, i, source))
+	}
+	code, _ = do(t, s.Handler(), "POST", "/bulk", strings.Join(bulk, "\n"))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 2, w.Len())
+
+	ship, err := r.entries(0)
+	require.Nil(t, err)
+	require.Len(t, ship.Entries, 1)
+	require.Empty(t, ship.Entries[0].Fetch)
+
+	ship, err = r.entries(1)
+	require.Nil(t, err)
+	require.Len(t, ship.Entries, 1)
+	require.Len(t, ship.Entries[0].Fetch, len(bulk))
+	for _, op := range ship.Entries[0].Ops {
+		require.Empty(t, op.Source)
+	}
+}
+
+// TestFailover isolates the primary, promotes a follower and heals the
+// partition. The old primary keeps taking writes while it's isolated,
+// which are dropped when it rejoins as a follower of the new primary.
+func TestFailover(t *testing.T) {
+	net := &network{isolated: make(map[string]bool)}
+	replicas := startReplicas(t, net, 3)
+	old, next, other := replicas[0], replicas[1], replicas[2]
+
+	for i := 0; i < 5; i++ {
+		code, _ := send(t, "POST", fmt.Sprintf("%s/doc?id=before%d", old, i), fmt.Sprintf("before %d", i))
+		require.Equal(t, http.StatusOK, code)
+	}
+	// A copy shares its source with the original in the store.
+	code, _ := send(t, "POST", old+"/doc?id=copy", "before 1")
+	require.Equal(t, http.StatusOK, code)
+	waitInSync(t, old, next, other)
+
+	net.isolate(strings.TrimPrefix(old, "http://"))
+
+	// Followers cut off from the primary stop serving reads.
+	require.Eventually(t, func() bool {
+		code, _ := search(t, next, "before")
+		return code == http.StatusServiceUnavailable
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The old primary doesn't know it's cut off.
+	code, _ = send(t, "POST", old+"/doc?id=lost", "lost write")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = send(t, "POST", old+"/doc?id=before0", "lost update")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = send(t, "POST", next+"/replication/promote", "")
+	require.Equal(t, http.StatusOK, code)
+	st := replicationStatus(t, next)
+	require.Equal(t, rolePrimary, st.Role)
+	require.Equal(t, uint64(2), st.Term)
+
+	for i := 0; i < 3; i++ {
+		code, _ := send(t, "POST", fmt.Sprintf("%s/doc?id=after%d", next, i), fmt.Sprintf("after %d", i))
+		require.Equal(t, http.StatusOK, code)
+	}
+	waitInSync(t, next, other)
+	_, got := search(t, other, "after")
+	require.Len(t, got, 3)
+
+	// Once the partition heals, the old primary learns of the new term and
+	// steps down, and its diverged writes are replaced by the new
+	// primary's.
+	net.heal()
+	waitInSync(t, next, old, other)
+	st = replicationStatus(t, old)
+	require.Equal(t, roleFollower, st.Role)
+	require.Equal(t, uint64(2), st.Term)
+	require.Equal(t, next, st.Primary)
+
+	for _, replica := range replicas {
+		_, got := search(t, replica, "lost")
+		require.Empty(t, got)
+		_, got = search(t, replica, "after")
+		require.Len(t, got, 3)
+		_, got = search(t, replica, "before")
+		require.Len(t, got, 6)
+		require.Contains(t, got, "before 0")
+	}
+
+	code, _ = send(t, "POST", old+"/doc", "rejected")
+	require.Equal(t, http.StatusMisdirectedRequest, code)
+
+	// Promoting the primary again changes nothing.
+	code, _ = send(t, "POST", next+"/replication/promote", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, uint64(2), replicationStatus(t, next).Term)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fieldString = "string"
+	fieldNumber = "number"
+	fieldDate   = "date"
+)
+
+// Schema declares the fields of the documents of an index. Values of
+// declared fields must be of the declared type. Fields that aren't declared
+// are accepted, unless the schema is strict.
+type Schema struct {
+	Fields map[string]FieldSchema `json:"fields,omitempty"`
+	Strict bool                   `json:"strict,omitempty"`
+}
+
+// FieldSchema declares a field. Type is one of string, number and date,
+// with dates in one of the dateLayouts. A required field must have a value
+// in every document.
+type FieldSchema struct {
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// validate returns an error if the schema declares invalid fields.
+func (s *Schema) validate() error {
+	for name, f := range s.Fields {
+		if err := validateFieldName(name); err != nil {
+			return err
+		}
+		switch f.Type {
+		case fieldString, fieldNumber, fieldDate:
+		default:
+			return fmt.Errorf("invalid type '%s' of field '%s'", f.Type, name)
+		}
+	}
+	return nil
+}
+
+// check returns an error if the fields of a document don't follow the
+// schema. Reserved fields aren't checked. A nil schema accepts any fields.
+func (s *Schema) check(fields Fields) error {
+	if s == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		f, ok := s.Fields[name]
+		if !ok {
+			if s.Strict {
+				return fmt.Errorf("field '%s' isn't in the schema", name)
+			}
+			continue
+		}
+		for _, v := range fields[name] {
+			if !f.accepts(v) {
+				return fmt.Errorf("invalid %s '%s' in field '%s'", f.Type, v, name)
+			}
+		}
+	}
+
+	var missing []string
+	for name, f := range s.Fields {
+		if f.Required && len(fields[name]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing required fields %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// accepts returns if the value is of the type of the field.
+func (f FieldSchema) accepts(v string) bool {
+	switch f.Type {
+	case fieldNumber:
+		_, err := strconv.ParseFloat(v, 64)
+		return err == nil
+	case fieldDate:
+		for _, layout := range dateLayouts {
+			if _, err := time.Parse(layout, v); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
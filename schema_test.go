@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	schema := &Schema{
+		Fields: map[string]FieldSchema{
+			"title": {Type: fieldString, Required: true},
+			"price": {Type: fieldNumber},
+			"date":  {Type: fieldDate},
+		},
+	}
+	require.Nil(t, schema.validate())
+
+	require.Nil(t, schema.check(Fields{"title": {"Hi"}, "price": {"1.5"}, "date": {"2021-03-04"}, "other": {"x"}, "_id": {"1"}}))
+	require.EqualError(t, schema.check(Fields{"title": {"Hi"}, "price": {"cheap"}}), "invalid number 'cheap' in field 'price'")
+	require.EqualError(t, schema.check(Fields{"title": {"Hi"}, "date": {"yesterday"}}), "invalid date 'yesterday' in field 'date'")
+	require.EqualError(t, schema.check(Fields{"price": {"1"}}), "missing required fields title")
+
+	schema.Strict = true
+	require.EqualError(t, schema.check(Fields{"title": {"Hi"}, "other": {"x"}}), "field 'other' isn't in the schema")
+
+	var none *Schema
+	require.Nil(t, none.check(Fields{"anything": {"goes"}}))
+
+	require.NotNil(t, (&Schema{Fields: map[string]FieldSchema{"x": {Type: "blob"}}}).validate())
+	require.NotNil(t, (&Schema{Fields: map[string]FieldSchema{"_x": {Type: fieldString}}}).validate())
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Service interface {
@@ -14,82 +24,1762 @@ type Service interface {
 }
 
 type service struct {
-	addr    string
-	idx     Index
-	querier Querier
-	store   Store
+	addr      string
+	idx       Index
+	querier   Querier
+	store     Store
+	suggester Suggester
+
+	// duplicates finds near-duplicate documents.
+	duplicates *duplicates
+
+	// wal records changes before they're committed to the index and the
+	// store, if set. commitMu serializes commits.
+	wal      *writeAheadLog
+	commitMu sync.Mutex
+
+	// logOps is the number of changes in the write-ahead log and
+	// compactInterval how often it's checked for compaction, see Config.
+	// logOps is guarded by commitMu.
+	logOps          int
+	compactInterval time.Duration
+
+	// refreshInterval is how often committed changes are made visible to
+	// searches, see Config.
+	refreshInterval time.Duration
+
+	// snapshots holds the snapshots of the service, if set. While pins is
+	// non-zero a snapshot is being taken, and documents removed from the
+	// index are kept in the store until it's done. Both are guarded by
+	// commitMu.
+	snapshots *snapshotRepo
+	pins      int
+	unpinned  []int
+
+	// removed holds the documents replaced or deleted by committed
+	// changes. Searches find them until the next refresh, so they're
+	// removed from the store only then. Guarded by commitMu.
+	removed []int
+
+	// maxDocSize is the largest document accepted, see Config.
+	maxDocSize int64
+
+	// analyzer analyzes documents and queries, and schema is the schema
+	// documents must follow, if set.
+	analyzer *analyzer
+	schema   *Schema
+
+	// collections are the named indexes served with the service, if set.
+	collections *collections
+
+	// replication replicates the index to other nodes, if set.
+	replication *replicator
+
+	// done is closed when the service is closed.
+	done chan struct{}
+
+	// jobs runs documents posted for asynchronous indexing.
+	jobs *jobQueue
+
+	// results caches search responses and filters caches the documents
+	// matching a query.
+	results *lruCache
+	filters *lruCache
+}
+
+const (
+	resultCacheSize = 1000
+	filterCacheSize = 1000
+
+	// jobQueueSize is the number of documents that can wait for indexing
+	// and finishedJobs the number of finished jobs that can be looked up.
+	jobQueueSize = 100
+	finishedJobs = 10000
+)
+
+// Config holds the settings of a service.
+type Config struct {
+	// Addr is the address the service listens on, :5001 if empty.
+	Addr string
+
+	// WAL records changes, if set. It's replayed when the service starts.
+	WAL *writeAheadLog
+
+	// CompactInterval is how often the write-ahead log is checked for
+	// compaction, see service.compact. If zero, it's only compacted on
+	// request. Logs of replicated indexes aren't compacted.
+	CompactInterval time.Duration
+
+	// RefreshInterval is how often committed changes are made visible to
+	// searches. If zero, they're visible as soon as they're committed.
+	RefreshInterval time.Duration
+
+	// Snapshots is the repository snapshots are taken to, if set.
+	Snapshots *snapshotRepo
+
+	// MaxDocSize is the largest document accepted, in bytes. If zero,
+	// there's no limit.
+	MaxDocSize int64
+
+	// Analyzer analyzes documents and queries. If nil, the standard
+	// analyzer is used.
+	Analyzer *analyzer
+
+	// Schema is the schema documents must follow, if set.
+	Schema *Schema
+
+	// Collections are the named indexes served along with the index of
+	// the service under /indexes/, if set.
+	Collections *collections
+
+	// Replication replicates the index to other nodes, if set. It
+	// requires a write-ahead log. Named indexes aren't replicated.
+	Replication *ReplicationConfig
+}
+
+// NewService returns a service for the index and the store.
+func NewService(idx Index, querier Querier, store Store, cfg Config) Service {
+	a := cfg.Analyzer
+	if a == nil {
+		a = analyzers[defaultAnalyzer]
+	}
+	addr := cfg.Addr
+	if addr == "" {
+		addr = ":5001"
+	}
+	s := &service{
+		addr:            addr,
+		idx:             idx,
+		querier:         querier,
+		store:           store,
+		suggester:       NewSuggester(idx),
+		duplicates:      newDuplicates(idx),
+		wal:             cfg.WAL,
+		compactInterval: cfg.CompactInterval,
+		refreshInterval: cfg.RefreshInterval,
+		snapshots:       cfg.Snapshots,
+		maxDocSize:      cfg.MaxDocSize,
+		analyzer:        a,
+		schema:          cfg.Schema,
+		collections:     cfg.Collections,
+		done:            make(chan struct{}),
+		jobs:            newJobQueue(runtime.NumCPU(), jobQueueSize, finishedJobs),
+		results:         newLRUCache(resultCacheSize),
+		filters:         newLRUCache(filterCacheSize),
+	}
+	if cfg.Replication != nil {
+		s.replication = newReplicator(s, *cfg.Replication)
+	}
+	return s
+}
+
+func (s *service) Start() error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	return http.ListenAndServe(s.addr, s.Handler())
+}
+
+// open recovers the index and the store and starts the background work of
+// the service.
+func (s *service) open() error {
+	if err := s.recover(); err != nil {
+		return fmt.Errorf("recover: %w", err)
+	}
+	if s.replication != nil {
+		if err := s.replication.start(); err != nil {
+			return fmt.Errorf("start replication: %w", err)
+		}
+	}
+	if s.refreshInterval > 0 {
+		go s.refreshEvery(s.refreshInterval)
+	}
+	if s.compactInterval > 0 && s.wal != nil && s.replication == nil {
+		go s.compactEvery(s.compactInterval)
+	}
+	return nil
+}
+
+// close stops the background work of the service and closes its
+// write-ahead log once the queued jobs are done, so none of them commits to
+// a closed log.
+func (s *service) close() error {
+	close(s.done)
+	s.jobs.Close()
+	if s.replication != nil {
+		s.replication.stop()
+	}
+	if s.wal != nil {
+		return s.wal.Close()
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler serving the endpoints of the service.
+func (s *service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search/intersection", s.handleIntersectionSearch)
+	mux.HandleFunc("/search/phrase", s.handlePhraseSearch)
+	mux.HandleFunc("/search/union", s.handleUnionSearch)
+	mux.HandleFunc("/doc", s.handleDoc)
+	mux.HandleFunc("/doc/", s.handleDocPath)
+	mux.HandleFunc("/bulk", s.handleBulk)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.HandleFunc("/refresh", s.handleRefresh)
+	mux.HandleFunc("/snapshots", s.handleSnapshots)
+	mux.HandleFunc("/snapshots/", s.handleSnapshot)
+	mux.HandleFunc("/explain", s.handleExplain)
+	mux.HandleFunc("/suggest", s.handleSuggest)
+	mux.HandleFunc("/feedback", s.handleFeedback)
+
+	mux.HandleFunc("/admin/duplicates", s.handleDuplicates)
+	mux.HandleFunc("/admin/compact", s.handleCompact)
+
+	mux.HandleFunc("/debug/postings", s.handleDebugPostings)
+	mux.HandleFunc("/debug/cache", s.handleDebugCache)
+
+	if s.collections != nil {
+		mux.HandleFunc("/indexes", s.collections.handleIndexes)
+		mux.HandleFunc("/indexes/", s.collections.handleIndex)
+		mux.HandleFunc("/aliases", s.collections.handleAliases)
+		mux.HandleFunc("/aliases/", s.collections.handleAlias)
+		mux.HandleFunc("/reindex", s.handleReindex)
+	}
+
+	if s.replication != nil {
+		mux.HandleFunc("/replication", s.replication.handleStatus)
+		mux.HandleFunc("/replication/apply", s.replication.handleApply)
+		mux.HandleFunc("/replication/source", s.replication.handleSource)
+		mux.HandleFunc("/replication/promote", s.replication.handlePromote)
+		return s.replication.guard(mux)
+	}
+	return mux
+}
+
+// Document is a search hit. Collapsed is the number of near-duplicates of
+// the document left out of the results when they're collapsed, Index the
+// named index of the document in searches across indexes, and Node the
+// node holding the document in searches through a coordinator.
+type Document struct {
+	ID         int     `json:"id"`
+	ExternalID string  `json:"external_id,omitempty"`
+	Score      float64 `json:"score"`
+	Fields     Fields  `json:"fields,omitempty"`
+	Source     string  `json:"source"`
+	Collapsed  int     `json:"collapsed,omitempty"`
+	Index      string  `json:"index,omitempty"`
+	Node       string  `json:"node,omitempty"`
+}
+
+type GetResponseBody struct {
+	Hits      int        `json:"hits"`
+	Documents []Document `json:"documents"`
+	Next      string     `json:"next,omitempty"`
+}
+
+// parseQuery parses a query of the given type into the terms analyzed like
+// the documents of the index.
+func (s *service) parseQuery(typ, query string) ([]QueryTerm, error) {
+	terms, err := queryTypes(s.querier)[typ].parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.analyzer.filter(terms), nil
+}
+
+// match finds the documents matching the terms, using the filter cache.
+// Cached postings lists hold document IDs only.
+func (s *service) match(typ string, terms []QueryTerm) ([]Posting, error) {
+	if len(terms) == 0 {
+		// The query held stop words only.
+		return nil, nil
+	}
+	key := filterKey(typ, terms)
+	version := s.idx.Version()
+	if v, ok := s.filters.Get(key, version); ok {
+		return v.(bitset).postings(), nil
+	}
+
+	postings, err := queryTypes(s.querier)[typ].match(terms)
+	if errors.Is(err, errNotFound) {
+		// A term isn't in the index, so no document has all of them.
+		postings, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.filters.Put(key, version, newBitset(postings))
+	return postings, nil
+}
+
+// handleIntersectionSearch takes a search query and returns the matching documents
+// using intersect.
+func (s *service) handleIntersectionSearch(w http.ResponseWriter, req *http.Request) {
+	s.handleSearch(w, req, "intersection")
+}
+
+// handlePhraseSearch search for an exact phrase and returns the matching documents.
+func (s *service) handlePhraseSearch(w http.ResponseWriter, req *http.Request) {
+	s.handleSearch(w, req, "phrase")
+}
+
+// handleUnionSearch takes a search query and returns the documents matching
+// any of its terms.
+func (s *service) handleUnionSearch(w http.ResponseWriter, req *http.Request) {
+	s.handleSearch(w, req, "union")
+}
+
+// handleSearch runs a query of the given type, ranks the matching documents
+// and returns one page of them. Responses are cached until the index
+// changes.
+//
+// Hits are sorted by relevance unless the sort parameter lists fields to sort
+// by, see parseSort. The page is selected with the query parameters from and
+// size. Pages beyond the result window are fetched by passing the next cursor
+// of the previous page as the after parameter.
+func (s *service) handleSearch(w http.ResponseWriter, req *http.Request, typ string) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query().Get("query")
+	if len(query) == 0 {
+		log.Printf("no query provided")
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseSearchParams(req)
+	if err != nil {
+		log.Printf("search params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	terms, err := s.parseQuery(typ, query)
+	if err != nil {
+		log.Printf("parse query: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := queryKey(typ, terms) + "|" + params.key()
+	version := s.idx.Version()
+	if v, ok := s.results.Get(key, version); ok {
+		w.Write(v.([]byte))
+		return
+	}
+
+	postings, err := s.match(typ, terms)
+	if err != nil {
+		log.Printf("match: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := s.rankedPage(postings, terms, params)
+	if err != nil {
+		log.Printf("ranked page: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	s.results.Put(key, version, jsonResp)
+
+	w.Write(jsonResp)
+}
+
+// rankedPage ranks the documents in the postings list against the terms,
+// sorts them and loads the documents of the requested page from the store.
+func (s *service) rankedPage(postings []Posting, terms []QueryTerm, params searchParams) (GetResponseBody, error) {
+	hits, err := s.querier.Rank(postings, terms...)
+	if err != nil {
+		return GetResponseBody{}, fmt.Errorf("rank: %w", err)
+	}
+	sortByFields(s.idx, hits, params.sort)
+
+	var collapsed map[int]int
+	if params.collapse {
+		hits, collapsed = s.duplicates.collapse(hits)
+	}
+
+	res := GetResponseBody{
+		Hits:      len(hits),
+		Documents: []Document{},
+	}
+
+	pageHits := page(hits, params.from, params.size, params.after, params.sort)
+	for _, h := range pageHits {
+		source, err := s.store.Get(h.DocID)
+		if err != nil {
+			return GetResponseBody{}, fmt.Errorf("get: %w", err)
+		}
+		fields := s.idx.Fields(h.DocID)
+		res.Documents = append(res.Documents, Document{
+			ID:         h.DocID,
+			ExternalID: fields.first(externalIDField),
+			Score:      h.Score,
+			Fields:     fields.public(),
+			Source:     string(source),
+			Collapsed:  collapsed[h.DocID],
+		})
+	}
+
+	if n := len(pageHits); n != 0 && pageHits[n-1].DocID != hits[len(hits)-1].DocID {
+		last := pageHits[n-1]
+		res.Next = cursor{Values: last.Sort, DocID: last.DocID}.String()
+	}
+	return res, nil
+}
+
+// searchParams selects how search results are sorted and which page of them
+// is returned. If collapse is set, near-duplicates of hits ranked above them
+// are left out.
+type searchParams struct {
+	sort     []sortField
+	from     int
+	size     int
+	after    *cursor
+	collapse bool
+}
+
+// key returns the normalized form of the parameters, used as a cache key.
+func (p searchParams) key() string {
+	var after string
+	if p.after != nil {
+		after = p.after.String()
+	}
+	return fmt.Sprintf("%v|%d|%d|%s|%t", p.sort, p.from, p.size, after, p.collapse)
+}
+
+// parseSearchParams parses the sort and pagination parameters from the
+// request.
+func parseSearchParams(req *http.Request) (searchParams, error) {
+	fields, err := parseSort(req.URL.Query().Get("sort"))
+	if err != nil {
+		return searchParams{}, fmt.Errorf("parse sort: %w", err)
+	}
+
+	from, size, after, err := pageParams(req)
+	if err != nil {
+		return searchParams{}, fmt.Errorf("page params: %w", err)
+	}
+	if after != nil && len(after.Values) != len(fields) {
+		return searchParams{}, fmt.Errorf("cursor doesn't match sort")
+	}
+
+	var collapse bool
+	if v := req.URL.Query().Get("collapse"); v != "" {
+		collapse, err = strconv.ParseBool(v)
+		if err != nil {
+			return searchParams{}, fmt.Errorf("invalid collapse: %w", err)
+		}
+	}
+
+	return searchParams{
+		sort:     fields,
+		from:     from,
+		size:     size,
+		after:    after,
+		collapse: collapse,
+	}, nil
+}
+
+// pageParams parses the pagination parameters from the request.
+func pageParams(req *http.Request) (from, size int, after *cursor, err error) {
+	q := req.URL.Query()
+
+	size = defaultPageSize
+	if v := q.Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 0 {
+			return 0, 0, nil, fmt.Errorf("invalid size: %s", v)
+		}
+	}
+
+	if v := q.Get("from"); v != "" {
+		from, err = strconv.Atoi(v)
+		if err != nil || from < 0 {
+			return 0, 0, nil, fmt.Errorf("invalid from: %s", v)
+		}
+	}
+
+	if v := q.Get("after"); v != "" {
+		if from != 0 {
+			return 0, 0, nil, fmt.Errorf("from can't be combined with after")
+		}
+		c, err := parseCursor(v)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("invalid cursor: %w", err)
+		}
+		after = &c
+	}
+
+	// Checked without adding them, which could overflow.
+	if size > maxResultWindow || from > maxResultWindow-size {
+		return 0, 0, nil, fmt.Errorf("from+size must not exceed %d, use after for deeper pages", maxResultWindow)
+	}
+	return from, size, after, nil
+}
+
+type DocResponseBody struct {
+	ID         int    `json:"id"`
+	ExternalID string `json:"external_id,omitempty"`
+	Result     string `json:"result"`
+}
+
+const (
+	resultCreated = "created"
+	resultUpdated = "updated"
+	resultDeleted = "deleted"
+)
+
+// handlePost takes an document in the body, indexes it and stores it to disk.
+// It responds with the ID assigned to the document.
+//
+// With the query parameter async=true the document is queued for indexing
+// instead, and the response is 202 Accepted with the job indexing it, see
+// handleJob. If the queue is full the response is 429 Too Many Requests.
+//
+// A client-supplied ID can be given with the id query parameter. Posting a
+// document with an ID already in use replaces the existing document.
+//
+// Field values of the document are given as query parameters prefixed with
+// "field.", e.g. field.title=Home. Repeat a parameter for multiple values.
+//
+// Documents larger than the maximum document size are rejected with 413
+// Request Entity Too Large.
+func (s *service) handleDoc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, err := docFields(req)
+	if err != nil {
+		log.Printf("doc fields: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.schema.check(fields); err != nil {
+		log.Printf("schema: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	setReservedFields(fields, contentType, req.URL.Query().Get("id"))
+
+	async := false
+	if v := req.URL.Query().Get("async"); v != "" {
+		async, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Printf("invalid async: %v", err)
+			http.Error(w, "invalid async", http.StatusBadRequest)
+			return
+		}
+	}
+
+	refresh, err := parseRefresh(req)
+	if err != nil {
+		log.Printf("invalid refresh: %v", err)
+		http.Error(w, "invalid refresh", http.StatusBadRequest)
+		return
+	}
+
+	if s.maxDocSize > 0 && req.ContentLength > s.maxDocSize {
+		log.Printf("document too large: %d bytes", req.ContentLength)
+		http.Error(w, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := newMaxSizeReader(req.Body, s.maxDocSize)
+
+	if async {
+		// The body is spooled before the job is submitted, since it can't
+		// be read after the response is sent.
+		f, err := s.createSource()
+		if err != nil {
+			log.Printf("create source: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if _, err := io.Copy(f, body); err != nil {
+			s.discardSource(f)
+			log.Printf("read body: %v", err)
+			http.Error(w, "", errorStatus(err))
+			return
+		}
+
+		job, err := s.jobs.Submit(func() (interface{}, error) {
+			return s.indexSource(f, fields, refresh)
+		})
+		if err != nil {
+			s.discardSource(f)
+			log.Printf("submit: %v", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+
+		jsonResp, err := json.Marshal(job)
+		if err != nil {
+			log.Printf("marshal: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%d", job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(jsonResp)
+		return
+	}
+
+	res, err := s.indexDoc(body, fields, refresh)
+	if err != nil {
+		log.Printf("index doc: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
+
+// indexDoc indexes and stores a single document. The source is read from r
+// once: it's spooled to a source file while it's analyzed, and stored from
+// the file when the document is committed, so it's never held in memory as
+// a whole.
+func (s *service) indexDoc(r io.Reader, fields Fields, refresh bool) (DocResponseBody, error) {
+	f, err := s.createSource()
+	if err != nil {
+		return DocResponseBody{}, fmt.Errorf("create source: %w", err)
+	}
+
+	b := newBatch(s.analyzer)
+	err = b.Index(io.TeeReader(r, f), fields)
+	if err == nil {
+		// The analyzer may stop before the end of the source.
+		_, err = io.Copy(f, r)
+	}
+	if err != nil {
+		s.discardSource(f)
+		return DocResponseBody{}, err
+	}
+	return s.commitSource(f, b, fields, refresh)
+}
+
+// indexSource indexes and stores a document spooled to a source file.
+func (s *service) indexSource(f *os.File, fields Fields, refresh bool) (DocResponseBody, error) {
+	b := newBatch(s.analyzer)
+	_, err := f.Seek(0, io.SeekStart)
+	if err == nil {
+		err = b.Index(f, fields)
+	}
+	if err != nil {
+		s.discardSource(f)
+		return DocResponseBody{}, err
+	}
+	return s.commitSource(f, b, fields, refresh)
+}
+
+// commitSource commits a batch indexing the document spooled to the source
+// file. With a write-ahead log, a source of up to inlineSourceSize bytes is
+// kept in the record. A larger one is kept in the file, which the record
+// refers to, for replays until the log is compacted. Otherwise the file is
+// removed once the document is stored.
+func (s *service) commitSource(f *os.File, b *Batch, fields Fields, refresh bool) (DocResponseBody, error) {
+	op := walOp{
+		Action: actionIndex,
+		Fields: fields,
+		path:   f.Name(),
+	}
+	keep := false
+	if s.wal != nil {
+		source, ok, err := readInlineSource(f)
+		if err != nil {
+			s.discardSource(f)
+			return DocResponseBody{}, fmt.Errorf("read source: %w", err)
+		}
+		if ok {
+			op.Source = source
+			op.path = ""
+			f.Close()
+		} else {
+			keep = true
+			op.Blob = filepath.Base(f.Name())
+			if err := s.wal.closeSource(f); err != nil {
+				os.Remove(f.Name())
+				return DocResponseBody{}, fmt.Errorf("close source: %w", err)
+			}
+		}
+	} else {
+		f.Close()
+	}
+
+	results, err := s.commit(b, []walOp{op}, refresh)
+	if err != nil || !keep {
+		os.Remove(f.Name())
+	}
+	if err != nil {
+		return DocResponseBody{}, fmt.Errorf("commit: %w", err)
+	}
+	res := results[0]
+	if res.Err != nil {
+		return DocResponseBody{}, fmt.Errorf("commit: %w", res.Err)
+	}
+	return DocResponseBody{
+		ID:         res.ID,
+		ExternalID: fields.first(externalIDField),
+		Result:     indexResult(res),
+	}, nil
+}
+
+// readInlineSource reads the source spooled to the file, unless it's larger
+// than inlineSourceSize.
+func readInlineSource(f *os.File) ([]byte, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() > inlineSourceSize {
+		return nil, false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	source, err := io.ReadAll(f)
+	if err != nil {
+		return nil, false, err
+	}
+	return source, true, nil
+}
+
+// createSource creates a file to spool the source of a document to: in the
+// sources directory of the write-ahead log if there is one, and as a
+// temporary file otherwise.
+func (s *service) createSource() (*os.File, error) {
+	if s.wal != nil {
+		return s.wal.createSource()
+	}
+	return ioutil.TempFile("", "source-")
+}
+
+// discardSource closes and removes a source file that won't be committed.
+func (s *service) discardSource(f *os.File) {
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		log.Printf("remove source: %v", err)
+	}
+}
+
+// setReservedFields sets the metadata fields of a document about to be
+// indexed.
+func setReservedFields(fields Fields, contentType, externalID string) {
+	fields[contentTypeField] = []string{contentType}
+	fields[indexedAtField] = []string{time.Now().UTC().Format(time.RFC3339Nano)}
+	if externalID != "" {
+		fields[externalIDField] = []string{externalID}
+	}
+}
+
+// indexResult describes the outcome of indexing a document.
+func indexResult(res BatchResult) string {
+	if len(res.Removed) != 0 {
+		return resultUpdated
+	}
+	return resultCreated
+}
+
+// commit commits the changes to the index and the store as one atomic
+// operation. ops holds the changes of the batch, in the same order. The
+// changes become visible to searches on the next refresh, or at once if
+// refresh is set. With replication, only the primary commits changes.
+func (s *service) commit(b *Batch, ops []walOp, refresh bool) ([]BatchResult, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if s.replication != nil && !s.replication.isPrimary() {
+		return nil, errNotPrimary
+	}
+
+	results, err := s.apply(b, ops, s.wal)
+	if err != nil {
+		return nil, err
+	}
+	if s.replication != nil {
+		s.replication.notify()
+	}
+	if refresh || s.refreshInterval == 0 {
+		s.refresh()
+	}
+	return results, nil
+}
+
+// apply commits a batch in two phases. First, the transaction is prepared,
+// which assigns the document IDs, and the sources of the documents are
+// stored. Nothing refers to them until the transaction is committed, so if
+// storing fails they're removed again and the batch fails as a whole.
+//
+// The batch is then appended to the write-ahead log, if given, which is the
+// commit point: from then on, the changes are replayed after a crash.
+// Finally the transaction is committed to the index. If that fails, the
+// record is truncated from the log and the sources removed again. Replaced
+// or deleted documents are removed from the store on the next refresh.
+//
+// The caller must hold commitMu.
+func (s *service) apply(b *Batch, ops []walOp, wal *writeAheadLog) ([]BatchResult, error) {
+	txn, results := s.idx.Prepare(b)
+
+	var stored []int
+	rollback := func() {
+		for _, id := range stored {
+			if err := s.store.Delete(id); err != nil {
+				log.Printf("rollback: %v", err)
+			}
+		}
+	}
+
+	for i, res := range results {
+		if res.Err != nil || ops[i].Action == actionDelete {
+			continue
+		}
+		if err := s.putSource(ops[i], res.ID); err != nil {
+			rollback()
+			return nil, err
+		}
+		stored = append(stored, res.ID)
+	}
+
+	var n int
+	if wal != nil {
+		n = wal.Len()
+		if err := wal.Append(ops); err != nil {
+			rollback()
+			return nil, fmt.Errorf("append to wal: %w", err)
+		}
+	}
+
+	if err := s.idx.Commit(txn); err != nil {
+		if wal != nil {
+			if err := wal.Truncate(n); err != nil {
+				log.Printf("rollback: %v", err)
+			}
+		}
+		rollback()
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	if wal != nil {
+		s.logOps += len(ops)
+	}
+
+	for _, res := range results {
+		s.removed = append(s.removed, res.Removed...)
+	}
+	return results, nil
+}
+
+// putSource stores the source of the change as the document with the given
+// ID.
+func (s *service) putSource(op walOp, id int) error {
+	r, err := op.open()
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer r.Close()
+
+	if err := s.store.PutFromStream(r, id); err != nil {
+		return fmt.Errorf("put from stream: %w", err)
+	}
+	return nil
+}
+
+// removeFromStore removes a document no longer in the index from the store,
+// unless a snapshot is being taken. The caller must hold commitMu.
+func (s *service) removeFromStore(id int) {
+	if s.pins > 0 {
+		s.unpinned = append(s.unpinned, id)
+		return
+	}
+	if err := s.store.Delete(id); err != nil {
+		log.Printf("delete from store: %v", err)
+	}
+}
+
+// snapshot takes a snapshot of all committed documents. Commits are blocked
+// while the documents are listed, after which the snapshot is taken
+// alongside new commits.
+func (s *service) snapshot(name string) (SnapshotInfo, error) {
+	docs, unpin := s.pinDocs()
+	defer unpin()
+
+	return s.snapshots.Create(name, docs, s.store.Get)
+}
+
+// pinDocs refreshes the index and returns its documents with their fields.
+// Their sources are kept in the store, even if they're removed from the
+// index, until unpin is called.
+func (s *service) pinDocs() (docs []SnapshotDoc, unpin func()) {
+	s.commitMu.Lock()
+	s.refresh()
+	ids := s.idx.DocIDs()
+	docs = make([]SnapshotDoc, len(ids))
+	for i, id := range ids {
+		docs[i] = SnapshotDoc{
+			ID:     id,
+			Fields: s.idx.Fields(id),
+		}
+	}
+	s.pins++
+	s.commitMu.Unlock()
+
+	return docs, func() {
+		s.commitMu.Lock()
+		defer s.commitMu.Unlock()
+
+		s.pins--
+		if s.pins == 0 {
+			for _, id := range s.unpinned {
+				s.removeFromStore(id)
+			}
+			s.unpinned = nil
+		}
+	}
+}
+
+// refresh makes committed changes visible to searches and removes the
+// documents they replaced or deleted from the store. The caller must hold
+// commitMu.
+func (s *service) refresh() {
+	if err := s.refreshIndex(); err != nil {
+		log.Printf("refresh: %v", err)
+	}
+}
+
+// refreshIndex is refresh, returning the error.
+func (s *service) refreshIndex() error {
+	if _, err := s.idx.Refresh(); err != nil {
+		return err
+	}
+	for _, id := range s.removed {
+		s.removeFromStore(id)
+	}
+	s.removed = nil
+	return nil
+}
+
+// refreshEvery refreshes the index periodically.
+func (s *service) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.commitMu.Lock()
+			s.refresh()
+			s.commitMu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// recover rebuilds the index and the store by replaying the write-ahead log.
+func (s *service) recover() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	records, err := s.replay()
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %d records, %d documents in index", records, s.idx.DocCount())
+	return nil
+}
+
+// replay applies the records of the write-ahead log to the index and the
+// store, and returns the number of records. The caller must hold commitMu.
+func (s *service) replay() (int, error) {
+	records := 0
+	s.logOps = 0
+	err := s.wal.Replay(func(ops []walOp) error {
+		b := newBatch(s.analyzer)
+		for _, op := range ops {
+			if err := op.addTo(b); err != nil {
+				return err
+			}
+		}
+		if _, err := s.apply(b, ops, nil); err != nil {
+			return err
+		}
+		records++
+		s.logOps += len(ops)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.refresh()
+	return records, nil
+}
+
+// truncate removes the records from the one with the given number on from
+// the write-ahead log, and rebuilds the index from the records left. The
+// sources of the documents are stored again, replacing the stored ones;
+// sources of documents only in the removed records are left in the store,
+// unreferenced, until their IDs are reused. The caller must hold commitMu.
+func (s *service) truncate(n int) error {
+	if err := s.wal.Truncate(n); err != nil {
+		return err
+	}
+	s.idx.Reset()
+	s.duplicates.reset()
+	s.removed = nil
+	if _, err := s.replay(); err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	return nil
+}
+
+// handleRefresh makes committed changes visible to searches.
+func (s *service) handleRefresh(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.commitMu.Lock()
+	err := s.refreshIndex()
+	s.commitMu.Unlock()
+	if err != nil {
+		log.Printf("refresh: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseRefresh parses the refresh query parameter, which makes the changes
+// of a request visible to searches before the response is sent.
+func parseRefresh(req *http.Request) (bool, error) {
+	v := req.URL.Query().Get("refresh")
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// handleSnapshots lists the snapshots.
+func (s *service) handleSnapshots(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.snapshots == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		log.Printf("list snapshots: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(snapshots)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
+
+// handleSnapshot takes, describes or deletes the snapshot named in the path,
+// /snapshots/{name}, for PUT, GET and DELETE requests respectively.
+func (s *service) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	if s.snapshots == nil {
+		http.NotFound(w, req)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/snapshots/")
+	if !snapshotNameRe.MatchString(name) {
+		log.Printf("invalid snapshot name: %s", name)
+		http.Error(w, "invalid name", http.StatusBadRequest)
+		return
+	}
+
+	var info SnapshotInfo
+	var err error
+	switch req.Method {
+	case "PUT":
+		info, err = s.snapshot(name)
+		if errors.Is(err, errSnapshotExists) {
+			log.Printf("snapshot: %v", err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case "GET":
+		var snap Snapshot
+		snap, err = s.snapshots.Get(name)
+		info = snap.info()
+	case "DELETE":
+		err = s.snapshots.Delete(name)
+		if err == nil {
+			return
+		}
+	default:
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Printf("snapshot %s: %v", name, err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+
+	jsonResp, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
+
+// handleJob serves the status of the job with the ID given in the path,
+// /jobs/{id}.
+func (s *service) handleJob(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/jobs/"))
+	if err != nil {
+		log.Printf("invalid id: %v", err)
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.jobs.Get(id)
+	if err != nil {
+		log.Printf("get job: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+
+	jsonResp, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
+
+// Actions of a bulk request.
+const (
+	actionIndex  = "index"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// BulkAction is one line of a bulk request. Index adds a document, replacing
+// any existing document with the same ID. Update replaces an existing
+// document and fails if there is none. Delete removes a document and only
+// needs the ID.
+//
+// Source is the source of the document as text. A source that isn't valid
+// UTF-8, which a JSON string can't hold, is given base64 encoded as
+// SourceBase64 instead.
+type BulkAction struct {
+	Action       string `json:"action"`
+	ID           string `json:"id,omitempty"`
+	Source       string `json:"source,omitempty"`
+	SourceBase64 []byte `json:"source_base64,omitempty"`
+	Fields       Fields `json:"fields,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+}
+
+// BulkItem is the result of one action of a bulk request. Status is the
+// HTTP status the action would have had as a request of its own. Node is
+// the node the action was sent to in requests through a coordinator.
+type BulkItem struct {
+	Action     string `json:"action"`
+	ID         *int   `json:"id,omitempty"`
+	ExternalID string `json:"external_id,omitempty"`
+	Result     string `json:"result,omitempty"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Node       string `json:"node,omitempty"`
+}
+
+type BulkResponseBody struct {
+	Errors bool       `json:"errors"`
+	Items  []BulkItem `json:"items"`
+}
+
+// bulkLineLimit returns the length of the longest line of a bulk request
+// accepted with the given maximum document size: room for the source
+// base64 encoded, or as a JSON string with some characters escaped, and
+// for the rest of the action. If the size is zero, there's no limit.
+func bulkLineLimit(maxDocSize int64) int64 {
+	if maxDocSize == 0 {
+		return 0
+	}
+	return 2*maxDocSize + 64<<10
+}
+
+// readBulkLine reads the next line of a bulk request. A line longer than
+// limit bytes, if limit is non-zero, is skipped without being held in
+// memory and reported as too long.
+func readBulkLine(r *bufio.Reader, limit int64) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if limit > 0 && int64(len(line)+len(chunk)) > limit {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return line, tooLong, err
+		}
+	}
+}
+
+// handleBulk takes newline-delimited JSON actions in the body, see
+// BulkAction, and applies them to the index as a single batch. It responds
+// with the result of every action, in the order of the request. A failing
+// action doesn't fail the others. An action on a line longer than
+// bulkLineLimit fails with 413 Request Entity Too Large without being read
+// into memory.
+func (s *service) handleBulk(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	refresh, err := parseRefresh(req)
+	if err != nil {
+		log.Printf("invalid refresh: %v", err)
+		http.Error(w, "invalid refresh", http.StatusBadRequest)
+		return
+	}
+
+	b := newBatch(s.analyzer)
+	var ops []walOp
+	// changes maps the items to their changes in the batch. Items failing
+	// before they're added to the batch are mapped to -1.
+	var changes []int
+	var items []BulkItem
+
+	fail := func(item BulkItem, status int, err error) {
+		item.Status = status
+		item.Error = err.Error()
+		items = append(items, item)
+		changes = append(changes, -1)
+	}
+
+	r := bufio.NewReader(req.Body)
+	for {
+		line, tooLong, err := readBulkLine(r, bulkLineLimit(s.maxDocSize))
+		if err != nil && err != io.EOF {
+			log.Printf("read: %v", err)
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		if tooLong {
+			fail(BulkItem{}, http.StatusRequestEntityTooLarge, errDocTooLarge)
+		} else if len(bytes.TrimSpace(line)) != 0 {
+			var action BulkAction
+			if err := json.Unmarshal(line, &action); err != nil {
+				fail(BulkItem{}, http.StatusBadRequest, fmt.Errorf("invalid action: %w", err))
+			} else if item, op, err := bulkOp(action); err != nil {
+				fail(item, http.StatusBadRequest, err)
+			} else if s.maxDocSize > 0 && int64(len(op.Source)) > s.maxDocSize {
+				fail(item, http.StatusRequestEntityTooLarge, errDocTooLarge)
+			} else if err := s.schema.check(op.Fields); err != nil {
+				fail(item, http.StatusBadRequest, err)
+			} else if err := op.addTo(b); err != nil {
+				fail(item, http.StatusBadRequest, err)
+			} else {
+				items = append(items, item)
+				changes = append(changes, b.Len()-1)
+				ops = append(ops, op)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	var results []BatchResult
+	if len(ops) != 0 {
+		results, err = s.commit(b, ops, refresh)
+		if err != nil {
+			log.Printf("commit: %v", err)
+			http.Error(w, "", errorStatus(err))
+			return
+		}
+	}
+
+	resp := BulkResponseBody{
+		Items: items,
+	}
+	for i, change := range changes {
+		item := &resp.Items[i]
+		if change == -1 {
+			resp.Errors = true
+			continue
+		}
+
+		res := results[change]
+		if res.Err != nil {
+			resp.Errors = true
+			item.Status = errorStatus(res.Err)
+			item.Error = res.Err.Error()
+			continue
+		}
+
+		id := res.ID
+		item.ID = &id
+		switch {
+		case item.Action == actionDelete:
+			item.Result = resultDeleted
+			item.Status = http.StatusOK
+		case len(res.Removed) != 0:
+			item.Result = resultUpdated
+			item.Status = http.StatusOK
+		default:
+			item.Result = resultCreated
+			item.Status = http.StatusCreated
+		}
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
+
+// bulkOp validates the action and returns the change it makes.
+func bulkOp(action BulkAction) (BulkItem, walOp, error) {
+	item := BulkItem{
+		Action:     action.Action,
+		ExternalID: action.ID,
+	}
+
+	switch action.Action {
+	case actionIndex, actionUpdate:
+	case actionDelete:
+		if action.ID == "" {
+			return item, walOp{}, fmt.Errorf("delete requires an id")
+		}
+		return item, walOp{Action: actionDelete, ExternalID: action.ID}, nil
+	default:
+		return item, walOp{}, fmt.Errorf("unknown action '%s'", action.Action)
+	}
+
+	fields := make(Fields, len(action.Fields)+3)
+	for name, values := range action.Fields {
+		if err := validateFieldName(name); err != nil {
+			return item, walOp{}, err
+		}
+		fields[name] = values
+	}
+
+	source := []byte(action.Source)
+	if action.SourceBase64 != nil {
+		if action.Source != "" {
+			return item, walOp{}, fmt.Errorf("source and source_base64 can't both be given")
+		}
+		source = action.SourceBase64
+	}
+
+	contentType := action.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	setReservedFields(fields, contentType, action.ID)
+
+	return item, walOp{
+		Action: action.Action,
+		Fields: fields,
+		Source: source,
+	}, nil
+}
+
+// handleDocPath routes requests for a single document, addressed as
+// /doc/{id} for its source and /doc/{id}/{resource} for the rest.
+func (s *service) handleDocPath(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/doc/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		log.Printf("invalid id: %v", err)
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	var resource string
+	if len(parts) > 1 {
+		resource = strings.Join(parts[1:], "/")
+	}
+
+	switch resource {
+	case "":
+		s.handleGetDoc(w, req, id)
+	case "meta":
+		s.handleDocMeta(w, req, id)
+	case "similar":
+		s.handleSimilar(w, req, id)
+	case "termvector":
+		s.handleTermVector(w, req, id)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// errorStatus returns the HTTP status code for an error from the index or
+// the store.
+func errorStatus(err error) int {
+	if errors.Is(err, errNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, errDocTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, errNotPrimary) {
+		return http.StatusMisdirectedRequest
+	}
+	return http.StatusInternalServerError
+}
+
+var errDocTooLarge = errors.New("document too large")
+
+// maxSizeReader reads from r, and fails with errDocTooLarge if it holds
+// more than n bytes.
+type maxSizeReader struct {
+	r io.Reader
+	n int64
+}
+
+// newMaxSizeReader returns a reader failing after n bytes. If n is zero,
+// it's r itself.
+func newMaxSizeReader(r io.Reader, n int64) io.Reader {
+	if n == 0 {
+		return r
+	}
+	return &maxSizeReader{r: r, n: n}
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.r.Read(p)
+	if int64(n) > r.n {
+		return int(r.n), errDocTooLarge
+	}
+	r.n -= int64(n)
+	return n, err
 }
 
-func NewService(idx Index, querier Querier, store Store) Service {
-	return &service{
-		addr:    ":5001",
-		idx:     idx,
-		querier: querier,
-		store:   store,
+// handleGetDoc serves the stored source of the document with the given ID.
+// Metadata is sent as headers: the content type given when the document was
+// indexed, its size, the time it was indexed as Last-Modified and its number
+// of tokens as X-Token-Count. Conditional and range requests are supported.
+func (s *service) handleGetDoc(w http.ResponseWriter, req *http.Request, id int) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, err := s.store.Open(id)
+	if err != nil {
+		log.Printf("open: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
 	}
+	defer file.Close()
+
+	meta := s.docMeta(id)
+
+	// Documents are never changed once stored, so the ID and the time it
+	// was indexed identify the content.
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%x"`, id, meta.IndexedAt.UnixNano()))
+	w.Header().Set("Content-Type", meta.ContentType)
+	w.Header().Set("X-Token-Count", strconv.Itoa(meta.TokenCount))
+
+	http.ServeContent(w, req, "", meta.IndexedAt, file)
 }
 
-func (s *service) Start() error {
-	http.HandleFunc("/search/intersection", s.handleIntersectionSearch)
-	http.HandleFunc("/search/phrase", s.handlePhraseSearch)
-	http.HandleFunc("/doc", s.handleDoc)
+type DocMeta struct {
+	ID          int       `json:"id"`
+	ExternalID  string    `json:"external_id,omitempty"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	IndexedAt   time.Time `json:"indexed_at"`
+	TokenCount  int       `json:"token_count"`
+	Fields      Fields    `json:"fields,omitempty"`
+}
+
+// docMeta returns the metadata of the document with the given ID kept in
+// the index. The size is left for the caller to fill in.
+func (s *service) docMeta(id int) DocMeta {
+	fields := s.idx.Fields(id)
+	indexedAt, _ := time.Parse(time.RFC3339Nano, fields.first(indexedAtField))
+	return DocMeta{
+		ID:          id,
+		ExternalID:  fields.first(externalIDField),
+		ContentType: fields.first(contentTypeField),
+		IndexedAt:   indexedAt,
+		TokenCount:  s.idx.DocLength(id),
+		Fields:      fields.public(),
+	}
+}
+
+// handleDocMeta serves the metadata of the document with the given ID.
+func (s *service) handleDocMeta(w http.ResponseWriter, req *http.Request, id int) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, err := s.store.Open(id)
+	if err != nil {
+		log.Printf("open: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+	defer file.Close()
+
+	meta := s.docMeta(id)
+	meta.Size, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		log.Printf("seek: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResp, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 
-	http.HandleFunc("/debug/postings", s.handleDebugPostings)
+	w.Write(jsonResp)
+}
 
-	return http.ListenAndServe(s.addr, nil)
+type TermVectorResponseBody struct {
+	ID         int              `json:"id"`
+	Terms      []TermVectorTerm `json:"terms"`
+	Collection CollectionStats  `json:"collection"`
+	// Text is the text extracted from the document source, which the
+	// offsets of the terms point into.
+	Text *string `json:"text,omitempty"`
 }
 
-type Document struct {
-	ID     int    `json:"id"`
-	Source string `json:"source"`
+// TermVectorTerm holds the occurrences of a term in a document and its
+// statistics in the collection.
+type TermVectorTerm struct {
+	TermVectorEntry
+	DocFreq       int `json:"doc_freq"`
+	TotalTermFreq int `json:"total_term_freq"`
 }
 
-type GetResponseBody struct {
-	Hits      int        `json:"hits"`
-	Documents []Document `json:"documents"`
+type CollectionStats struct {
+	DocCount         int `json:"doc_count"`
+	SumTotalTermFreq int `json:"sum_total_term_freq"`
 }
 
-// handleIntersectionSearch takes a search query and returns the matching documents
-// using intersect.
-func (s *service) handleIntersectionSearch(w http.ResponseWriter, req *http.Request) {
+// handleTermVector serves the term vector of the document with the given
+// ID, along with collection statistics of its terms. Positions and offsets
+// are left out with positions=false and offsets=false. Offsets are byte
+// ranges in the text extracted from the source, which is included with
+// text=true.
+func (s *service) handleTermVector(w http.ResponseWriter, req *http.Request, id int) {
 	if req.Method != "GET" {
 		log.Printf("unsupported http method: %s", req.Method)
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
 	}
 
-	query := req.URL.Query().Get("query")
-	if len(query) == 0 {
-		log.Printf("no query provided")
-		http.Error(w, "", http.StatusBadRequest)
+	q := req.URL.Query()
+	positions := q.Get("positions") != "false"
+	offsets := q.Get("offsets") != "false"
+	withText := q.Get("text") == "true"
+
+	tv, err := s.idx.TermVector(id)
+	if err != nil {
+		log.Printf("term vector: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+
+	res := TermVectorResponseBody{
+		ID:    id,
+		Terms: make([]TermVectorTerm, 0, len(tv.Terms)),
+		Collection: CollectionStats{
+			DocCount:         s.idx.DocCount(),
+			SumTotalTermFreq: s.idx.SumTotalTermFreq(),
+		},
+	}
+	for _, e := range tv.Terms {
+		if !positions {
+			e.Positions = nil
+		}
+		if !offsets {
+			e.Offsets = nil
+		}
+		res.Terms = append(res.Terms, TermVectorTerm{
+			TermVectorEntry: e,
+			DocFreq:         s.idx.DocFreq(e.Term),
+			TotalTermFreq:   s.idx.TotalTermFreq(e.Term),
+		})
+	}
+	if withText {
+		text, err := s.extractedText(id)
+		if err != nil {
+			log.Printf("extract text: %v", err)
+			http.Error(w, "", errorStatus(err))
+			return
+		}
+		res.Text = &text
 	}
 
-	tokens := strings.Split(query, " ")
-	postings, err := s.querier.Intersection(tokens...)
+	jsonResp, err := json.Marshal(res)
 	if err != nil {
-		log.Printf("intersection: %v", err)
+		log.Printf("marshal: %v", err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	var docs []Document
-	for _, p := range postings {
-		source, err := s.store.Get(p.DocID)
+	w.Write(jsonResp)
+}
+
+// extractedText returns the text extracted from the source of the document
+// with the given ID when it was indexed.
+func (s *service) extractedText(id int) (string, error) {
+	file, err := s.store.Open(id)
+	if err != nil {
+		return "", fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	text, err := io.ReadAll(newExtractor(s.idx.Fields(id).first(contentTypeField), file))
+	if err != nil {
+		return "", fmt.Errorf("read: %w", err)
+	}
+	return string(text), nil
+}
+
+// ExpandedQueryResponseBody holds search results for a query generated by
+// the service, along with the terms of that query.
+type ExpandedQueryResponseBody struct {
+	Terms []QueryTerm `json:"terms"`
+	GetResponseBody
+}
+
+// handleSimilar finds documents similar to the document with the given ID,
+// by querying for its most distinctive terms. The terms are selected with
+// the min_tf, max_terms and min_df parameters, see similarParams. The
+// results are sorted and paged like search results.
+func (s *service) handleSimilar(w http.ResponseWriter, req *http.Request, id int) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, err := parseSimilarParams(req)
+	if err != nil {
+		log.Printf("similar params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseSearchParams(req)
+	if err != nil {
+		log.Printf("search params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tv, err := s.idx.TermVector(id)
+	if err != nil {
+		log.Printf("term vector: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+
+	res := ExpandedQueryResponseBody{
+		Terms: similarTerms(s.idx, tv.freqs(), p),
+		GetResponseBody: GetResponseBody{
+			Documents: []Document{},
+		},
+	}
+
+	if len(res.Terms) != 0 {
+		postings, err := s.querier.Union(tokens(res.Terms)...)
 		if err != nil {
-			log.Printf("get: %v", err)
+			log.Printf("union: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		res.GetResponseBody, err = s.rankedPage(withoutDoc(postings, id), res.Terms, params)
+		if err != nil {
+			log.Printf("ranked page: %v", err)
 			http.Error(w, "", http.StatusInternalServerError)
 			return
 		}
-		docs = append(docs, Document{
-			ID:     p.DocID,
-			Source: string(source),
-		})
 	}
 
-	jsonResp, err := json.Marshal(GetResponseBody{
-		Hits:      len(docs),
-		Documents: docs,
-	})
+	jsonResp, err := json.Marshal(res)
 	if err != nil {
 		log.Printf("marshal: %v", err)
 		http.Error(w, "", http.StatusInternalServerError)
@@ -99,45 +1789,195 @@ func (s *service) handleIntersectionSearch(w http.ResponseWriter, req *http.Requ
 	w.Write(jsonResp)
 }
 
-// handlePhraseSearch search for an exact phrase and returns the matching documents.
-func (s *service) handlePhraseSearch(w http.ResponseWriter, req *http.Request) {
+type FeedbackRequestBody struct {
+	Query       string `json:"query"`
+	Relevant    []int  `json:"relevant"`
+	NonRelevant []int  `json:"non_relevant"`
+	rocchioParams
+}
+
+// handleFeedback reformulates a query with the Rocchio algorithm, using
+// documents marked as relevant and non-relevant, and runs the reformulated
+// query. The request body is a FeedbackRequestBody. The results are sorted
+// and paged like search results.
+func (s *service) handleFeedback(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := FeedbackRequestBody{
+		rocchioParams: defaultRocchioParams,
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.Printf("decode: %v", err)
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if err := body.validate(); err != nil {
+		log.Printf("validate: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	terms, err := s.parseQuery("union", body.Query)
+	if err != nil {
+		log.Printf("parse query: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := parseSearchParams(req)
+	if err != nil {
+		log.Printf("search params: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	relevant, err := s.docVectors(body.Relevant)
+	if err != nil {
+		log.Printf("relevant vectors: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+	nonRelevant, err := s.docVectors(body.NonRelevant)
+	if err != nil {
+		log.Printf("non-relevant vectors: %v", err)
+		http.Error(w, "", errorStatus(err))
+		return
+	}
+
+	res := ExpandedQueryResponseBody{
+		Terms: rocchio(queryVector(terms), relevant, nonRelevant, body.rocchioParams),
+		GetResponseBody: GetResponseBody{
+			Documents: []Document{},
+		},
+	}
+
+	if len(res.Terms) != 0 {
+		postings, err := s.querier.Union(tokens(res.Terms)...)
+		if err != nil {
+			log.Printf("union: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		res.GetResponseBody, err = s.rankedPage(postings, res.Terms, params)
+		if err != nil {
+			log.Printf("ranked page: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	jsonResp, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
+
+// docVectors returns the tf-idf vectors of the documents with the given IDs.
+func (s *service) docVectors(ids []int) ([]termVector, error) {
+	out := make([]termVector, 0, len(ids))
+	for _, id := range ids {
+		tv, err := s.idx.TermVector(id)
+		if err != nil {
+			return nil, fmt.Errorf("term vector: %w", err)
+		}
+		out = append(out, tfidfVector(s.idx, tv.freqs()))
+	}
+	return out, nil
+}
+
+// parseSimilarParams parses the term selection parameters of a similar
+// documents request.
+func parseSimilarParams(req *http.Request) (similarParams, error) {
+	p := defaultSimilarParams
+	for name, dst := range map[string]*int{
+		"min_tf":    &p.minTermFreq,
+		"max_terms": &p.maxQueryTerms,
+		"min_df":    &p.minDocFreq,
+	} {
+		v := req.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return similarParams{}, fmt.Errorf("invalid %s: %s", name, v)
+		}
+		*dst = n
+	}
+	return p, nil
+}
+
+// handleExplain describes how the document with the given ID matches the
+// query and how its score is computed. The query type is given with the type
+// parameter and defaults to intersection.
+func (s *service) handleExplain(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		log.Printf("unsupported http method: %s", req.Method)
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
 	}
 
-	query := req.URL.Query().Get("query")
+	q := req.URL.Query()
+
+	query := q.Get("query")
 	if len(query) == 0 {
 		log.Printf("no query provided")
 		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(q.Get("id"))
+	if err != nil {
+		log.Printf("invalid id: %v", err)
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+
+	typ := q.Get("type")
+	if typ == "" {
+		typ = "intersection"
+	}
+	qt, ok := queryTypes(s.querier)[typ]
+	if !ok {
+		log.Printf("unknown query type: %s", typ)
+		http.Error(w, fmt.Sprintf("unknown query type '%s'", typ), http.StatusBadRequest)
+		return
+	}
+
+	terms, err := qt.parse(query)
+	if err == nil {
+		terms = s.analyzer.filter(terms)
+	}
+	if err != nil {
+		log.Printf("parse query: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	postings, err := s.querier.Phrase(query)
+	postings, err := s.match(typ, terms)
 	if err != nil {
-		log.Printf("phrase: %v", err)
+		log.Printf("match: %v", err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	var docs []Document
-	for _, p := range postings {
-		source, err := s.store.Get(p.DocID)
-		if err != nil {
-			log.Printf("get: %v", err)
-			http.Error(w, "", http.StatusInternalServerError)
-			return
-		}
-		docs = append(docs, Document{
-			ID:     p.DocID,
-			Source: string(source),
-		})
+	explanation, err := s.querier.Explain(postings, id, terms...)
+	if err != nil {
+		log.Printf("explain: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
 
-	jsonResp, err := json.Marshal(GetResponseBody{
-		Hits:      len(docs),
-		Documents: docs,
-	})
+	jsonResp, err := json.Marshal(explanation)
 	if err != nil {
 		log.Printf("marshal: %v", err)
 		http.Error(w, "", http.StatusInternalServerError)
@@ -147,33 +1987,137 @@ func (s *service) handlePhraseSearch(w http.ResponseWriter, req *http.Request) {
 	w.Write(jsonResp)
 }
 
-// handlePost takes an document in the body, indexes it and stores it to disk.
-func (s *service) handleDoc(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
+// handleSuggest completes the prefix given as a query parameter with terms
+// and titles from the index. The number of completions is set with size,
+// and fuzzy=true also completes prefixes with one typo.
+func (s *service) handleSuggest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
 		log.Printf("unsupported http method: %s", req.Method)
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
 	}
 
-	buf := bytes.Buffer{}
-	r := io.TeeReader(req.Body, &buf)
+	q := req.URL.Query()
+
+	prefix := q.Get("prefix")
+	if len(prefix) == 0 {
+		log.Printf("no prefix provided")
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	size := defaultPageSize
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("invalid size: %s", v)
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	fuzzy := q.Get("fuzzy") == "true"
 
-	id, err := s.idx.IndexDocument(r)
+	jsonResp, err := json.Marshal(s.suggester.Suggest(prefix, size, fuzzy))
 	if err != nil {
-		log.Printf("index document: %v", err)
+		log.Printf("marshal: %v", err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	r2 := bytes.NewReader(buf.Bytes())
-	err = s.store.PutFromStream(r2, id)
+	w.Write(jsonResp)
+}
+
+// fieldParamPrefix prefixes query parameters holding document field values.
+const fieldParamPrefix = "field."
+
+// docFields parses the document field values from the request. Field names
+// starting with an underscore are reserved, see validateFieldName.
+func docFields(req *http.Request) (Fields, error) {
+	fields := make(Fields)
+	for k, v := range req.URL.Query() {
+		if !strings.HasPrefix(k, fieldParamPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, fieldParamPrefix)
+		if err := validateFieldName(name); err != nil {
+			return nil, err
+		}
+		fields[name] = v
+	}
+	return fields, nil
+}
+
+// validateFieldName returns an error if the name can't be used for a field
+// given by clients.
+func validateFieldName(name string) error {
+	if name == "" || strings.HasPrefix(name, "_") {
+		return fmt.Errorf("invalid field name '%s'", name)
+	}
+	return nil
+}
+
+// DuplicateCluster is a group of duplicate documents.
+type DuplicateCluster struct {
+	IDs         []int    `json:"ids"`
+	ExternalIDs []string `json:"external_ids,omitempty"`
+}
+
+// DuplicatesResponseBody holds the groups of documents with identical
+// sources, if the store keeps track of them, and the clusters of
+// near-duplicate documents.
+type DuplicatesResponseBody struct {
+	Exact []DuplicateCluster `json:"exact,omitempty"`
+	Near  []DuplicateCluster `json:"near"`
+}
+
+// duplicateStore is implemented by stores keeping track of documents with
+// identical sources.
+type duplicateStore interface {
+	Duplicates() [][]int
+}
+
+// handleDuplicates serves the duplicate documents in the index.
+func (s *service) handleDuplicates(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var res DuplicatesResponseBody
+	if ds, ok := s.store.(duplicateStore); ok {
+		res.Exact = s.duplicateClusters(ds.Duplicates())
+	}
+	res.Near = s.duplicateClusters(s.duplicates.Clusters())
+
+	jsonResp, err := json.Marshal(res)
 	if err != nil {
-		log.Printf("put from stream: %v", err)
+		log.Printf("marshal: %v", err)
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(200)
+	w.Write(jsonResp)
+}
+
+// duplicateClusters looks up the external IDs of the documents in the
+// groups.
+func (s *service) duplicateClusters(groups [][]int) []DuplicateCluster {
+	out := []DuplicateCluster{}
+	for _, ids := range groups {
+		c := DuplicateCluster{
+			IDs: ids,
+		}
+		for _, id := range ids {
+			if ext := s.idx.Fields(id).first(externalIDField); ext != "" {
+				c.ExternalIDs = append(c.ExternalIDs, ext)
+			}
+		}
+		out = append(out, c)
+	}
+	return out
 }
 
 type PostingsBody struct {
@@ -215,3 +2159,29 @@ func (s *service) handleDebugPostings(w http.ResponseWriter, req *http.Request)
 
 	w.Write(jsonResp)
 }
+
+type CacheBody struct {
+	Results CacheStats `json:"results"`
+	Filters CacheStats `json:"filters"`
+}
+
+// handleDebugCache serves the hit and miss counters of the caches.
+func (s *service) handleDebugCache(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		log.Printf("unsupported http method: %s", req.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResp, err := json.Marshal(CacheBody{
+		Results: s.results.Stats(),
+		Filters: s.filters.Stats(),
+	})
+	if err != nil {
+		log.Printf("marshal: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(jsonResp)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// maxShards is the largest number of shards an index can have.
+const maxShards = 64
+
+// shardedIndex is an index split into shards, each an index of its own.
+// Documents are routed to a shard by a hash of their ID, so the shards hold
+// about as many documents each, and changes to different shards are applied
+// in parallel.
+//
+// IDs and external IDs are assigned by the sharded index, and the document
+// statistics it returns, like DocCount and DocFreq, are those of all shards
+// together.
+type shardedIndex struct {
+	// mu guards the fields below. Refreshes hold it while changing the
+	// shards, so searches holding it see all of a refresh or none of it.
+	mu sync.RWMutex
+
+	shards   []*index
+	nextID   int
+	external map[string]int
+	pending  []*Txn
+	version  uint64
+}
+
+// NewShardedIndex returns an index split into the given number of shards.
+// The number of shards can't be changed once documents are indexed.
+func NewShardedIndex(shards int) Index {
+	idx := &shardedIndex{
+		shards:   make([]*index, shards),
+		external: make(map[string]int),
+	}
+	for i := range idx.shards {
+		idx.shards[i] = NewIndex().(*index)
+	}
+	return idx
+}
+
+// validateShards returns an error if an index can't have the number of
+// shards.
+func validateShards(n int) error {
+	if n < 1 || n > maxShards {
+		return fmt.Errorf("shards must be between 1 and %d", maxShards)
+	}
+	return nil
+}
+
+// shardOf returns the number of the shard holding the document with the
+// given ID. IDs are assigned in sequence, so they're hashed by Fibonacci
+// hashing to spread them over the shards.
+func (idx *shardedIndex) shardOf(id int) int {
+	h := uint64(id) * 0x9e3779b97f4a7c15
+	return int((h >> 32) % uint64(len(idx.shards)))
+}
+
+func (idx *shardedIndex) shard(id int) *index {
+	return idx.shards[idx.shardOf(id)]
+}
+
+// each runs fn for every shard in parallel, and returns the first error.
+func (idx *shardedIndex) each(fn func(i int, shard *index) error) error {
+	errs := make([]error, len(idx.shards))
+	var wg sync.WaitGroup
+	for i, shard := range idx.shards {
+		wg.Add(1)
+		go func(i int, shard *index) {
+			defer wg.Done()
+			errs[i] = fn(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexDocument tokenizes the document from the reader and adds it to its
+// shard. It returns the ID of the new document.
+func (idx *shardedIndex) IndexDocument(r io.Reader) (int, error) {
+	doc, err := analyzers[defaultAnalyzer].analyze(r)
+	if err != nil {
+		return 0, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	id := idx.nextID
+	idx.nextID++
+
+	shard := idx.shard(id)
+	shard.mu.Lock()
+	shard.addAs(id, doc)
+	shard.version++
+	shard.mu.Unlock()
+
+	idx.version++
+	return id, nil
+}
+
+// Delete removes the document with the given ID from its shard.
+func (idx *shardedIndex) Delete(id int) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	shard := idx.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if ext := shard.values.get(id, externalIDField); len(ext) != 0 && idx.external[ext[0].Str] == id {
+		delete(idx.external, ext[0].Str)
+	}
+	if err := shard.remove(id); err != nil {
+		return err
+	}
+	shard.version++
+	idx.version++
+	return nil
+}
+
+// Prepare prepares the changes in the batch for committing, see
+// index.Prepare.
+func (idx *shardedIndex) Prepare(b *Batch) (*Txn, []BatchResult) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return prepare(b, idx.nextID, idx.external)
+}
+
+// Commit commits the transaction, see index.Commit.
+func (idx *shardedIndex) Commit(txn *Txn) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := txn.take(&idx.nextID, idx.external); err != nil {
+		return err
+	}
+	idx.pending = append(idx.pending, txn)
+	return nil
+}
+
+// shardChange is a change of a refresh, applied to one shard. A change
+// either adds a document or removes one.
+type shardChange struct {
+	id     int
+	op     batchOp
+	remove bool
+}
+
+// Refresh makes the changes of all committed transactions visible to
+// searches, see index.Refresh. The changes are split by shard, and the
+// shards are changed in parallel. Transactions removing documents that
+// aren't in the index are dropped and reported before any shard is
+// changed.
+func (idx *shardedIndex) Refresh() (bool, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if len(idx.pending) == 0 {
+		return false, nil
+	}
+
+	txns, checkErr := checkPending(idx.pending, func(id int) bool {
+		shard := idx.shard(id)
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		_, ok := shard.vectors[id]
+		return ok
+	})
+	changes := make([][]shardChange, len(idx.shards))
+	for _, txn := range txns {
+		i := 0
+		for _, res := range txn.results {
+			if res.Err != nil {
+				continue
+			}
+			op := txn.ops[i]
+			i++
+
+			if op.kind != opDelete {
+				s := idx.shardOf(res.ID)
+				changes[s] = append(changes[s], shardChange{id: res.ID, op: op})
+			}
+			for _, id := range res.Removed {
+				s := idx.shardOf(id)
+				changes[s] = append(changes[s], shardChange{id: id, remove: true})
+			}
+		}
+	}
+	err := idx.each(func(i int, shard *index) error {
+		if len(changes[i]) == 0 {
+			return nil
+		}
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		for _, c := range changes[i] {
+			if c.remove {
+				if err := shard.remove(c.id); err != nil {
+					return fmt.Errorf("remove: %w", err)
+				}
+				continue
+			}
+			shard.addAs(c.id, c.op.doc)
+			shard.values.set(c.id, c.op.fields)
+		}
+		shard.version++
+		return nil
+	})
+	idx.pending = nil
+	idx.version++
+	if err != nil {
+		return true, err
+	}
+	return true, checkErr
+}
+
+// Lookup returns the internal ID of the document with the given external ID.
+// Documents committed but not yet refreshed are included.
+func (idx *shardedIndex) Lookup(externalID string) (int, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	id, ok := idx.external[externalID]
+	return id, ok
+}
+
+// Postings returns the full postings list for the given token, merged from
+// the postings lists of all shards.
+func (idx *shardedIndex) Postings(token string) ([]Posting, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	lists := make([][]Posting, 0, len(idx.shards))
+	for _, shard := range idx.shards {
+		if postings, err := shard.Postings(token); err == nil {
+			lists = append(lists, postings)
+		}
+	}
+	if len(lists) == 0 {
+		return nil, errTokenNotInIndex(token)
+	}
+	return mergePostings(lists), nil
+}
+
+// mergePostings merges postings lists holding distinct documents into one
+// sorted by document ID.
+func mergePostings(lists [][]Posting) []Posting {
+	var n int
+	for _, l := range lists {
+		n += len(l)
+	}
+	out := make([]Posting, 0, n)
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DocID < out[j].DocID })
+	return out
+}
+
+// DocCount returns the number of documents in all shards.
+func (idx *shardedIndex) DocCount() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.docCount()
+}
+
+// docCount returns the number of documents in all shards. The caller must
+// hold mu.
+func (idx *shardedIndex) docCount() int {
+	var n int
+	for _, shard := range idx.shards {
+		n += shard.DocCount()
+	}
+	return n
+}
+
+// DocLength returns the number of tokens in the document with the given ID.
+func (idx *shardedIndex) DocLength(id int) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.shard(id).DocLength(id)
+}
+
+// SetFields replaces the field values of the document with the given ID.
+// If the fields hold an external ID, it's mapped to the document.
+func (idx *shardedIndex) SetFields(id int, fields Fields) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if ext := fields.first(externalIDField); ext != "" {
+		idx.external[ext] = id
+	}
+	shard := idx.shard(id)
+	shard.mu.Lock()
+	shard.values.set(id, fields)
+	shard.version++
+	shard.mu.Unlock()
+	idx.version++
+}
+
+// Fields returns the field values of the document with the given ID.
+func (idx *shardedIndex) Fields(id int) Fields {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.shard(id).Fields(id)
+}
+
+// DocValues returns the parsed values of a field of the document with the
+// given ID.
+func (idx *shardedIndex) DocValues(id int, field string) []DocValue {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.shard(id).DocValues(id, field)
+}
+
+// Version returns a number that changes whenever the index changes.
+func (idx *shardedIndex) Version() uint64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.version
+}
+
+// Reset removes all documents and pending transactions from the shards, like
+// for a single index.
+func (idx *shardedIndex) Reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, shard := range idx.shards {
+		shard.Reset()
+	}
+	idx.nextID = 0
+	idx.external = make(map[string]int)
+	idx.pending = nil
+	idx.version++
+}
+
+// Terms returns all tokens in any of the shards, in no particular order.
+func (idx *shardedIndex) Terms() []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, shard := range idx.shards {
+		for _, t := range shard.Terms() {
+			if !seen[t] {
+				seen[t] = true
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+// DocFreq returns the number of documents in all shards containing the
+// token.
+func (idx *shardedIndex) DocFreq(token string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.docFreq(token)
+}
+
+// docFreq returns the number of documents in all shards containing the
+// token. The caller must hold mu.
+func (idx *shardedIndex) docFreq(token string) int {
+	var n int
+	for _, shard := range idx.shards {
+		n += shard.DocFreq(token)
+	}
+	return n
+}
+
+// DocIDs returns the IDs of all documents in ascending order.
+func (idx *shardedIndex) DocIDs() []int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var out []int
+	for _, shard := range idx.shards {
+		out = append(out, shard.DocIDs()...)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// TermVector returns the terms of the document with the given ID.
+func (idx *shardedIndex) TermVector(id int) (TermVector, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.shard(id).TermVector(id)
+}
+
+// TotalTermFreq returns the total number of occurrences of the token in all
+// shards.
+func (idx *shardedIndex) TotalTermFreq(token string) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var n int
+	for _, shard := range idx.shards {
+		n += shard.TotalTermFreq(token)
+	}
+	return n
+}
+
+// SumTotalTermFreq returns the total number of tokens in all shards.
+func (idx *shardedIndex) SumTotalTermFreq() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var n int
+	for _, shard := range idx.shards {
+		n += shard.SumTotalTermFreq()
+	}
+	return n
+}
+
+// shardedQuerier runs queries against a sharded index by scattering them to
+// the shards in parallel and gathering the results. Hits are scored in
+// their shards with the document statistics of the whole index, so scores
+// are the same as if the index wasn't sharded.
+type shardedQuerier struct {
+	idx    *shardedIndex
+	shards []*querier
+
+	// whole queries the sharded index as one index, for explanations.
+	whole *querier
+}
+
+func newShardedQuerier(idx *shardedIndex) Querier {
+	q := &shardedQuerier{
+		idx:    idx,
+		shards: make([]*querier, len(idx.shards)),
+		whole:  newQuerier(idx),
+	}
+	for i, shard := range idx.shards {
+		q.shards[i] = newQuerier(shard)
+	}
+	return q
+}
+
+// scatter runs the query in every shard and merges the matching documents.
+// A shard can fail a query for a token it doesn't hold, which means it has
+// no matches: the query only fails if it fails in every shard.
+func (q *shardedQuerier) scatter(fn func(q *querier) ([]Posting, error)) ([]Posting, error) {
+	q.idx.mu.RLock()
+	defer q.idx.mu.RUnlock()
+
+	lists := make([][]Posting, len(q.shards))
+	errs := make([]error, len(q.shards))
+	q.idx.each(func(i int, _ *index) error {
+		lists[i], errs[i] = fn(q.shards[i])
+		return nil
+	})
+
+	var ok [][]Posting
+	for i, err := range errs {
+		if err == nil {
+			ok = append(ok, lists[i])
+		}
+	}
+	if len(ok) == 0 {
+		return nil, errs[0]
+	}
+	return mergePostings(ok), nil
+}
+
+// Intersection returns the documents in any shard containing all tokens.
+func (q *shardedQuerier) Intersection(tokens ...string) ([]Posting, error) {
+	return q.scatter(func(q *querier) ([]Posting, error) {
+		return q.Intersection(tokens...)
+	})
+}
+
+// Phrase returns the documents in any shard containing the phrase.
+func (q *shardedQuerier) Phrase(phrase string) ([]Posting, error) {
+	return q.scatter(func(q *querier) ([]Posting, error) {
+		return q.Phrase(phrase)
+	})
+}
+
+// Union returns the documents in any shard containing any of the tokens.
+func (q *shardedQuerier) Union(tokens ...string) ([]Posting, error) {
+	return q.scatter(func(q *querier) ([]Posting, error) {
+		return q.Union(tokens...)
+	})
+}
+
+// Rank scores the documents in their shards, with the document count and
+// the document frequencies of the terms taken from all shards, and merges
+// the hits, see querier.Rank.
+func (q *shardedQuerier) Rank(postings []Posting, terms ...QueryTerm) ([]Hit, error) {
+	q.idx.mu.RLock()
+	defer q.idx.mu.RUnlock()
+
+	n := q.idx.docCount()
+	dfs := make([]int, len(terms))
+	for i, t := range terms {
+		dfs[i] = q.idx.docFreq(t.Token)
+	}
+
+	byShard := make([][]Posting, len(q.shards))
+	for _, p := range postings {
+		s := q.idx.shardOf(p.DocID)
+		byShard[s] = append(byShard[s], p)
+	}
+
+	hits := make([][]Hit, len(q.shards))
+	err := q.idx.each(func(i int, _ *index) error {
+		if len(byShard[i]) == 0 {
+			return nil
+		}
+		termPostings, err := q.shards[i].termPostings(terms)
+		if err != nil {
+			return err
+		}
+		hits[i] = q.shards[i].score(byShard[i], terms, termPostings, n, dfs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Hit, 0, len(postings))
+	for _, h := range hits {
+		out = append(out, h...)
+	}
+	sortHits(out)
+	return out, nil
+}
+
+// Explain describes how Rank scores the document, see querier.Explain.
+func (q *shardedQuerier) Explain(postings []Posting, id int, terms ...QueryTerm) (Explanation, error) {
+	return q.whole.Explain(postings, id, terms...)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// indexAll indexes the documents in one batch, with external IDs doc{i}.
+func indexAll(t *testing.T, idx Index, docs []string) {
+	t.Helper()
+	var b Batch
+	for i, d := range docs {
+		require.Nil(t, b.Index(strings.NewReader(d), Fields{externalIDField: {fmt.Sprintf("doc%d", i)}}))
+	}
+	txn, _ := idx.Prepare(&b)
+	require.Nil(t, idx.Commit(txn))
+	_, err := idx.Refresh()
+	require.Nil(t, err)
+}
+
+// TestShardedIndex checks that a sharded index returns the same results
+// and scores as an index that isn't sharded.
+func TestShardedIndex(t *testing.T) {
+	words := []string{"red", "green", "blue", "fish", "bird", "cat", "dog", "tree"}
+	docs := make([]string, 100)
+	for i := range docs {
+		var doc []string
+		for j := 0; j < 3+i%5; j++ {
+			doc = append(doc, words[(i*7+j*3)%len(words)])
+		}
+		docs[i] = strings.Join(doc, " ")
+	}
+
+	plain := NewIndex()
+	sharded := NewShardedIndex(4)
+	indexAll(t, plain, docs)
+	indexAll(t, sharded, docs)
+
+	for _, shard := range sharded.(*shardedIndex).shards {
+		require.NotZero(t, shard.DocCount())
+	}
+	require.Equal(t, plain.DocCount(), sharded.DocCount())
+	require.Equal(t, plain.DocIDs(), sharded.DocIDs())
+	require.Equal(t, plain.DocFreq("fish"), sharded.DocFreq("fish"))
+	require.Equal(t, plain.SumTotalTermFreq(), sharded.SumTotalTermFreq())
+	require.ElementsMatch(t, plain.Terms(), sharded.Terms())
+	postings, err := sharded.Postings("fish")
+	require.Nil(t, err)
+	want, err := plain.Postings("fish")
+	require.Nil(t, err)
+	require.Equal(t, want, postings)
+
+	pq, sq := NewQuerier(plain), NewQuerier(sharded)
+	for _, query := range []string{"fish", "red fish", "blue^2 dog", "green bird cat", "red unknown"} {
+		for typ, qt := range queryTypes(pq) {
+			terms, err := qt.parse(query)
+			require.Nil(t, err)
+
+			want, wantErr := qt.match(terms)
+			got, err := queryTypes(sq)[typ].match(terms)
+			require.Equal(t, wantErr, err, "%s %s", typ, query)
+			require.Equal(t, len(want), len(got), "%s %s", typ, query)
+			for i := range want {
+				require.Equal(t, want[i].DocID, got[i].DocID)
+			}
+
+			wantHits, err := pq.Rank(want, terms...)
+			require.Nil(t, err)
+			hits, err := sq.Rank(got, terms...)
+			require.Nil(t, err)
+			require.Equal(t, wantHits, hits, "%s %s", typ, query)
+
+			if len(want) != 0 {
+				wantExpl, err := pq.Explain(want, want[0].DocID, terms...)
+				require.Nil(t, err)
+				expl, err := sq.Explain(got, want[0].DocID, terms...)
+				require.Nil(t, err)
+				require.Equal(t, wantExpl, expl)
+			}
+		}
+	}
+}
+
+func TestShardedIndexChanges(t *testing.T) {
+	idx := NewShardedIndex(3)
+	indexAll(t, idx, []string{"a b", "b c", "c d", "d e"})
+
+	// Replace doc0 and delete doc1, which end up in other shards than
+	// the documents replacing them.
+	var b Batch
+	require.Nil(t, b.Index(strings.NewReader("x y"), Fields{externalIDField: {"doc0"}}))
+	b.Delete("doc1")
+	txn, res := idx.Prepare(&b)
+	require.Equal(t, []BatchResult{{ID: 4, Removed: []int{0}}, {ID: 1, Removed: []int{1}}}, res)
+	require.Nil(t, idx.Commit(txn))
+
+	id, ok := idx.Lookup("doc0")
+	require.True(t, ok)
+	require.Equal(t, 4, id)
+	require.Equal(t, 4, idx.DocCount())
+
+	version := idx.Version()
+	changed, err := idx.Refresh()
+	require.Nil(t, err)
+	require.True(t, changed)
+	require.NotEqual(t, version, idx.Version())
+
+	require.Equal(t, []int{2, 3, 4}, idx.DocIDs())
+	require.Equal(t, Fields{externalIDField: {"doc0"}}, idx.Fields(4))
+	require.Equal(t, 2, idx.DocLength(4))
+	_, err = idx.Postings("a")
+	require.Equal(t, errTokenNotInIndex("a"), err)
+
+	require.Nil(t, idx.Delete(4))
+	_, ok = idx.Lookup("doc0")
+	require.False(t, ok)
+	require.Equal(t, errDocNotInIndex(4), idx.Delete(4))
+
+	// A transaction replacing a document that is gone by the time it's
+	// refreshed is dropped without changing any shard.
+	commit := func(source, externalID string) {
+		t.Helper()
+		var b Batch
+		require.Nil(t, b.Index(strings.NewReader(source), Fields{externalIDField: {externalID}}))
+		txn, _ := idx.Prepare(&b)
+		require.Nil(t, idx.Commit(txn))
+	}
+	commit("z", "doc2")
+	require.Nil(t, idx.Delete(2))
+	commit("w", "doc5")
+	changed, err = idx.Refresh()
+	require.NotNil(t, err)
+	require.True(t, changed)
+	require.Equal(t, []int{3, 6}, idx.DocIDs())
+
+	changed, err = idx.Refresh()
+	require.Nil(t, err)
+	require.False(t, changed)
+	require.Equal(t, []int{3, 6}, idx.DocIDs())
+}
+
+func TestValidateShards(t *testing.T) {
+	require.NotNil(t, validateShards(0))
+	require.Nil(t, validateShards(1))
+	require.Nil(t, validateShards(maxShards))
+	require.NotNil(t, validateShards(maxShards+1))
+}
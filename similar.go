@@ -0,0 +1,75 @@
+package main
+
+import "sort"
+
+// similarParams selects the terms of a document used to find similar
+// documents.
+type similarParams struct {
+	// minTermFreq is the minimum number of occurrences of a term in the
+	// document.
+	minTermFreq int
+
+	// maxQueryTerms is the maximum number of terms in the query.
+	maxQueryTerms int
+
+	// minDocFreq is the minimum number of documents in the index that
+	// must contain a term.
+	minDocFreq int
+}
+
+var defaultSimilarParams = similarParams{
+	minTermFreq:   2,
+	maxQueryTerms: 25,
+	minDocFreq:    5,
+}
+
+// similarTerms returns the most distinctive terms of a document, by tf-idf
+// against the index. Each term is boosted by its tf-idf relative to the most
+// distinctive term.
+func similarTerms(idx Index, freqs map[string]int, p similarParams) []QueryTerm {
+	n := idx.DocCount()
+
+	var terms []QueryTerm
+	for t, f := range freqs {
+		if f < p.minTermFreq {
+			continue
+		}
+		df := idx.DocFreq(t)
+		if df < p.minDocFreq {
+			continue
+		}
+		terms = append(terms, QueryTerm{
+			Token: t,
+			Boost: tf(f) * idf(n, df),
+		})
+	}
+
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Boost != terms[j].Boost {
+			return terms[i].Boost > terms[j].Boost
+		}
+		return terms[i].Token < terms[j].Token
+	})
+	if len(terms) > p.maxQueryTerms {
+		terms = terms[:p.maxQueryTerms]
+	}
+
+	if len(terms) != 0 {
+		top := terms[0].Boost
+		for i := range terms {
+			terms[i].Boost /= top
+		}
+	}
+	return terms
+}
+
+// withoutDoc returns the postings list without the document with the given ID.
+func withoutDoc(postings []Posting, id int) []Posting {
+	out := make([]Posting, 0, len(postings))
+	for _, p := range postings {
+		if p.DocID != id {
+			out = append(out, p)
+		}
+	}
+	return out
+}
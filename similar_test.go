@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimilarTerms(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []string{
+		"bike bike lanes in davis davis",
+		"davis bike shop",
+		"davis farmers market",
+		"davis",
+	} {
+		_, err := idx.IndexDocument(strings.NewReader(doc))
+		require.Nil(t, err)
+	}
+
+	freqs := map[string]int{"bike": 2, "davis": 2, "lanes": 1, "in": 1}
+
+	tests := []struct {
+		name string
+		p    similarParams
+		res  []string
+	}{
+		{
+			name: "distinctive terms first",
+			p:    similarParams{minTermFreq: 1, maxQueryTerms: 10, minDocFreq: 1},
+			res:  []string{"bike", "in", "lanes", "davis"},
+		},
+		{
+			name: "min term frequency",
+			p:    similarParams{minTermFreq: 2, maxQueryTerms: 10, minDocFreq: 1},
+			res:  []string{"bike", "davis"},
+		},
+		{
+			name: "min doc frequency",
+			p:    similarParams{minTermFreq: 1, maxQueryTerms: 10, minDocFreq: 3},
+			res:  []string{"davis"},
+		},
+		{
+			name: "max query terms",
+			p:    similarParams{minTermFreq: 1, maxQueryTerms: 1, minDocFreq: 1},
+			res:  []string{"bike"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms := similarTerms(idx, freqs, tt.p)
+			require.Equal(t, tt.res, tokens(terms))
+			require.Equal(t, 1.0, terms[0].Boost)
+		})
+	}
+}
+
+func TestWithoutDoc(t *testing.T) {
+	res := withoutDoc([]Posting{{DocID: 0}, {DocID: 1}, {DocID: 2}}, 1)
+	require.Equal(t, []Posting{{DocID: 0}, {DocID: 2}}, res)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot is a point-in-time copy of the documents of an index. Sources
+// are kept as content-addressed blobs shared between snapshots, so a
+// snapshot only adds the documents that changed since the previous ones.
+type Snapshot struct {
+	Name    string        `json:"name"`
+	Created time.Time     `json:"created"`
+	Docs    []SnapshotDoc `json:"docs"`
+}
+
+// SnapshotDoc is a document in a snapshot. Blob is the SHA-256 hash of its
+// source.
+type SnapshotDoc struct {
+	ID     int    `json:"id"`
+	Blob   string `json:"blob"`
+	Fields Fields `json:"fields,omitempty"`
+}
+
+// SnapshotInfo summarizes a snapshot. NewBlobs is the number of sources the
+// snapshot added to the repository when it was taken.
+type SnapshotInfo struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Docs     int       `json:"docs"`
+	NewBlobs int       `json:"new_blobs,omitempty"`
+}
+
+func (s Snapshot) info() SnapshotInfo {
+	return SnapshotInfo{
+		Name:    s.Name,
+		Created: s.Created,
+		Docs:    len(s.Docs),
+	}
+}
+
+var snapshotNameRe = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+var errSnapshotNotFound = func(name string) error { return fmt.Errorf("snapshot '%s' %w", name, errNotFound) }
+
+var errSnapshotExists = errors.New("snapshot already exists")
+
+// snapshotRepo is a directory of snapshots. Manifests are stored as
+// {name}.json and sources in blobs/ by hash.
+type snapshotRepo struct {
+	// mu keeps blobs from being removed while a snapshot is taken.
+	mu   sync.RWMutex
+	root string
+}
+
+func newSnapshotRepo(root string) (*snapshotRepo, error) {
+	if err := os.MkdirAll(filepath.Join(root, "blobs"), 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+	return &snapshotRepo{
+		root: root,
+	}, nil
+}
+
+func (r *snapshotRepo) manifestPath(name string) string {
+	return filepath.Join(r.root, name+".json")
+}
+
+func (r *snapshotRepo) blobPath(hash string) string {
+	return filepath.Join(r.root, "blobs", hash)
+}
+
+// putBlob stores the data unless the repository already holds it. It
+// returns the hash of the data and whether it was added.
+func (r *snapshotRepo) putBlob(data []byte) (string, bool, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	path := r.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, false, nil
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+// writeFileAtomic writes the file through a temporary file, so it's either
+// written completely or not at all.
+func writeFileAtomic(path string, data []byte) error {
+	return writeTemp(path, data, os.Rename)
+}
+
+// createFileAtomic is writeFileAtomic, failing with an error satisfying
+// os.IsExist if the file exists. The temporary file is linked to the path
+// rather than renamed over it, which only one of concurrent creates can do.
+func createFileAtomic(path string, data []byte) error {
+	return writeTemp(path, data, os.Link)
+}
+
+// writeTemp writes the data to a temporary file next to the path and moves
+// it there with move.
+func writeTemp(path string, data []byte, move func(tmp, path string) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("create temp: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	return move(tmp.Name(), path)
+}
+
+// Create takes a snapshot with the given name. get returns the source of a
+// document. Of concurrent creates of the same name, only one succeeds.
+func (r *snapshotRepo) Create(name string, docs []SnapshotDoc, get func(id int) ([]byte, error)) (SnapshotInfo, error) {
+	if !snapshotNameRe.MatchString(name) {
+		return SnapshotInfo{}, fmt.Errorf("invalid snapshot name '%s'", name)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, err := os.Stat(r.manifestPath(name)); err == nil {
+		return SnapshotInfo{}, errSnapshotExists
+	}
+
+	snap := Snapshot{
+		Name:    name,
+		Created: time.Now().UTC(),
+		Docs:    docs,
+	}
+	added := 0
+	for i, doc := range snap.Docs {
+		data, err := get(doc.ID)
+		if err != nil {
+			return SnapshotInfo{}, fmt.Errorf("get %d: %w", doc.ID, err)
+		}
+		hash, ok, err := r.putBlob(data)
+		if err != nil {
+			return SnapshotInfo{}, fmt.Errorf("put blob: %w", err)
+		}
+		if ok {
+			added++
+		}
+		snap.Docs[i].Blob = hash
+	}
+
+	manifest, err := json.Marshal(snap)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("marshal: %w", err)
+	}
+	if err := createFileAtomic(r.manifestPath(name), manifest); err != nil {
+		if os.IsExist(err) {
+			return SnapshotInfo{}, errSnapshotExists
+		}
+		return SnapshotInfo{}, fmt.Errorf("write manifest: %w", err)
+	}
+
+	info := snap.info()
+	info.NewBlobs = added
+	return info, nil
+}
+
+// Get reads the manifest of the snapshot with the given name.
+func (r *snapshotRepo) Get(name string) (Snapshot, error) {
+	if !snapshotNameRe.MatchString(name) {
+		return Snapshot{}, errSnapshotNotFound(name)
+	}
+
+	data, err := os.ReadFile(r.manifestPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Snapshot{}, errSnapshotNotFound(name)
+		}
+		return Snapshot{}, fmt.Errorf("read manifest: %w", err)
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return Snapshot{}, fmt.Errorf("unmarshal: %w", err)
+	}
+	return snap, nil
+}
+
+// Blob opens the source with the given hash.
+func (r *snapshotRepo) Blob(hash string) (io.ReadCloser, error) {
+	return os.Open(r.blobPath(hash))
+}
+
+// List returns the snapshots in the repository, oldest first.
+func (r *snapshotRepo) List() ([]SnapshotInfo, error) {
+	names, err := r.names()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]SnapshotInfo, 0, len(names))
+	for _, name := range names {
+		snap, err := r.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, snap.info())
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out, nil
+}
+
+func (r *snapshotRepo) names() ([]string, error) {
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return names, nil
+}
+
+// Delete removes the snapshot with the given name, along with the sources
+// no other snapshot refers to.
+func (r *snapshotRepo) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.Get(name); err != nil {
+		return err
+	}
+	if err := os.Remove(r.manifestPath(name)); err != nil {
+		return fmt.Errorf("remove manifest: %w", err)
+	}
+
+	names, err := r.names()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, name := range names {
+		snap, err := r.Get(name)
+		if err != nil {
+			return err
+		}
+		for _, doc := range snap.Docs {
+			used[doc.Blob] = true
+		}
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(r.root, "blobs"))
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
+	for _, b := range blobs {
+		if used[b.Name()] {
+			continue
+		}
+		if err := os.Remove(r.blobPath(b.Name())); err != nil {
+			return fmt.Errorf("remove blob: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreBatchSize is the number of documents per write-ahead log record
+// written by a restore.
+const restoreBatchSize = 100
+
+// restore writes the documents of the snapshot to an empty write-ahead log,
+// so a service started with the log comes up with the documents of the
+// snapshot. Documents keep their IDs.
+func restore(r *snapshotRepo, name string, wal *writeAheadLog) (int, error) {
+	snap, err := r.Get(name)
+	if err != nil {
+		return 0, err
+	}
+
+	records := 0
+	if err := wal.Replay(func([]walOp) error { records++; return nil }); err != nil {
+		return 0, fmt.Errorf("replay: %w", err)
+	}
+	if records != 0 {
+		return 0, fmt.Errorf("write-ahead log isn't empty")
+	}
+
+	sort.Slice(snap.Docs, func(i, j int) bool {
+		return snap.Docs[i].ID < snap.Docs[j].ID
+	})
+
+	var ops []walOp
+	for i, doc := range snap.Docs {
+		name, err := restoreSource(r, doc.Blob, wal)
+		if err != nil {
+			return 0, err
+		}
+
+		id := doc.ID
+		ops = append(ops, walOp{
+			Action: actionIndex,
+			Fields: doc.Fields,
+			Blob:   name,
+			DocID:  &id,
+		})
+		if len(ops) == restoreBatchSize || i == len(snap.Docs)-1 {
+			if err := wal.Append(ops); err != nil {
+				return 0, fmt.Errorf("append: %w", err)
+			}
+			ops = nil
+		}
+	}
+	return len(snap.Docs), nil
+}
+
+// restoreSource copies a source from the repository to the sources of the
+// write-ahead log, and returns its name there.
+func restoreSource(r *snapshotRepo, hash string, wal *writeAheadLog) (string, error) {
+	blob, err := r.Blob(hash)
+	if err != nil {
+		return "", fmt.Errorf("open blob: %w", err)
+	}
+	defer blob.Close()
+
+	f, err := wal.createSource()
+	if err != nil {
+		return "", fmt.Errorf("create source: %w", err)
+	}
+	if _, err := io.Copy(f, blob); err != nil {
+		f.Close()
+		return "", fmt.Errorf("copy blob: %w", err)
+	}
+	if err := wal.closeSource(f); err != nil {
+		return "", fmt.Errorf("close source: %w", err)
+	}
+	return filepath.Base(f.Name()), nil
+}
+
+// runRestore runs the restore command, which prepares a fresh instance to
+// start from a snapshot by writing its documents to the write-ahead log.
+func runRestore(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	repoPath := flags.String("snapshots", "./snapshots", "snapshot repository")
+	name := flags.String("name", "", "name of the snapshot to restore")
+	walPath := flags.String("wal", "./wal", "write-ahead log of the instance, must be empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+
+	repo, err := newSnapshotRepo(*repoPath)
+	if err != nil {
+		return fmt.Errorf("open repository: %w", err)
+	}
+	wal, err := openWAL(*walPath, syncNever, 0)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+	defer wal.Close()
+
+	n, err := restore(repo, *name, wal)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Restored %d documents from snapshot %s\n", n, *name)
+	return nil
+}
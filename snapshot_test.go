@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRepo(t *testing.T) {
+	repo, err := newSnapshotRepo(t.TempDir())
+	require.Nil(t, err)
+
+	sources := map[int][]byte{0: []byte("hello"), 1: []byte("world"), 2: []byte("hello")}
+	get := func(id int) ([]byte, error) { return sources[id], nil }
+
+	info, err := repo.Create("first", []SnapshotDoc{{ID: 0}, {ID: 1}, {ID: 2, Fields: Fields{"title": {"x"}}}}, get)
+	require.Nil(t, err)
+	require.Equal(t, 3, info.Docs)
+	require.Equal(t, 2, info.NewBlobs)
+
+	_, err = repo.Create("first", nil, get)
+	require.Equal(t, errSnapshotExists, err)
+	_, err = repo.Create("../first", nil, get)
+	require.NotNil(t, err)
+
+	// Only the changed document is added.
+	sources[1] = []byte("again")
+	info, err = repo.Create("second", []SnapshotDoc{{ID: 0}, {ID: 1}}, get)
+	require.Nil(t, err)
+	require.Equal(t, 1, info.NewBlobs)
+
+	snap, err := repo.Get("first")
+	require.Nil(t, err)
+	require.Equal(t, Fields{"title": {"x"}}, snap.Docs[2].Fields)
+	require.Equal(t, snap.Docs[0].Blob, snap.Docs[2].Blob)
+
+	list, err := repo.List()
+	require.Nil(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "first", list[0].Name)
+
+	// Deleting the first snapshot keeps the blobs the second refers to.
+	require.Nil(t, repo.Delete("first"))
+	blobs, err := os.ReadDir(filepath.Join(repo.root, "blobs"))
+	require.Nil(t, err)
+	require.Len(t, blobs, 2)
+
+	_, err = repo.Get("first")
+	require.Equal(t, errSnapshotNotFound("first"), err)
+	require.Equal(t, errSnapshotNotFound("first"), repo.Delete("first"))
+}
+
+func TestSnapshotCreateConcurrent(t *testing.T) {
+	repo, err := newSnapshotRepo(t.TempDir())
+	require.Nil(t, err)
+
+	// Every create gets past the check for an existing snapshot before any
+	// of them writes its manifest.
+	const creates = 4
+	var entered sync.WaitGroup
+	entered.Add(creates)
+	get := func(id int) ([]byte, error) {
+		entered.Done()
+		entered.Wait()
+		return []byte("hello"), nil
+	}
+
+	errs := make(chan error, creates)
+	for i := 0; i < creates; i++ {
+		go func() {
+			_, err := repo.Create("same", []SnapshotDoc{{ID: 0}}, get)
+			errs <- err
+		}()
+	}
+	created := 0
+	for i := 0; i < creates; i++ {
+		err := <-errs
+		if err == nil {
+			created++
+			continue
+		}
+		require.Equal(t, errSnapshotExists, err)
+	}
+	require.Equal(t, 1, created)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := newSnapshotRepo(filepath.Join(dir, "snapshots"))
+	require.Nil(t, err)
+
+	s := newTestService(t, filepath.Join(dir, "store"), nil)
+	s.snapshots = repo
+	for i := 0; i < 5; i++ {
+		_, err := s.indexDoc(strings.NewReader(fmt.Sprintf("hello %d", i)), Fields{externalIDField: {fmt.Sprint(i)}}, false)
+		require.Nil(t, err)
+	}
+	_, err = s.indexDoc(strings.NewReader("goodbye"), Fields{externalIDField: {"1"}}, false)
+	require.Nil(t, err)
+
+	info, err := s.snapshot("snap")
+	require.Nil(t, err)
+	require.Equal(t, 5, info.Docs)
+
+	// Changes after the snapshot was taken aren't in it.
+	_, err = s.indexDoc(strings.NewReader("later"), Fields{externalIDField: {"2"}}, false)
+	require.Nil(t, err)
+
+	w, err := openWAL(filepath.Join(dir, "wal"), syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	n, err := restore(repo, "snap", w)
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
+
+	_, err = restore(repo, "snap", w)
+	require.NotNil(t, err)
+
+	restored := newTestService(t, filepath.Join(dir, "restored"), w)
+	require.Nil(t, restored.recover())
+	require.Equal(t, []int{0, 2, 3, 4, 5}, restored.idx.DocIDs())
+	for _, id := range restored.idx.DocIDs() {
+		source, err := restored.store.Get(id)
+		require.Nil(t, err)
+		if id == 5 {
+			require.Equal(t, "goodbye", string(source))
+			require.Equal(t, "1", restored.idx.Fields(id).first(externalIDField))
+		} else {
+			require.Equal(t, fmt.Sprintf("hello %d", id), string(source))
+		}
+	}
+	id, ok := restored.idx.Lookup("1")
+	require.True(t, ok)
+	require.Equal(t, 5, id)
+}
+
+func TestSnapshotPinsStore(t *testing.T) {
+	s := newTestService(t, filepath.Join(t.TempDir(), "store"), nil)
+	_, err := s.indexDoc(strings.NewReader("hello"), Fields{externalIDField: {"a"}}, false)
+	require.Nil(t, err)
+
+	// While a snapshot is being taken, replaced documents stay in the
+	// store.
+	s.pins++
+	_, err = s.indexDoc(strings.NewReader("goodbye"), Fields{externalIDField: {"a"}}, false)
+	require.Nil(t, err)
+	_, err = s.store.Get(0)
+	require.Nil(t, err)
+	require.Equal(t, []int{0}, s.unpinned)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// scoreField sorts hits by relevance.
+	scoreField = "_score"
+
+	// idField sorts hits by document ID.
+	idField = "_id"
+)
+
+// sortField is one key of a sort specification.
+type sortField struct {
+	Field string
+	Desc  bool
+}
+
+// defaultSort ranks hits by relevance.
+var defaultSort = []sortField{{Field: scoreField, Desc: true}}
+
+// parseSort parses a comma separated sort specification such as
+// "modified:desc,title". Fields sort ascending unless suffixed with :desc,
+// except _score which sorts descending by default.
+func parseSort(s string) ([]sortField, error) {
+	if s == "" {
+		return defaultSort, nil
+	}
+
+	var out []sortField
+	for _, key := range strings.Split(s, ",") {
+		parts := strings.SplitN(key, ":", 2)
+		f := sortField{
+			Field: parts[0],
+			Desc:  parts[0] == scoreField,
+		}
+		if f.Field == "" {
+			return nil, fmt.Errorf("empty sort field in '%s'", s)
+		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "asc":
+				f.Desc = false
+			case "desc":
+				f.Desc = true
+			default:
+				return nil, fmt.Errorf("invalid sort order '%s' for field '%s'", parts[1], f.Field)
+			}
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// sortByFields computes the sort values of the hits and sorts them by the
+// fields. Hits with equal values are ordered by ascending document ID.
+func sortByFields(idx Index, hits []Hit, fields []sortField) {
+	for i := range hits {
+		hits[i].Sort = sortValues(idx, hits[i], fields)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return compareHits(fields, hits[i], hits[j]) < 0
+	})
+}
+
+// sortValues returns the values the hit is sorted by.
+func sortValues(idx Index, h Hit, fields []sortField) []DocValue {
+	out := make([]DocValue, 0, len(fields))
+	for _, f := range fields {
+		switch f.Field {
+		case scoreField:
+			out = append(out, DocValue{Kind: kindNumber, Num: h.Score})
+		case idField:
+			out = append(out, DocValue{Kind: kindNumber, Num: float64(h.DocID)})
+		default:
+			out = append(out, sortValue(idx.DocValues(h.DocID, f.Field), f.Desc))
+		}
+	}
+	return out
+}
+
+// compareHits returns -1, 0 or 1 depending on whether a sorts before, equal
+// to or after b. Hits are compared by their sort values and then by document
+// ID.
+func compareHits(fields []sortField, a, b Hit) int {
+	for i, f := range fields {
+		if c := compareSortValues(a.Sort[i], b.Sort[i], f.Desc); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a.DocID < b.DocID:
+		return -1
+	case a.DocID > b.DocID:
+		return 1
+	}
+	return 0
+}
+
+// compareSortValues compares two sort values in the given direction.
+// Documents missing the value always sort last.
+func compareSortValues(a, b DocValue, desc bool) int {
+	switch {
+	case a.Kind == kindMissing && b.Kind == kindMissing:
+		return 0
+	case a.Kind == kindMissing:
+		return 1
+	case b.Kind == kindMissing:
+		return -1
+	}
+
+	c := compareDocValues(a, b)
+	if desc {
+		return -c
+	}
+	return c
+}
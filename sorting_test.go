@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		res  []sortField
+		err  error
+	}{
+		{
+			name: "default",
+			res:  defaultSort,
+		},
+		{
+			name: "multiple keys",
+			s:    "modified:desc,title,_score",
+			res: []sortField{
+				{Field: "modified", Desc: true},
+				{Field: "title"},
+				{Field: "_score", Desc: true},
+			},
+		},
+		{
+			name: "explicit ascending score",
+			s:    "_score:asc",
+			res:  []sortField{{Field: "_score"}},
+		},
+		{
+			name: "invalid order",
+			s:    "title:up",
+			err:  fmt.Errorf("invalid sort order 'up' for field 'title'"),
+		},
+		{
+			name: "empty field",
+			s:    "title,",
+			err:  fmt.Errorf("empty sort field in 'title,'"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := parseSort(tt.s)
+			require.Equal(t, tt.err, err)
+			require.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestSortByFields(t *testing.T) {
+	idx := NewIndex()
+	idx.SetFields(0, Fields{"title": {"b"}, "modified": {"2021-01-02"}})
+	idx.SetFields(1, Fields{"title": {"a"}, "modified": {"2021-01-02"}})
+	idx.SetFields(2, Fields{"title": {"c"}, "modified": {"2021-03-01"}})
+	idx.SetFields(3, Fields{"title": {"d"}})
+
+	tests := []struct {
+		name   string
+		fields []sortField
+		res    []int
+	}{
+		{
+			name:   "ascending string",
+			fields: []sortField{{Field: "title"}},
+			res:    []int{1, 0, 2, 3},
+		},
+		{
+			name:   "descending date, missing last",
+			fields: []sortField{{Field: "modified", Desc: true}},
+			res:    []int{2, 0, 1, 3},
+		},
+		{
+			name:   "tie-break on second key",
+			fields: []sortField{{Field: "modified"}, {Field: "title", Desc: true}},
+			res:    []int{0, 1, 2, 3},
+		},
+		{
+			name:   "score then document ID",
+			fields: defaultSort,
+			res:    []int{3, 0, 1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := []Hit{
+				{DocID: 0, Score: 1},
+				{DocID: 1, Score: 1},
+				{DocID: 2, Score: 1},
+				{DocID: 3, Score: 2},
+			}
+			sortByFields(idx, hits, tt.fields)
+
+			var ids []int
+			for _, h := range hits {
+				ids = append(ids, h.DocID)
+			}
+			require.Equal(t, tt.res, ids)
+		})
+	}
+}
@@ -10,7 +10,40 @@ import (
 
 type Store interface {
 	Get(id int) ([]byte, error)
+	Open(id int) (io.ReadSeekCloser, error)
 	PutFromStream(r io.Reader, id int) error
+	Delete(id int) error
+}
+
+var errDocNotInStore = func(id int) error { return fmt.Errorf("document %d %w in store", id, errNotFound) }
+
+// Types of stores.
+const (
+	storeFiles  = "files"
+	storePacked = "packed"
+)
+
+// openStore returns a new store of the given type in the directory: files
+// for a file per document, or packed for pack files, see NewPackedStore.
+// With dedup, identical documents are stored once.
+func openStore(typ, root string, dedup bool) (Store, error) {
+	var store Store
+	var err error
+	switch typ {
+	case storeFiles:
+		store, err = NewStore(root)
+	case storePacked:
+		store, err = NewPackedStore(root)
+	default:
+		return nil, fmt.Errorf("unknown store '%s'", typ)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dedup {
+		store = NewDedupStore(store)
+	}
+	return store, nil
 }
 
 type store struct {
@@ -34,9 +67,9 @@ func NewStore(root string) (Store, error) {
 }
 
 func (s *store) Get(id int) ([]byte, error) {
-	file, err := os.Open(fmt.Sprintf("%s/%d", s.root, id))
+	file, err := s.Open(id)
 	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
+		return nil, err
 	}
 	defer file.Close()
 
@@ -48,19 +81,39 @@ func (s *store) Get(id int) ([]byte, error) {
 	return bytes, nil
 }
 
-func (s *store) PutFromStream(r io.Reader, id int) error {
-	log.Printf("id: %d\n", id)
-	bytes, err := ioutil.ReadAll(r)
+// Open opens the document with the given ID for reading.
+func (s *store) Open(id int) (io.ReadSeekCloser, error) {
+	file, err := os.Open(fmt.Sprintf("%s/%d", s.root, id))
 	if err != nil {
-		return fmt.Errorf("read all: %w", err)
+		if os.IsNotExist(err) {
+			return nil, errDocNotInStore(id)
+		}
+		return nil, fmt.Errorf("open: %w", err)
 	}
+	return file, nil
+}
 
+func (s *store) PutFromStream(r io.Reader, id int) error {
+	log.Printf("id: %d\n", id)
 	file, err := os.Create(fmt.Sprintf("%s/%d", s.root, id))
 	if err != nil {
 		return fmt.Errorf("create: %w", err)
 	}
 	defer file.Close()
 
-	file.Write(bytes)
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the document with the given ID.
+func (s *store) Delete(id int) error {
+	if err := os.Remove(fmt.Sprintf("%s/%d", s.root, id)); err != nil {
+		if os.IsNotExist(err) {
+			return errDocNotInStore(id)
+		}
+		return fmt.Errorf("remove: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "store"))
+	require.Nil(t, err)
+	testStore(t, s)
+}
+
+func TestPackedStore(t *testing.T) {
+	s, err := NewPackedStore(filepath.Join(t.TempDir(), "store"))
+	require.Nil(t, err)
+	testStore(t, s)
+}
+
+func TestDedupStore(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "store"))
+	require.Nil(t, err)
+	testStore(t, NewDedupStore(s))
+}
+
+// TestDedupStoreShared stores identical documents and checks that they share
+// their source until the last of them is deleted.
+func TestDedupStoreShared(t *testing.T) {
+	backing, err := NewStore(filepath.Join(t.TempDir(), "store"))
+	require.Nil(t, err)
+	s := NewDedupStore(backing).(*dedupStore)
+
+	require.Nil(t, s.PutFromStream(strings.NewReader("hello"), 0))
+	require.Nil(t, s.PutFromStream(strings.NewReader("world"), 1))
+	require.Nil(t, s.PutFromStream(strings.NewReader("hello"), 2))
+	require.Nil(t, s.PutFromStream(strings.NewReader("hello"), 3))
+	require.Equal(t, [][]int{{0, 2, 3}}, s.Duplicates())
+
+	_, err = backing.Get(2)
+	require.Equal(t, errDocNotInStore(2), err)
+
+	// The source stays while documents refer to it, even when the document
+	// it was stored as is gone.
+	require.Nil(t, s.Delete(0))
+	b, err := s.Get(2)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(b))
+	require.Equal(t, [][]int{{2, 3}}, s.Duplicates())
+
+	require.Nil(t, s.Delete(2))
+	require.Nil(t, s.Delete(3))
+	_, err = backing.Get(0)
+	require.Equal(t, errDocNotInStore(0), err)
+	require.Empty(t, s.Duplicates())
+}
+
+// TestDedupStoreReplace stores documents again under IDs already in use, as
+// a replay does, and checks that no source is lost.
+func TestDedupStoreReplace(t *testing.T) {
+	backing, err := NewStore(filepath.Join(t.TempDir(), "store"))
+	require.Nil(t, err)
+	s := NewDedupStore(backing).(*dedupStore)
+
+	require.Nil(t, s.PutFromStream(strings.NewReader("hello"), 0))
+	require.Nil(t, s.PutFromStream(strings.NewReader("hello"), 1))
+	require.Nil(t, s.PutFromStream(strings.NewReader("world"), 2))
+
+	// The same source under the same IDs.
+	for id, source := range []string{"hello", "hello", "world"} {
+		require.Nil(t, s.PutFromStream(strings.NewReader(source), id))
+	}
+	require.Equal(t, [][]int{{0, 1}}, s.Duplicates())
+
+	// Another source under the ID the shared source is stored as.
+	owner, _ := s.owner(1)
+	require.Nil(t, s.PutFromStream(strings.NewReader("other"), owner))
+
+	for id, source := range map[int]string{owner: "other", 1 - owner: "hello", 2: "world"} {
+		b, err := s.Get(id)
+		require.Nil(t, err)
+		require.Equal(t, source, string(b), id)
+	}
+	require.Empty(t, s.Duplicates())
+}
+
+// TestPackedStoreBlocks stores documents spanning several blocks and pack
+// files.
+func TestPackedStoreBlocks(t *testing.T) {
+	s, err := newPackedStore(filepath.Join(t.TempDir(), "store"), 100, 200)
+	require.Nil(t, err)
+
+	docs := make(map[int]string)
+	for i := 0; i < 100; i++ {
+		docs[i] = strings.Repeat(fmt.Sprintf("document %d ", i), i%7+1)
+		require.Nil(t, s.PutFromStream(strings.NewReader(docs[i]), i))
+	}
+	require.Greater(t, len(s.blocks), 10)
+	require.Greater(t, len(s.packs), 1)
+
+	require.Nil(t, s.Delete(50))
+	delete(docs, 50)
+
+	for id, want := range docs {
+		b, err := s.Get(id)
+		require.Nil(t, err)
+		require.Equal(t, want, string(b))
+	}
+	_, err = s.Get(50)
+	require.Equal(t, errDocNotInStore(50), err)
+}
+
+// TestPackedStoreLarge stores documents larger than a block, which get a
+// block of their own.
+func TestPackedStoreLarge(t *testing.T) {
+	s, err := newPackedStore(filepath.Join(t.TempDir(), "store"), 100, 1000)
+	require.Nil(t, err)
+
+	large := strings.Repeat("large document ", 100)
+	require.Nil(t, s.PutFromStream(strings.NewReader("small"), 0))
+	require.Nil(t, s.PutFromStream(strings.NewReader(large), 1))
+	require.Nil(t, s.PutFromStream(strings.NewReader("small again"), 2))
+	require.Len(t, s.blocks, 2)
+	require.True(t, s.blocks[1].large)
+
+	for id, want := range []string{"small", large, "small again"} {
+		b, err := s.Get(id)
+		require.Nil(t, err)
+		require.Equal(t, want, string(b))
+	}
+
+	// Large documents are decompressed as they're read.
+	f, err := s.Open(1)
+	require.Nil(t, err)
+	defer f.Close()
+	require.IsType(t, &blockReader{}, f)
+	for _, offset := range []int64{900, 15, 0, 1500, 2000} {
+		_, err := f.Seek(offset, io.SeekStart)
+		require.Nil(t, err)
+		b, err := io.ReadAll(f)
+		require.Nil(t, err)
+		want := ""
+		if offset < int64(len(large)) {
+			want = large[offset:]
+		}
+		require.Equal(t, want, string(b), offset)
+	}
+}
+
+// TestPackedStoreLargeUnlocked reads documents while a large document is
+// stored.
+func TestPackedStoreLargeUnlocked(t *testing.T) {
+	s, err := newPackedStore(filepath.Join(t.TempDir(), "store"), 100, 1000)
+	require.Nil(t, err)
+	require.Nil(t, s.PutFromStream(strings.NewReader("small"), 0))
+
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- s.PutFromStream(pr, 1)
+	}()
+	large := strings.Repeat("large document ", 100)
+	_, err = pw.Write([]byte(large))
+	require.Nil(t, err)
+
+	b, err := s.Get(0)
+	require.Nil(t, err)
+	require.Equal(t, "small", string(b))
+	require.Nil(t, s.PutFromStream(strings.NewReader("small again"), 2))
+
+	pw.Close()
+	require.Nil(t, <-done)
+	for id, want := range []string{"small", large, "small again"} {
+		b, err := s.Get(id)
+		require.Nil(t, err)
+		require.Equal(t, want, string(b))
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+
+	err := s.PutFromStream(strings.NewReader("hello world"), 1)
+	require.Nil(t, err)
+
+	b, err := s.Get(1)
+	require.Nil(t, err)
+	require.Equal(t, "hello world", string(b))
+
+	f, err := s.Open(1)
+	require.Nil(t, err)
+	_, err = f.Seek(6, io.SeekStart)
+	require.Nil(t, err)
+	b, err = io.ReadAll(f)
+	require.Nil(t, err)
+	require.Equal(t, "world", string(b))
+	require.Nil(t, f.Close())
+
+	_, err = s.Get(2)
+	require.Equal(t, errDocNotInStore(2), err)
+	require.True(t, errors.Is(err, errNotFound))
+
+	require.Nil(t, s.Delete(1))
+	_, err = s.Get(1)
+	require.Equal(t, errDocNotInStore(1), err)
+	require.Equal(t, errDocNotInStore(1), s.Delete(1))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// titleField is the document field holding the title.
+const titleField = "title"
+
+const (
+	// minRebuildInterval is the shortest time between two rebuilds of the
+	// tries of a suggester.
+	minRebuildInterval = time.Second
+
+	// rebuildCostFactor spaces rebuilds by this many times the time the
+	// last one took, so rebuilding large tries while documents are
+	// ingested takes a bounded share of the time.
+	rebuildCostFactor = 10
+)
+
+type Suggester interface {
+	Suggest(prefix string, size int, fuzzy bool) Suggestions
+}
+
+// Suggestions holds the completions of a prefix.
+type Suggestions struct {
+	Terms  []Completion `json:"terms"`
+	Titles []Completion `json:"titles"`
+}
+
+// suggester completes prefixes from the vocabulary of the index, weighted by
+// document frequency, and from the document titles, weighted by the number
+// of documents having the title. The tries are rebuilt on the first
+// suggestion after the index has changed, but no sooner than the rebuild
+// interval after the last rebuild, until which the old tries are used.
+//
+// builtAt is when the tries were last built, and took how long it took.
+type suggester struct {
+	idx Index
+
+	mu      sync.Mutex
+	built   bool
+	version uint64
+	terms   *trie
+	titles  *trie
+	builtAt time.Time
+	took    time.Duration
+}
+
+func NewSuggester(idx Index) Suggester {
+	return &suggester{
+		idx: idx,
+	}
+}
+
+// Suggest returns the size best completions of the prefix. If fuzzy is set,
+// prefixes with one typo are also completed, ranked below exact matches of
+// equal weight.
+func (s *suggester) Suggest(prefix string, size int, fuzzy bool) Suggestions {
+	terms, titles := s.tries()
+
+	prefix = strings.ToLower(prefix)
+	return Suggestions{
+		Terms:  terms.complete(prefix, size, fuzzy),
+		Titles: titles.complete(prefix, size, fuzzy),
+	}
+}
+
+// tries returns the tries of the current version of the index, or of an
+// earlier one if they were rebuilt within the rebuild interval.
+func (s *suggester) tries() (*trie, *trie) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := s.idx.Version()
+	if s.built && (s.version == version || time.Since(s.builtAt) < s.rebuildInterval()) {
+		return s.terms, s.titles
+	}
+	start := time.Now()
+
+	terms := newTrie()
+	for _, t := range s.idx.Terms() {
+		terms.add(t, float64(s.idx.DocFreq(t)))
+	}
+
+	titles := newTrie()
+	for _, id := range s.idx.DocIDs() {
+		for _, v := range s.idx.DocValues(id, titleField) {
+			titles.add(strings.ToLower(v.Str), 1)
+		}
+	}
+
+	s.terms = terms
+	s.titles = titles
+	s.version = version
+	s.built = true
+	s.builtAt = time.Now()
+	s.took = s.builtAt.Sub(start)
+	return terms, titles
+}
+
+// rebuildInterval returns the shortest time from the last rebuild to the
+// next. The caller must hold mu.
+func (s *suggester) rebuildInterval() time.Duration {
+	if d := rebuildCostFactor * s.took; d > minRebuildInterval {
+		return d
+	}
+	return minRebuildInterval
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuggest(t *testing.T) {
+	idx := NewIndex()
+	for _, doc := range []struct {
+		source string
+		title  string
+	}{
+		{"davis bike lanes", "Davis Bikes"},
+		{"davis farmers market", "Farmers Market"},
+	} {
+		id, err := idx.IndexDocument(strings.NewReader(doc.source))
+		require.Nil(t, err)
+		idx.SetFields(id, Fields{titleField: {doc.title}})
+	}
+
+	s := NewSuggester(idx)
+	res := s.Suggest("Da", 10, false)
+	require.Equal(t, Suggestions{
+		Terms:  []Completion{{Text: "davis", Weight: 2}},
+		Titles: []Completion{{Text: "davis bikes", Weight: 1}},
+	}, res)
+
+	// The suggester picks up changes to the index once the rebuild
+	// interval has passed.
+	_, err := idx.IndexDocument(strings.NewReader("dance"))
+	require.Nil(t, err)
+	res = s.Suggest("da", 10, false)
+	require.Equal(t, []Completion{{Text: "davis", Weight: 2}}, res.Terms)
+
+	ss := s.(*suggester)
+	ss.builtAt = ss.builtAt.Add(-ss.rebuildInterval())
+	res = s.Suggest("da", 10, false)
+	require.Equal(t, []Completion{{Text: "davis", Weight: 2}, {Text: "dance", Weight: 1}}, res.Terms)
+}
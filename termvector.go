@@ -0,0 +1,56 @@
+package main
+
+import "sort"
+
+// TermVector holds the terms of a single document.
+type TermVector struct {
+	DocID int               `json:"id"`
+	Terms []TermVectorEntry `json:"terms"`
+}
+
+// TermVectorEntry holds the occurrences of a term in a document.
+type TermVectorEntry struct {
+	Term      string   `json:"term"`
+	Freq      int      `json:"freq"`
+	Positions []int    `json:"positions,omitempty"`
+	Offsets   []Offset `json:"offsets,omitempty"`
+}
+
+// Offset is the byte range of a term occurrence in the text extracted from
+// the document source, see extractor. The text is as long as the source, so
+// an occurrence starts at the same offset in both, but character references
+// are decoded in the text and the range may differ from the one of the
+// occurrence in the source.
+type Offset struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// storedTerm is a term vector entry as stored in the index. The frequency
+// is the number of offsets, and positions are read from the postings.
+type storedTerm struct {
+	term    string
+	offsets []int
+}
+
+// newStoredTerms returns the term vector entries of a document from the
+// start offsets of every term, sorted by term.
+func newStoredTerms(offsets map[string][]int) []storedTerm {
+	out := make([]storedTerm, 0, len(offsets))
+	for t, o := range offsets {
+		out = append(out, storedTerm{term: t, offsets: o})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].term < out[j].term
+	})
+	return out
+}
+
+// freqs returns the term frequencies of the term vector.
+func (tv TermVector) freqs() map[string]int {
+	out := make(map[string]int, len(tv.Terms))
+	for _, t := range tv.Terms {
+		out[t.Term] = t.Freq
+	}
+	return out
+}
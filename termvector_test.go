@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleTermVector(t *testing.T) {
+	idx := NewIndex()
+	store, err := NewStore(t.TempDir())
+	require.Nil(t, err)
+	h := NewService(idx, NewQuerier(idx), store, Config{}).(*service).Handler()
+
+	source := "<p>caf&eacute; <b>hello</b></p>"
+	req := httptest.NewRequest("POST", "/doc?refresh=true", strings.NewReader(source))
+	req.Header.Set("Content-Type", "text/html")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	code, body := do(t, h, "GET", "/doc/0/termvector", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NotContains(t, body, `"text"`)
+
+	// Offsets point into the extracted text.
+	code, body = do(t, h, "GET", "/doc/0/termvector?text=true", "")
+	require.Equal(t, http.StatusOK, code)
+	var res TermVectorResponseBody
+	require.Nil(t, json.Unmarshal([]byte(body), &res))
+	require.NotNil(t, res.Text)
+	require.Len(t, *res.Text, len(source))
+	require.Len(t, res.Terms, 2)
+	for _, term := range res.Terms {
+		for _, o := range term.Offsets {
+			require.Equal(t, term.Term, (*res.Text)[o.Start:o.End])
+		}
+	}
+}
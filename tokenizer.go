@@ -10,6 +10,11 @@ import (
 
 var stopBytes = []byte{' ', '\n'}
 
+// maxWordLength is the longest word read from the input. Longer runs of
+// bytes without a stop byte are split into several words, which keeps the
+// memory used for a single word bounded.
+const maxWordLength = 64 << 10
+
 var patterns = []string{
 	`https?:\/\/[a-z0-9\/\?&\.,=\-_:#\+%@!]+`, // URL:s
 	`[a-z0-9\.\-_]+@[a-z0-9\.\-]+\.[a-z]+`,    // E-mail addresses.
@@ -33,18 +38,35 @@ type Tokenizer interface {
 	NextWord() ([]byte, error)
 	HasMoreTokens() bool
 	NextToken() (string, error)
+	Offset() int
 }
 
 type tokenizer struct {
 	r        *bufio.Reader
 	queue    [][]byte
 	patterns []regexp.Regexp
+
+	// read is the number of bytes read so far, wordStart is the byte
+	// offset of the last read word and offsets holds the byte offsets of
+	// the words in the queue.
+	read      int
+	wordStart int
+	offsets   []int
+
+	// offset is the byte offset of the last returned token.
+	offset int
 }
 
 func NewTokenizer(reader io.Reader) Tokenizer {
+	return newTokenizer(reader, patterns)
+}
+
+// newTokenizer returns a tokenizer finding tokens with the given patterns
+// instead of the default ones.
+func newTokenizer(reader io.Reader, patterns []string) Tokenizer {
 	return &tokenizer{
 		r:        bufio.NewReader(reader),
-		patterns: tokenPatterns(),
+		patterns: compilePatterns(patterns),
 	}
 }
 
@@ -71,13 +93,20 @@ readByte:
 			}
 			return nil, fmt.Errorf("read byte: %w", err)
 		}
+		t.read++
 		for _, s := range stopBytes {
 			if s == b {
 				break readByte
 			}
 		}
+		if out.Len() == 0 {
+			t.wordStart = t.read - 1
+		}
 		c := bytes.ToLower([]byte{b})[0]
 		out.WriteByte(c)
+		if out.Len() == maxWordLength {
+			break
+		}
 	}
 
 	if out.Len() == 0 {
@@ -111,6 +140,7 @@ func (t *tokenizer) NextToken() (string, error) {
 				return "", fmt.Errorf("read next word: %w", err)
 			}
 			t.queue = append(t.queue, word)
+			t.offsets = append(t.offsets, t.wordStart)
 		}
 
 		// Return if the queue is empty.
@@ -120,6 +150,11 @@ func (t *tokenizer) NextToken() (string, error) {
 
 		word := t.queue[0]
 		t.queue = t.queue[1:]
+		t.offset = 0
+		if len(t.offsets) != 0 {
+			t.offset = t.offsets[0]
+			t.offsets = t.offsets[1:]
+		}
 
 		token, err := t.TokenFromWord(word)
 		if err != nil {
@@ -134,6 +169,13 @@ func (t *tokenizer) NextToken() (string, error) {
 	return "", nil
 }
 
+// Offset returns the byte offset of the last returned token in the input.
+func (t *tokenizer) Offset() int {
+	return t.offset
+}
+
+// TokenFromWord returns the first token matching a pattern in the word,
+// which starts at the current offset. The rest of the word is queued.
 func (t *tokenizer) TokenFromWord(w []byte) ([]byte, error) {
 	for _, p := range t.patterns {
 		loc := p.FindIndex(w)
@@ -145,18 +187,21 @@ func (t *tokenizer) TokenFromWord(w []byte) ([]byte, error) {
 
 		if before := w[:loc[0]]; len(before) != 0 {
 			t.queue = append(t.queue, before)
+			t.offsets = append(t.offsets, t.offset)
 		}
 		if after := w[loc[1]:]; len(after) != 0 {
 			t.queue = append(t.queue, after)
+			t.offsets = append(t.offsets, t.offset+loc[1])
 		}
+		t.offset += loc[0]
 
 		return token, nil
 	}
 	return nil, nil
 }
 
-// TokenPatterns returns regexps for all allowed complex token patterns.
-func tokenPatterns() []regexp.Regexp {
+// compilePatterns returns regexps for the token patterns.
+func compilePatterns(patterns []string) []regexp.Regexp {
 	var out []regexp.Regexp
 	for _, p := range patterns {
 		re := regexp.MustCompile(p)
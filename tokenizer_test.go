@@ -180,6 +180,28 @@ func TestNextToken(t *testing.T) {
 	}
 }
 
+func TestOffset(t *testing.T) {
+	input := "Hello, (world)!\n  foo-bar baz"
+	want := []struct {
+		token  string
+		offset int
+	}{
+		{"hello", 0},
+		{"world", 8},
+		{"foo-bar", 18},
+		{"baz", 26},
+	}
+
+	tokenizer := NewTokenizer(strings.NewReader(input))
+	for _, w := range want {
+		res, err := tokenizer.NextToken()
+		require.Nil(t, err)
+		require.Equal(t, w.token, res)
+		require.Equal(t, w.offset, tokenizer.Offset())
+		require.Equal(t, w.token, strings.ToLower(input[w.offset:w.offset+len(w.token)]))
+	}
+}
+
 // Tokenize the file tokenizer_test_corpus.txt and verify that the result
 // corresponds with the tokens in tokenizer_test_tokens.txt
 func TestTokenizeCorpus(t *testing.T) {
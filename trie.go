@@ -0,0 +1,198 @@
+package main
+
+import "container/heap"
+
+// trie is a prefix tree of weighted strings. Every node knows the highest
+// weight in its subtree, so the best completions of a prefix can be found
+// without visiting the whole subtree.
+type trie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+
+	// value and weight are set if a string ends at the node.
+	value  string
+	weight float64
+	end    bool
+
+	// max is the highest weight of any string in the subtree.
+	max float64
+}
+
+// Completion is a string completing a prefix.
+type Completion struct {
+	Text   string  `json:"text"`
+	Weight float64 `json:"weight"`
+}
+
+func newTrie() *trie {
+	return &trie{root: &trieNode{}}
+}
+
+// add inserts the string with the given weight. Adding a string again adds
+// to its weight.
+func (t *trie) add(s string, weight float64) {
+	n := t.root
+	path := []*trieNode{n}
+	for i := 0; i < len(s); i++ {
+		if n.children == nil {
+			n.children = make(map[byte]*trieNode)
+		}
+		child, ok := n.children[s[i]]
+		if !ok {
+			child = &trieNode{}
+			n.children[s[i]] = child
+		}
+		n = child
+		path = append(path, n)
+	}
+
+	n.value = s
+	n.weight += weight
+	n.end = true
+	for _, p := range path {
+		if n.weight > p.max {
+			p.max = n.weight
+		}
+	}
+}
+
+// complete returns the size highest weighted strings starting with the
+// prefix. If fuzzy is set, prefixes one edit away from the given one are
+// also completed, with their weights halved.
+func (t *trie) complete(prefix string, size int, fuzzy bool) []Completion {
+	starts := make(map[*trieNode]int)
+	maxEdits := 0
+	if fuzzy {
+		maxEdits = 1
+	}
+	t.root.walk(prefix, 0, 0, maxEdits, starts)
+
+	q := &completionQueue{}
+	for n, edits := range starts {
+		heap.Push(q, completionItem{node: n, factor: editFactor(edits)})
+	}
+
+	var out []Completion
+	seen := make(map[string]bool)
+	for q.Len() > 0 && len(out) < size {
+		item := heap.Pop(q).(completionItem)
+		if item.emit {
+			if !seen[item.node.value] {
+				seen[item.node.value] = true
+				out = append(out, Completion{
+					Text:   item.node.value,
+					Weight: item.node.weight * item.factor,
+				})
+			}
+			continue
+		}
+
+		n := item.node
+		if n.end {
+			heap.Push(q, completionItem{node: n, factor: item.factor, emit: true})
+		}
+		for _, c := range n.children {
+			heap.Push(q, completionItem{node: c, factor: item.factor})
+		}
+	}
+	return out
+}
+
+// walk finds the nodes reached by the prefix from position i, having used
+// edits of at most maxEdits substitutions, insertions, deletions or
+// transpositions. The reached nodes are recorded with the fewest edits
+// needed to reach them.
+func (n *trieNode) walk(prefix string, i, edits, maxEdits int, reached map[*trieNode]int) {
+	if i == len(prefix) {
+		if e, ok := reached[n]; !ok || edits < e {
+			reached[n] = edits
+		}
+		return
+	}
+
+	if c, ok := n.children[prefix[i]]; ok {
+		c.walk(prefix, i+1, edits, maxEdits, reached)
+	}
+	if edits == maxEdits {
+		return
+	}
+
+	// Deletion, the prefix has an extra character.
+	n.walk(prefix, i+1, edits+1, maxEdits, reached)
+
+	for b, c := range n.children {
+		// Insertion, the prefix misses a character.
+		c.walk(prefix, i, edits+1, maxEdits, reached)
+
+		// Substitution.
+		if b != prefix[i] {
+			c.walk(prefix, i+1, edits+1, maxEdits, reached)
+		}
+	}
+
+	// Transposition of two adjacent characters.
+	if i+1 < len(prefix) {
+		if c, ok := n.children[prefix[i+1]]; ok {
+			if gc, ok := c.children[prefix[i]]; ok {
+				gc.walk(prefix, i+2, edits+1, maxEdits, reached)
+			}
+		}
+	}
+}
+
+// editFactor returns the weight multiplier of completions of a prefix
+// reached with the given number of edits.
+func editFactor(edits int) float64 {
+	if edits == 0 {
+		return 1
+	}
+	return 0.5
+}
+
+// completionItem is a node in the best-first search for completions. Items
+// to emit are the string ending at the node; other items are subtrees still
+// to be explored.
+type completionItem struct {
+	node   *trieNode
+	factor float64
+	emit   bool
+}
+
+func (i completionItem) priority() float64 {
+	if i.emit {
+		return i.node.weight * i.factor
+	}
+	return i.node.max * i.factor
+}
+
+// completionQueue is a max-heap of completion items. Items with equal
+// priority are ordered so that strings are emitted before subtrees are
+// explored, and then alphabetically.
+type completionQueue []completionItem
+
+func (q completionQueue) Len() int { return len(q) }
+
+func (q completionQueue) Less(i, j int) bool {
+	pi, pj := q[i].priority(), q[j].priority()
+	if pi != pj {
+		return pi > pj
+	}
+	if q[i].emit != q[j].emit {
+		return q[i].emit
+	}
+	return q[i].node.value < q[j].node.value
+}
+
+func (q completionQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *completionQueue) Push(x interface{}) { *q = append(*q, x.(completionItem)) }
+
+func (q *completionQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
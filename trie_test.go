@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrieComplete(t *testing.T) {
+	tr := newTrie()
+	tr.add("davis", 10)
+	tr.add("david", 3)
+	tr.add("day", 5)
+	tr.add("dog", 20)
+	tr.add("data", 1)
+	tr.add("data", 1)
+
+	tests := []struct {
+		name   string
+		prefix string
+		size   int
+		fuzzy  bool
+		res    []Completion
+	}{
+		{
+			name:   "highest weights first",
+			prefix: "da",
+			size:   3,
+			res: []Completion{
+				{Text: "davis", Weight: 10},
+				{Text: "day", Weight: 5},
+				{Text: "david", Weight: 3},
+			},
+		},
+		{
+			name:   "repeated strings add weight",
+			prefix: "dat",
+			size:   3,
+			res: []Completion{
+				{Text: "data", Weight: 2},
+			},
+		},
+		{
+			name:   "no completions",
+			prefix: "x",
+			size:   3,
+		},
+		{
+			name:   "typo",
+			prefix: "dvai",
+			size:   3,
+			fuzzy:  true,
+			res: []Completion{
+				{Text: "davis", Weight: 5},
+				{Text: "david", Weight: 1.5},
+			},
+		},
+		{
+			name:   "exact matches rank above typos",
+			prefix: "do",
+			size:   2,
+			fuzzy:  true,
+			res: []Completion{
+				{Text: "dog", Weight: 20},
+				{Text: "davis", Weight: 5},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tr.complete(tt.prefix, tt.size, tt.fuzzy)
+			require.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func BenchmarkTrieComplete(b *testing.B) {
+	tr := newTrie()
+	for i := 0; i < 100000; i++ {
+		tr.add(fmt.Sprintf("term%d", i), float64(i%100))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.complete("term12", 10, true)
+	}
+}
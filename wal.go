@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// walOp is a document change recorded in the write-ahead log. Action is one
+// of the bulk actions. Deletions only have an external ID, the other
+// actions have the fields and source of the document. DocID is set for
+// documents indexed with a given ID, see Batch.IndexAs.
+//
+// The source is either kept in the record, or, for documents that may be
+// too large for that, in a file in the sources directory of the log named
+// by Blob.
+type walOp struct {
+	Action     string `json:"a"`
+	ExternalID string `json:"id,omitempty"`
+	Fields     Fields `json:"f,omitempty"`
+	Source     []byte `json:"s,omitempty"`
+	Blob       string `json:"b,omitempty"`
+	DocID      *int   `json:"d,omitempty"`
+
+	// path is the file holding the source, if it's not in the record.
+	path string
+}
+
+// inlineSourceSize is the size of the largest source kept in a record
+// rather than in a file of its own.
+const inlineSourceSize = 64 << 10
+
+// open opens the source of the document.
+func (op walOp) open() (io.ReadCloser, error) {
+	if op.path != "" {
+		return os.Open(op.path)
+	}
+	return ioutil.NopCloser(bytes.NewReader(op.Source)), nil
+}
+
+// addTo adds the change to the batch.
+func (op walOp) addTo(b *Batch) error {
+	if op.Action == actionDelete {
+		b.Delete(op.ExternalID)
+		return nil
+	}
+	if op.Action != actionIndex && op.Action != actionUpdate {
+		return fmt.Errorf("unknown action '%s'", op.Action)
+	}
+
+	r, err := op.open()
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer r.Close()
+
+	switch {
+	case op.Action == actionUpdate:
+		return b.Update(r, op.Fields)
+	case op.DocID != nil:
+		return b.IndexAs(*op.DocID, r, op.Fields)
+	}
+	return b.Index(r, op.Fields)
+}
+
+// syncPolicy decides when appends to the write-ahead log are synced to disk.
+type syncPolicy int
+
+const (
+	// syncAlways syncs every append before it returns.
+	syncAlways syncPolicy = iota
+	// syncInterval syncs periodically, so a crash may lose the changes of
+	// the last interval.
+	syncInterval
+	// syncNever leaves syncing to the operating system.
+	syncNever
+)
+
+func parseSyncPolicy(s string) (syncPolicy, error) {
+	switch s {
+	case "always":
+		return syncAlways, nil
+	case "interval":
+		return syncInterval, nil
+	case "never":
+		return syncNever, nil
+	}
+	return 0, fmt.Errorf("invalid sync policy '%s'", s)
+}
+
+// walHeaderSize is the size of a record header: the length of the record
+// and its CRC-32C checksum, both as big endian uint32.
+const walHeaderSize = 8
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeAheadLog is an append-only log of document changes. Every change is
+// appended before it's applied to the index and the store, so the state of
+// both can be rebuilt by replaying the log.
+//
+// A record holds the changes applied as one batch. Records are framed by a
+// header with their length and checksum. A crash while appending leaves a
+// torn record at the end of the log, which is discarded when the log is
+// replayed.
+//
+// Sources not kept in the records are written to the sources directory, a
+// sibling of the log named like it with the suffix .sources, before the
+// record referring to them is appended.
+//
+// The store is rebuilt from the log whenever the service starts, so the log
+// holds every change since the index was created, including those to
+// documents since replaced or deleted. Compact rewrites it with only the
+// documents in the index.
+type writeAheadLog struct {
+	mu      sync.Mutex
+	path    string
+	file    walFile
+	sources string
+	policy  syncPolicy
+	dirty   bool
+
+	// torn is set when a failed write may have left part of a record at the
+	// end of the log. Nothing is appended until it's cut off again.
+	torn bool
+
+	// offsets holds the offset of every record in the log and size the
+	// size of the log. Both are set by Replay.
+	offsets []int64
+	size    int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// walFile is the file of a write-ahead log.
+type walFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// openWAL opens the write-ahead log at the given path, creating it if it
+// doesn't exist. The log must be replayed before anything is appended.
+//
+// With syncInterval, the log is synced every interval until it's closed.
+func openWAL(path string, policy syncPolicy, interval time.Duration) (*writeAheadLog, error) {
+	sources := path + ".sources"
+	if err := os.MkdirAll(sources, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	w := &writeAheadLog{
+		path:    path,
+		file:    file,
+		sources: sources,
+		policy:  policy,
+		done:    make(chan struct{}),
+	}
+	if policy == syncInterval {
+		w.wg.Add(1)
+		go w.syncEvery(interval)
+	}
+	return w, nil
+}
+
+// Replay calls fn with the changes of every record in the log, in order.
+// The log is truncated after the last complete record, so new records are
+// appended after it, and sources no record refers to are removed.
+func (w *writeAheadLog) Replay(fn func(ops []walOp) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	r := bufio.NewReader(w.file)
+	var offset int64
+	used := make(map[string]bool)
+	w.offsets = w.offsets[:0]
+	for {
+		record, err := readRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("wal: discarding torn record at offset %d: %v", offset, err)
+			break
+		}
+
+		var ops []walOp
+		if err := json.Unmarshal(record, &ops); err != nil {
+			return fmt.Errorf("unmarshal record at offset %d: %w", offset, err)
+		}
+		for i, op := range ops {
+			if op.Blob != "" {
+				used[op.Blob] = true
+				ops[i].path = w.sourcePath(op.Blob)
+			}
+		}
+		if err := fn(ops); err != nil {
+			return fmt.Errorf("replay record at offset %d: %w", offset, err)
+		}
+		w.offsets = append(w.offsets, offset)
+		offset += int64(walHeaderSize + len(record))
+	}
+	w.size = offset
+
+	if err := w.file.Truncate(offset); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	if _, err := w.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+
+	return w.removeSources(used)
+}
+
+// removeSources removes the sources not in used from the sources directory.
+func (w *writeAheadLog) removeSources(used map[string]bool) error {
+	entries, err := os.ReadDir(w.sources)
+	if err != nil {
+		return fmt.Errorf("read sources: %w", err)
+	}
+	for _, e := range entries {
+		if used[e.Name()] {
+			continue
+		}
+		if err := os.Remove(w.sourcePath(e.Name())); err != nil {
+			return fmt.Errorf("remove source: %w", err)
+		}
+	}
+	return nil
+}
+
+// createSource creates a file in the sources directory, to be closed with
+// closeSource before a record refers to it by its name.
+func (w *writeAheadLog) createSource() (*os.File, error) {
+	return ioutil.TempFile(w.sources, "source-")
+}
+
+// closeSource closes a source created with createSource, syncing it first
+// unless the policy is syncNever.
+func (w *writeAheadLog) closeSource(f *os.File) error {
+	if w.policy != syncNever {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("sync: %w", err)
+		}
+	}
+	return f.Close()
+}
+
+func (w *writeAheadLog) sourcePath(name string) string {
+	return filepath.Join(w.sources, name)
+}
+
+var errTornRecord = errors.New("torn record")
+
+// readRecord reads the next record from the reader, of which at most size
+// bytes remain. It returns io.EOF if there are no more records and
+// errTornRecord if the next record is incomplete or corrupt.
+func readRecord(r io.Reader, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, io.EOF
+	}
+
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errTornRecord
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if int64(n) > size-walHeaderSize {
+		return nil, errTornRecord
+	}
+
+	record := make([]byte, n)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, errTornRecord
+	}
+	if crc32.Checksum(record, walTable) != sum {
+		return nil, errTornRecord
+	}
+	return record, nil
+}
+
+// encodeRecord returns the changes framed as a record of the log.
+func encodeRecord(ops []walOp) ([]byte, error) {
+	record, err := json.Marshal(ops)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+
+	buf := make([]byte, walHeaderSize+len(record))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(record, walTable))
+	copy(buf[walHeaderSize:], record)
+	return buf, nil
+}
+
+// Append appends a record with the changes to the log. With syncAlways, the
+// record is synced to disk before Append returns.
+func (w *writeAheadLog) Append(ops []walOp) error {
+	buf, err := encodeRecord(ops)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.torn {
+		if err := w.cut(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.file.Write(buf); err != nil {
+		w.torn = true
+		if err := w.cut(); err != nil {
+			log.Printf("wal: %v", err)
+		}
+		return fmt.Errorf("write: %w", err)
+	}
+	w.offsets = append(w.offsets, w.size)
+	w.size += int64(len(buf))
+	w.dirty = true
+
+	if w.policy == syncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+// cut cuts off whatever a failed write left after the last record, so the
+// next record is appended right after it. The caller must hold the lock.
+func (w *writeAheadLog) cut() error {
+	if err := w.file.Truncate(w.size); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		return fmt.Errorf("seek: %w", err)
+	}
+	w.torn = false
+	return nil
+}
+
+// Len returns the number of records in the log.
+func (w *writeAheadLog) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.offsets)
+}
+
+// Read returns the changes of the record with the given number, counting
+// from zero. Sources not kept in the record are referred to by path, like
+// in Replay.
+func (w *writeAheadLog) Read(n int) ([]walOp, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n < 0 || n >= len(w.offsets) {
+		return nil, fmt.Errorf("record %d of %d", n, len(w.offsets))
+	}
+	end := w.size
+	if n+1 < len(w.offsets) {
+		end = w.offsets[n+1]
+	}
+
+	buf := make([]byte, end-w.offsets[n])
+	if _, err := w.file.ReadAt(buf, w.offsets[n]); err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	record, err := readRecord(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %w", n, err)
+	}
+
+	var ops []walOp
+	if err := json.Unmarshal(record, &ops); err != nil {
+		return nil, fmt.Errorf("unmarshal record %d: %w", n, err)
+	}
+	for i, op := range ops {
+		if op.Blob != "" {
+			ops[i].path = w.sourcePath(op.Blob)
+		}
+	}
+	return ops, nil
+}
+
+// Truncate removes the records from the one with the given number on. Their
+// sources are removed on the next replay.
+func (w *writeAheadLog) Truncate(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if n < 0 || n > len(w.offsets) {
+		return fmt.Errorf("record %d of %d", n, len(w.offsets))
+	}
+	if n == len(w.offsets) {
+		return nil
+	}
+	w.size = w.offsets[n]
+	w.offsets = w.offsets[:n]
+	w.dirty = true
+	if err := w.cut(); err != nil {
+		w.torn = true
+		return err
+	}
+	return w.sync()
+}
+
+// Compact replaces the log with the records fn adds with add. The new log is
+// written next to the log and renamed over it once it's complete and synced,
+// so a crash while compacting leaves the old log in place, and the directory
+// is synced after the rename so the new log survives a crash. Sources no record
+// of the new log refers to are removed.
+//
+// Records are numbered from the start of the log, so compacting renumbers
+// them. Nothing may be appended to the log while it's compacted.
+func (w *writeAheadLog) Compact(fn func(add func(ops []walOp) error) error) error {
+	path := w.path + ".compact"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	var offsets []int64
+	var size int64
+	used := make(map[string]bool)
+	add := func(ops []walOp) error {
+		buf, err := encodeRecord(ops)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(buf); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+		offsets = append(offsets, size)
+		size += int64(len(buf))
+		for _, op := range ops {
+			if op.Blob != "" {
+				used[op.Blob] = true
+			}
+		}
+		return nil
+	}
+
+	err = fn(add)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(path, w.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	dirErr := syncDir(filepath.Dir(w.path))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Close(); err != nil {
+		log.Printf("wal: close compacted log: %v", err)
+	}
+	w.file = file
+	w.offsets = offsets
+	w.size = size
+	w.dirty = false
+
+	// Until the rename is durable, a crash may bring back the old log and
+	// the sources it refers to must be kept.
+	if dirErr != nil {
+		return dirErr
+	}
+	return w.removeSources(used)
+}
+
+// syncDir syncs the directory, making renames in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+	return nil
+}
+
+// sync syncs the log to disk if anything was appended since the last sync.
+// The caller must hold the lock.
+func (w *writeAheadLog) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *writeAheadLog) syncEvery(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if err := w.sync(); err != nil {
+				log.Printf("wal: %v", err)
+			}
+			w.mu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close syncs and closes the log.
+func (w *writeAheadLog) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
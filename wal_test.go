@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// replayAll replays the log and returns its records.
+func replayAll(t *testing.T, w *writeAheadLog) [][]walOp {
+	t.Helper()
+	var records [][]walOp
+	require.Nil(t, w.Replay(func(ops []walOp) error {
+		records = append(records, ops)
+		return nil
+	}))
+	return records
+}
+
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	records := [][]walOp{
+		{{Action: actionIndex, Fields: Fields{externalIDField: {"a"}}, Source: []byte("hello world")}},
+		{{Action: actionDelete, ExternalID: "a"}, {Action: actionIndex, Source: []byte("hello")}},
+	}
+
+	w, err := openWAL(path, syncAlways, 0)
+	require.Nil(t, err)
+	require.Empty(t, replayAll(t, w))
+	for _, ops := range records {
+		require.Nil(t, w.Append(ops))
+	}
+	require.Nil(t, w.Close())
+
+	w, err = openWAL(path, syncInterval, time.Millisecond)
+	require.Nil(t, err)
+	require.Equal(t, records, replayAll(t, w))
+	require.Nil(t, w.Append(records[0]))
+	require.Nil(t, w.Close())
+
+	w, err = openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	require.Equal(t, append(records, records[0]), replayAll(t, w))
+	require.Nil(t, w.Close())
+}
+
+func TestWALCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	require.Nil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: "a"}}))
+	require.Nil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: "b"}}))
+	require.Nil(t, w.Close())
+
+	// Flip a byte in the last record.
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	data[len(data)-2] ^= 0xff
+	require.Nil(t, os.WriteFile(path, data, 0644))
+
+	w, err = openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	require.Equal(t, [][]walOp{{{Action: actionDelete, ExternalID: "a"}}}, replayAll(t, w))
+	require.Nil(t, w.Close())
+}
+
+// TestWALReadTruncate reads records by number and truncates the log.
+func TestWALReadTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	require.Empty(t, replayAll(t, w))
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: id}}))
+	}
+	require.Equal(t, 3, w.Len())
+	ops, err := w.Read(1)
+	require.Nil(t, err)
+	require.Equal(t, []walOp{{Action: actionDelete, ExternalID: "b"}}, ops)
+	_, err = w.Read(3)
+	require.NotNil(t, err)
+
+	// Records are appended after the truncated log.
+	require.Nil(t, w.Truncate(1))
+	require.Equal(t, 1, w.Len())
+	require.Nil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: "d"}}))
+	ops, err = w.Read(1)
+	require.Nil(t, err)
+	require.Equal(t, "d", ops[0].ExternalID)
+	require.Equal(t, [][]walOp{
+		{{Action: actionDelete, ExternalID: "a"}},
+		{{Action: actionDelete, ExternalID: "d"}},
+	}, replayAll(t, w))
+	require.Equal(t, 2, w.Len())
+}
+
+// shortWriteFile writes only half of the next write after fail is set.
+type shortWriteFile struct {
+	walFile
+	fail bool
+}
+
+func (f *shortWriteFile) Write(p []byte) (int, error) {
+	if !f.fail {
+		return f.walFile.Write(p)
+	}
+	f.fail = false
+	n, _ := f.walFile.Write(p[:len(p)/2])
+	return n, io.ErrShortWrite
+}
+
+func TestWALShortWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := openWAL(path, syncAlways, 0)
+	require.Nil(t, err)
+	require.Empty(t, replayAll(t, w))
+	file := &shortWriteFile{walFile: w.file}
+	w.file = file
+
+	require.Nil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: "a"}}))
+	file.fail = true
+	require.NotNil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: "b"}}))
+
+	// The next record is appended after the last complete one.
+	require.Nil(t, w.Append([]walOp{{Action: actionDelete, ExternalID: "c"}}))
+	require.Equal(t, 2, w.Len())
+	require.Nil(t, w.Close())
+
+	w, err = openWAL(path, syncAlways, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	require.Equal(t, [][]walOp{
+		{{Action: actionDelete, ExternalID: "a"}},
+		{{Action: actionDelete, ExternalID: "c"}},
+	}, replayAll(t, w))
+}
+
+// TestWALSources indexes documents through a service and checks that small
+// sources are kept in the records and large ones next to the log.
+func TestWALSources(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal")
+	w, err := openWAL(path, syncAlways, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	require.Nil(t, s.recover())
+
+	large := strings.Repeat("l", inlineSourceSize+1)
+	_, err = s.indexDoc(strings.NewReader("hello world"), Fields{}, false)
+	require.Nil(t, err)
+	_, err = s.indexDoc(strings.NewReader(large), Fields{}, false)
+	require.Nil(t, err)
+
+	// A document too large is rejected and leaves nothing behind.
+	s.maxDocSize = 5
+	_, err = s.indexDoc(newMaxSizeReader(strings.NewReader("hello world"), s.maxDocSize), Fields{}, false)
+	require.True(t, errors.Is(err, errDocTooLarge))
+
+	records := replayAll(t, w)
+	require.Len(t, records, 2)
+	op := records[0][0]
+	require.Equal(t, "hello world", string(op.Source))
+	require.Empty(t, op.Blob)
+	op = records[1][0]
+	require.Empty(t, op.Source)
+	source, err := os.ReadFile(filepath.Join(path+".sources", op.Blob))
+	require.Nil(t, err)
+	require.Equal(t, large, string(source))
+
+	// Only the large source is left in the sources directory, and sources
+	// no record refers to are removed on replay.
+	orphan := filepath.Join(path+".sources", "orphan")
+	require.Nil(t, os.WriteFile(orphan, []byte("orphan"), 0644))
+	replayAll(t, w)
+	entries, err := os.ReadDir(path + ".sources")
+	require.Nil(t, err)
+	require.Len(t, entries, 1)
+}
+
+// TestDocTooLarge posts documents larger than the limit, with and without
+// a content length, and checks that they're rejected.
+func TestDocTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal")
+	w, err := openWAL(path, syncNever, 0)
+	require.Nil(t, err)
+	defer w.Close()
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	require.Nil(t, s.recover())
+	s.maxDocSize = 5
+	h := s.Handler()
+
+	code, _ := do(t, h, "POST", "/doc", "hello world")
+	require.Equal(t, http.StatusRequestEntityTooLarge, code)
+
+	// A chunked body has no content length, so it's cut off while read.
+	req := httptest.NewRequest("POST", "/doc", io.MultiReader(strings.NewReader("hello"), strings.NewReader(" world")))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	code, _ = do(t, h, "POST", "/doc", "hello")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, replayAll(t, w), 1)
+	entries, err := os.ReadDir(path + ".sources")
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
+func TestMaxSizeReader(t *testing.T) {
+	b, err := io.ReadAll(newMaxSizeReader(strings.NewReader("hello"), 5))
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(b))
+
+	b, err = io.ReadAll(newMaxSizeReader(strings.NewReader("hello world"), 5))
+	require.Equal(t, errDocTooLarge, err)
+	require.Equal(t, "hello", string(b))
+}
+
+// TestCrashRecovery truncates the log of a service at every offset, as if
+// the service crashed while appending, and checks that a new service
+// recovers every complete record and nothing else.
+func TestCrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal")
+
+	w, err := openWAL(path, syncAlways, 0)
+	require.Nil(t, err)
+	s := newTestService(t, filepath.Join(dir, "store"), w)
+	require.Nil(t, s.recover())
+
+	// ends holds the size of the log after each record.
+	var ends []int64
+	appendEnd := func() {
+		info, err := os.Stat(path)
+		require.Nil(t, err)
+		ends = append(ends, info.Size())
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := s.indexDoc(strings.NewReader(fmt.Sprintf("hello world %d", i)), Fields{externalIDField: {fmt.Sprint(i)}}, false)
+		require.Nil(t, err)
+		appendEnd()
+	}
+	_, err = s.indexDoc(strings.NewReader("goodbye"), Fields{externalIDField: {"0"}}, false)
+	require.Nil(t, err)
+	appendEnd()
+	require.Nil(t, w.Close())
+
+	data, err := os.ReadFile(path)
+	require.Nil(t, err)
+	sources := path + ".sources"
+
+	for size := 0; size <= len(data); size++ {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "wal")
+			require.Nil(t, os.WriteFile(path, data[:size], 0644))
+			copySources(t, sources, path+".sources")
+
+			w, err := openWAL(path, syncNever, 0)
+			require.Nil(t, err)
+			defer w.Close()
+			s := newTestService(t, filepath.Join(dir, "store"), w)
+			require.Nil(t, s.recover())
+
+			records := 0
+			for records < len(ends) && ends[records] <= int64(size) {
+				records++
+			}
+
+			// The torn record is discarded.
+			info, err := os.Stat(path)
+			require.Nil(t, err)
+			if records == 0 {
+				require.Equal(t, int64(0), info.Size())
+			} else {
+				require.Equal(t, ends[records-1], info.Size())
+			}
+
+			require.Equal(t, min(records, 3), s.idx.DocCount())
+			for _, id := range s.idx.DocIDs() {
+				source, err := s.store.Get(id)
+				require.Nil(t, err)
+				if records == 4 && s.idx.Fields(id).first(externalIDField) == "0" {
+					require.Equal(t, "goodbye", string(source))
+				}
+			}
+
+			// New changes are appended after the recovered records.
+			_, err = s.indexDoc(strings.NewReader("hello"), Fields{}, false)
+			require.Nil(t, err)
+			require.Equal(t, records+1, len(replayAll(t, w)))
+		})
+	}
+}
+
+// copySources copies the sources directory of a log.
+func copySources(t *testing.T, from, to string) {
+	t.Helper()
+	require.Nil(t, os.MkdirAll(to, 0755))
+	entries, err := os.ReadDir(from)
+	require.Nil(t, err)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(from, e.Name()))
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(filepath.Join(to, e.Name()), data, 0644))
+	}
+}
+
+func newTestService(t *testing.T, root string, w *writeAheadLog) *service {
+	t.Helper()
+	idx := NewIndex()
+	store, err := NewStore(root)
+	require.Nil(t, err)
+	return NewService(idx, NewQuerier(idx), store, Config{WAL: w}).(*service)
+}